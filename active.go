@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of active transfers.
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// transferChunk is how much of a file is sent at a time, between checks
+// whether the transfer was canceled.
+const transferChunk = 1 << 20
+
+// transferStallTimeout is how long a transfer may go without progress. As
+// long as it makes progress, it outlasts the timeouts of the server.
+const transferStallTimeout = time.Minute
+
+var errTransferCanceled = errors.New("transfer canceled by an administrator")
+
+// ActiveTransfer is an upload or download in progress.
+type ActiveTransfer struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Path     string    `json:"path"`
+	User     string    `json:"user,omitempty"`
+	Client   string    `json:"client"`
+	Bytes    int64     `json:"bytes"`
+	Total    int64     `json:"total"` // -1 when unknown
+	Rate     float64   `json:"rate"`  // bytes per second
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration"` // seconds
+}
+
+// activeTransfer is the accounting of a transfer, updated by its copy.
+type activeTransfer struct {
+	info     ActiveTransfer
+	n        int64
+	total    int64
+	canceled int32
+}
+
+func (t *activeTransfer) add(n int) {
+	atomic.AddInt64(&t.n, int64(n))
+}
+
+func (t *activeTransfer) isCanceled() bool {
+	return atomic.LoadInt32(&t.canceled) == 1
+}
+
+// activeTransfers tracks the uploads and downloads in progress, so that
+// administrators can see and cancel them.
+type activeTransfers struct {
+	mu        sync.Mutex
+	nextID    uint64
+	transfers map[string]*activeTransfer
+}
+
+func newActiveTransfers() *activeTransfers {
+	return &activeTransfers{transfers: map[string]*activeTransfer{}}
+}
+
+func (a *activeTransfers) begin(info ActiveTransfer, total int64) *activeTransfer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nextID++
+	info.ID = strconv.FormatUint(a.nextID, 10)
+	info.Started = time.Now().UTC()
+	t := &activeTransfer{info: info, total: total}
+	a.transfers[info.ID] = t
+	return t
+}
+
+func (a *activeTransfers) end(t *activeTransfer) {
+	a.mu.Lock()
+	delete(a.transfers, t.info.ID)
+	a.mu.Unlock()
+}
+
+// cancel makes the copy of the transfer with the given ID fail, reporting
+// whether there is one.
+func (a *activeTransfers) cancel(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.transfers[id]
+	if ok {
+		atomic.StoreInt32(&t.canceled, 1)
+	}
+	return ok
+}
+
+// list returns the transfers in progress, oldest first.
+func (a *activeTransfers) list() []ActiveTransfer {
+	now := time.Now()
+	a.mu.Lock()
+	transfers := make([]ActiveTransfer, 0, len(a.transfers))
+	for _, t := range a.transfers {
+		info := t.info
+		info.Bytes = atomic.LoadInt64(&t.n)
+		info.Total = atomic.LoadInt64(&t.total)
+		elapsed := now.Sub(info.Started).Seconds()
+		info.Duration = elapsed
+		if elapsed > 0 {
+			info.Rate = float64(info.Bytes) / elapsed
+		}
+		transfers = append(transfers, info)
+	}
+	a.mu.Unlock()
+	sort.Slice(transfers, func(i, j int) bool {
+		a, _ := strconv.ParseUint(transfers[i].ID, 10, 64)
+		b, _ := strconv.ParseUint(transfers[j].ID, 10, 64)
+		return a < b
+	})
+	return transfers
+}
+
+// err returns why the transfer for a request with ctx has to stop: it was
+// canceled, or the client went away. It returns nil otherwise.
+func (t *activeTransfer) err(ctx context.Context) error {
+	if t.isCanceled() {
+		return errTransferCanceled
+	}
+	return ctx.Err()
+}
+
+// transferDeadline pushes the read and write deadlines of the connection
+// of a transfer ahead as it makes progress, at most once a second. Both
+// are needed either way: the server stops reading the connection of a
+// download at the read deadline, and responds to an upload once it's in.
+type transferDeadline struct {
+	rc   *http.ResponseController
+	last time.Time
+}
+
+func (d *transferDeadline) extend() {
+	now := time.Now()
+	if now.Sub(d.last) < time.Second {
+		return
+	}
+	d.last = now
+	d.rc.SetReadDeadline(now.Add(transferStallTimeout))
+	d.rc.SetWriteDeadline(now.Add(transferStallTimeout))
+}
+
+// transferReader accounts the request body of an upload and fails once it
+// is canceled or the request is done.
+type transferReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	t        *activeTransfer
+	deadline transferDeadline
+}
+
+func (tr *transferReader) Read(b []byte) (int, error) {
+	if err := tr.t.err(tr.ctx); err != nil {
+		return 0, err
+	}
+	tr.deadline.extend()
+	n, err := tr.ReadCloser.Read(b)
+	tr.t.add(n)
+	return n, err
+}
+
+// transferWriter accounts the response of a download and fails once it is
+// canceled or the client goes away, keeping the optional interfaces of the
+// writer it wraps.
+type transferWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	t        *activeTransfer
+	deadline transferDeadline
+}
+
+func (tw *transferWriter) WriteHeader(status int) {
+	if n, err := strconv.ParseInt(tw.Header().Get("Content-Length"), 10, 64); err == nil {
+		atomic.StoreInt64(&tw.t.total, n)
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *transferWriter) Write(b []byte) (int, error) {
+	if err := tw.t.err(tw.ctx); err != nil {
+		return 0, err
+	}
+	tw.deadline.extend()
+	n, err := tw.ResponseWriter.Write(b)
+	tw.t.add(n)
+	return n, err
+}
+
+// ReadFrom sends src in chunks, each of which can still go through
+// sendfile, so that cancellations and disconnects take effect in the
+// middle of files.
+func (tw *transferWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := tw.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		rf = &writerReaderFrom{writerOnly{tw.ResponseWriter}}
+	}
+	// Files come limited to the range sent, which sendfile only sees
+	// through a single LimitedReader.
+	lr, ok := src.(*io.LimitedReader)
+	if !ok {
+		lr = &io.LimitedReader{R: src, N: math.MaxInt64}
+	}
+	var total int64
+	for lr.N > 0 {
+		if err := tw.t.err(tw.ctx); err != nil {
+			return total, err
+		}
+		tw.deadline.extend()
+		chunk := &io.LimitedReader{R: lr.R, N: transferChunk}
+		if lr.N < chunk.N {
+			chunk.N = lr.N
+		}
+		want := chunk.N
+		n, err := rf.ReadFrom(chunk)
+		lr.N -= n
+		total += n
+		tw.t.add(int(n))
+		if err != nil || n < want {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (tw *transferWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *transferWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T doesn't support hijacking", tw.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the connection under tw.
+func (tw *transferWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// writerReaderFrom copies into a writer without ReadFrom of its own.
+type writerReaderFrom struct {
+	w io.Writer
+}
+
+func (wr *writerReaderFrom) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(wr.w, src)
+}
+
+// trackUpload registers the upload of the share path p through the body
+// of r as an active transfer, with w the response to it. The caller must
+// call the returned func once done.
+func (c *controller) trackUpload(w http.ResponseWriter, r *http.Request, p string) func() {
+	t := c.active.begin(ActiveTransfer{Kind: TransferUpload, Path: p, User: c.user(r), Client: clientIP(r)}, r.ContentLength)
+	r.Body = &transferReader{ReadCloser: r.Body, ctx: r.Context(), t: t,
+		deadline: transferDeadline{rc: http.NewResponseController(w)}}
+	return func() { c.active.end(t) }
+}
+
+// trackDownload registers the download of the share path p through w as
+// an active transfer, returning the writer to respond with. The caller
+// must call the returned func once done.
+func (c *controller) trackDownload(w http.ResponseWriter, r *http.Request, p string) (http.ResponseWriter, func()) {
+	if r.Method == http.MethodHead {
+		return w, func() {}
+	}
+	t := c.active.begin(ActiveTransfer{Kind: TransferDownload, Path: p, User: c.user(r), Client: clientIP(r)}, -1)
+	return &transferWriter{ResponseWriter: w, ctx: r.Context(), t: t,
+		deadline: transferDeadline{rc: http.NewResponseController(w)}}, func() { c.active.end(t) }
+}
+
+// adminActive lists the transfers in progress (GET) or cancels one
+// (DELETE .../{id}).
+func (c *controller) adminActive(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/transfers/active"), "/")
+	switch {
+	case id == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		w.Header().Set("Cache-Control", "no-store")
+		c.writeJSON(w, r, c.active.list())
+	case id != "" && r.Method == http.MethodDelete:
+		if !c.active.cancel(id) {
+			http.NotFound(w, r)
+			return
+		}
+		c.log(r).Printf("Transfer %s canceled\n", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
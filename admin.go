@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// isAdmin reports whether r carries the bearer token given by -admin-token.
+func (c *controller) isAdmin(r *http.Request) bool {
+	if c.adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.adminToken)) == 1
+}
+
+// adminOnly guards administrative endpoints with the admin token. Without
+// a token they don't exist.
+func (c *controller) adminOnly(hdlr http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !c.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gosfs admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		hdlr(w, r)
+	}
+}
+
+//go:embed admin.html
+var adminContent []byte
+
+// adminPage serves the admin UI, which asks for the admin token and talks
+// to the admin API with it. The page itself holds no data.
+func (c *controller) adminPage(w http.ResponseWriter, r *http.Request) {
+	if c.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(adminContent)
+}
+
+type userRequest struct {
+	Password string `json:"password"`
+}
+
+// adminUsers lists the users (GET /api/v1/admin/users), and adds them or
+// changes their password (PUT /api/v1/admin/users/<name>) or removes them
+// along with their API tokens (DELETE /api/v1/admin/users/<name>).
+func (c *controller) adminUsers(w http.ResponseWriter, r *http.Request) {
+	if c.users == nil {
+		http.Error(w, "authentication is disabled, start the server with -users", http.StatusNotFound)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/users"), "/")
+	if name == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		c.writeJSON(w, r, c.users.names())
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var req userRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid user request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.ContainsAny(name, ":\r\n") || strings.HasPrefix(name, "#") || req.Password == "" {
+			http.Error(w, "invalid user name or empty password", http.StatusBadRequest)
+			return
+		}
+		if err := c.users.set(name, req.Password); err != nil {
+			c.internalError(w, r, "Error saving users:", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		ok, err := c.users.remove(name)
+		if err == nil && ok {
+			_, err = c.tokens.remove("", name)
+		}
+		if err != nil {
+			c.internalError(w, r, "Error saving users:", err)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type tokenRequest struct {
+	User string `json:"user"`
+}
+
+// adminTokens lists (GET /api/v1/admin/tokens) and issues (POST) API
+// tokens, and revokes them (DELETE /api/v1/admin/tokens/<id>).
+func (c *controller) adminTokens(w http.ResponseWriter, r *http.Request) {
+	if c.tokens == nil {
+		http.Error(w, "authentication is disabled, start the server with -users", http.StatusNotFound)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/tokens"), "/")
+	switch {
+	case id == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		w.Header().Set("Cache-Control", "no-store")
+		c.writeJSON(w, r, c.tokens.list())
+	case id == "" && r.Method == http.MethodPost:
+		var req tokenRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid token request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !c.users.exists(req.User) {
+			http.Error(w, fmt.Sprintf("no user %q", req.User), http.StatusBadRequest)
+			return
+		}
+		t, secret, err := c.tokens.create(req.User)
+		if err != nil {
+			c.internalError(w, r, "Error saving API tokens:", err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			APIToken
+			Token string `json:"token"`
+		}{t, secret})
+	case id != "" && r.Method == http.MethodDelete:
+		ok, err := c.tokens.remove(id, "")
+		if err != nil {
+			c.internalError(w, r, "Error saving API tokens:", err)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case id == "":
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminSettings returns (GET) or changes (PATCH) the runtime settings.
+// Fields missing from a PATCH are left alone.
+func (c *controller) adminSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPatch:
+		settings := c.settings.get()
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&settings); err != nil {
+			http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := settings.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.settings.set(settings); err != nil {
+			c.internalError(w, r, "Error saving settings:", err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	c.writeJSON(w, r, c.settings.get())
+}
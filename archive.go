@@ -0,0 +1,328 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveEntry is a file of a directory archive.
+type archiveEntry struct {
+	name  string // in the archive
+	file  string
+	info  fs.FileInfo
+	strip bool // of its image metadata, see stripsExif
+}
+
+// archiveEntries lists the visible files of the tree at dir, whose share
+// path is display, merged from all layers holding it. It also returns a
+// version which changes with any of them, and the latest modification time
+// in the tree.
+func (c *controller) archiveEntries(dir, display string) ([]archiveEntry, string, time.Time, error) {
+	base := path.Base(display)
+	if display == "/" {
+		base = filepath.Base(c.rootDir)
+	}
+	var entries []archiveEntry
+	var modTime time.Time
+	dirs := []string{dir}
+	if len(c.unions) > 0 {
+		dirs = c.dirLayers(display, dir)
+	}
+	// Where layers hold the same file, the first one wins.
+	seen := map[string]bool{}
+	for _, root := range dirs {
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := c.relPath(p, d.IsDir())
+			if err != nil {
+				return err
+			}
+			if p != root && c.isHidden(rel, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// Links aren't followed, like in snapshots.
+			if !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(modTime) {
+				modTime = info.ModTime()
+			}
+			if d.IsDir() || seen[rel] {
+				return nil
+			}
+			seen[rel] = true
+			name := base + "/" + strings.TrimPrefix(rel, display)
+			entries = append(entries, archiveEntry{name: name, file: p, info: c.atRest.plainInfo(info)})
+			return nil
+		})
+		if err != nil {
+			return nil, "", time.Time{}, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	h := sha1.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", e.name, e.info.Size(), e.info.ModTime().UnixNano())
+	}
+	return entries, hex.EncodeToString(h.Sum(nil)[:16]), modTime, nil
+}
+
+// writeArchive writes the entries as a zip archive to w, compressing only
+// the files which aren't already. It stops once ctx is done.
+func (c *controller) writeArchive(ctx context.Context, w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		hdr, err := zip.FileInfoHeader(e.info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = e.name
+		hdr.Method = zip.Store
+		if compressible(mime.TypeByExtension(path.Ext(e.name))) {
+			hdr.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		f, err := c.atRest.open(e.file)
+		if err != nil {
+			return err
+		}
+		// Files growing while archived are cut at the size listed.
+		src := io.LimitReader(&contextReader{ctx: ctx, r: f}, e.info.Size())
+		if e.strip {
+			err = stripMetadata(fw, bufio.NewReader(src))
+		} else {
+			_, err = io.Copy(fw, src)
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("archiving %s: %w", e.name, err)
+		}
+	}
+	return zw.Close()
+}
+
+// downloadArchive sends the directory at dir as a zip archive. With the
+// archive cache, archives are kept after they were sent once, so that
+// later downloads of the unchanged directory support ranges and resuming.
+func (c *controller) downloadArchive(w http.ResponseWriter, r *http.Request, dir string) {
+	display, err := c.relPath(dir, true)
+	if err != nil {
+		c.internalError(w, r, "Error archiving directory:", err)
+		return
+	}
+	entries, version, modTime, err := c.archiveEntries(dir, display)
+	if err != nil {
+		c.log(r).Println("Error listing files to archive:", err)
+		http.Error(w, "unable to archive directory", http.StatusInternalServerError)
+		return
+	}
+	stripped := false
+	for i, e := range entries {
+		rel, err := c.relPath(e.file, false)
+		if err != nil || !c.stripsExif(r, rel, false) {
+			continue
+		}
+		if unstrippable[strings.ToLower(path.Ext(rel))] {
+			http.Error(w, fmt.Sprintf("image metadata can't be stripped from %s", rel), http.StatusForbidden)
+			return
+		}
+		entries[i].strip, stripped = true, true
+	}
+	if stripped {
+		// Not the archive of the images as they are
+		version += "-stripped"
+	}
+	name := path.Base(display)
+	if display == "/" {
+		name = filepath.Base(c.rootDir)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	etag := `"` + version + `"`
+	if c.archives != nil {
+		if f, err := c.archives.open(display, version); err == nil {
+			defer f.Close()
+			w.Header().Set("ETag", etag)
+			w, done := c.trackDownload(w, r, display)
+			defer done()
+			http.ServeContent(w, r, "", modTime, f)
+			return
+		}
+	}
+	if notModified(w, r, etag, modTime) || r.Method == http.MethodHead {
+		return
+	}
+
+	w, done := c.trackDownload(w, r, display)
+	defer done()
+	var out io.Writer = w
+	var tee *cacheTee
+	if c.archives != nil {
+		if tmp, err := c.archives.create(); err != nil {
+			c.log(r).Println("Error caching archive:", err)
+		} else {
+			tee = &cacheTee{w: w, f: tmp}
+			out = tee
+		}
+	}
+	err = c.writeArchive(r.Context(), out, entries)
+	if tee != nil {
+		if err == nil && tee.err == nil {
+			c.archives.commit(tee.f, display, version)
+		} else {
+			c.archives.abort(tee.f)
+		}
+	}
+	if err != nil && r.Context().Err() == nil {
+		// The response is underway, all that can be done is cutting it off.
+		c.log(r).Println("Error sending archive:", err)
+	}
+}
+
+// cacheTee copies what is sent to the client into a cache file, giving up
+// on the cache rather than on the download if that fails.
+type cacheTee struct {
+	w   io.Writer
+	f   *os.File
+	err error
+}
+
+func (t *cacheTee) Write(b []byte) (int, error) {
+	n, err := t.w.Write(b)
+	if t.err == nil {
+		_, t.err = t.f.Write(b[:n])
+	}
+	return n, err
+}
+
+// archiveCache keeps directory archives in dir, by directory and version,
+// up to max bytes in total. The least recently used ones are removed
+// first.
+type archiveCache struct {
+	dir string
+	max int64
+	mu  sync.Mutex
+}
+
+func newArchiveCache(dir string, max int64) (*archiveCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// Archives being written when the server stopped
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".archive-*"))
+	for _, p := range leftovers {
+		os.Remove(p)
+	}
+	return &archiveCache{dir: dir, max: max}, nil
+}
+
+// prefix returns the file name prefix of the archives of a directory.
+func (ac *archiveCache) prefix(display string) string {
+	sum := sha1.Sum([]byte(display))
+	return hex.EncodeToString(sum[:8]) + "-"
+}
+
+func (ac *archiveCache) path(display, version string) string {
+	return filepath.Join(ac.dir, ac.prefix(display)+version+".zip")
+}
+
+// open returns the cached archive of a directory version.
+func (ac *archiveCache) open(display, version string) (*os.File, error) {
+	p := ac.path(display, version)
+	f, err := os.Open(p)
+	if err == nil {
+		now := time.Now()
+		os.Chtimes(p, now, now)
+	}
+	return f, err
+}
+
+func (ac *archiveCache) create() (*os.File, error) {
+	return os.CreateTemp(ac.dir, ".archive-*")
+}
+
+func (ac *archiveCache) abort(tmp *os.File) {
+	tmp.Close()
+	os.Remove(tmp.Name())
+}
+
+// commit stores the archive written to tmp as the given version of the
+// directory, replacing older versions.
+func (ac *archiveCache) commit(tmp *os.File, display, version string) {
+	info, err := tmp.Stat()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || info.Size() > ac.max {
+		os.Remove(tmp.Name())
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	p := ac.path(display, version)
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	old, _ := filepath.Glob(filepath.Join(ac.dir, ac.prefix(display)+"*.zip"))
+	for _, o := range old {
+		if o != p {
+			os.Remove(o)
+		}
+	}
+	ac.prune()
+}
+
+// prune removes the least recently used archives beyond the size limit.
+func (ac *archiveCache) prune() {
+	entries, err := os.ReadDir(ac.dir)
+	if err != nil {
+		return
+	}
+	var infos []fs.FileInfo
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !strings.HasSuffix(e.Name(), ".zip") {
+			continue
+		}
+		infos = append(infos, info)
+		total += info.Size()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		if total <= ac.max {
+			break
+		}
+		if os.Remove(filepath.Join(ac.dir, info.Name())) == nil {
+			total -= info.Size()
+		}
+	}
+}
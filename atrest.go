@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted files start with a magic and the salt their key is derived
+// with, followed by chunks of up to atRestChunkSize bytes of contents,
+// each sealed with AES-256-GCM. The nonce of a chunk is its index, and
+// flags the last chunk, so that chunks can't be reordered, dropped or
+// cut off at the end without notice.
+const (
+	atRestMagic      = "GOSFSE1\n"
+	atRestSaltSize   = 16
+	atRestHeaderSize = len(atRestMagic) + atRestSaltSize
+	atRestChunkSize  = 64 << 10
+	atRestTagSize    = 16
+	atRestKeySize    = 32
+)
+
+var errNotEncrypted = errors.New("file is not encrypted at rest")
+
+// atRest encrypts the contents of the files of the share on disk, see
+// -encrypt-key-file, and decrypts them on the fly for downloads. Names,
+// sizes, modification times and the directory structure stay visible. A
+// nil atRest reads and writes files as they are.
+type atRest struct {
+	key []byte
+}
+
+// loadAtRestKey reads the master key from file, or from the output of
+// command, e.g. a KMS or Vault client. The key is 32 bytes, raw, hex or
+// base64 encoded.
+func loadAtRestKey(file, command string) (*atRest, error) {
+	var b []byte
+	var err error
+	if command != "" {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return nil, errors.New("empty key command")
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		b, err = cmd.Output()
+	} else {
+		b, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseAtRestKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &atRest{key: key}, nil
+}
+
+func parseAtRestKey(b []byte) ([]byte, error) {
+	if len(b) == atRestKeySize {
+		return b, nil
+	}
+	s := strings.TrimSpace(string(b))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == atRestKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == atRestKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("expected a key of %d bytes, raw, hex or base64 encoded", atRestKeySize)
+}
+
+// aead returns the cipher of the file with the given salt.
+func (a *atRest) aead(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, index int64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// plainSize returns the size of the contents of an encrypted file of the
+// given size.
+func plainSize(size int64) int64 {
+	body := size - int64(atRestHeaderSize)
+	if body <= 0 {
+		return 0
+	}
+	n, rem := body/(atRestChunkSize+atRestTagSize), body%(atRestChunkSize+atRestTagSize)
+	return n*atRestChunkSize + max(rem-atRestTagSize, 0)
+}
+
+// plainInfo returns info with the size of the contents of the file.
+func (a *atRest) plainInfo(info fs.FileInfo) fs.FileInfo {
+	if a == nil || info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	return plainFileInfo{info}
+}
+
+type plainFileInfo struct {
+	fs.FileInfo
+}
+
+func (fi plainFileInfo) Size() int64 { return plainSize(fi.FileInfo.Size()) }
+
+// fileReader is an open file of the share.
+type fileReader interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// open opens the file p for reading its contents.
+func (a *atRest) open(p string) (fileReader, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		// Directories have no contents to decrypt.
+		return f, nil
+	}
+	header := make([]byte, atRestHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(atRestMagic)]) != atRestMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", p, errNotEncrypted)
+	}
+	aead, err := a.aead(header[len(atRestMagic):])
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	chunks := (info.Size() - int64(atRestHeaderSize) + atRestChunkSize + atRestTagSize - 1) / (atRestChunkSize + atRestTagSize)
+	d := &decryptingReader{f: f, info: plainFileInfo{info}, aead: aead, chunks: chunks, index: -1}
+	// Verifying the last chunk up front catches files which were cut off,
+	// which reads up to the cut wouldn't.
+	if chunks == 0 {
+		err = fmt.Errorf("%s: no contents", p)
+	} else {
+		err = d.load(chunks - 1)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// readFile returns the contents of the file p.
+func (a *atRest) readFile(p string) ([]byte, error) {
+	if a == nil {
+		return os.ReadFile(p)
+	}
+	f, err := a.open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// decryptingReader reads the contents of an encrypted file, decrypting
+// the chunk read from at a time.
+type decryptingReader struct {
+	f      *os.File
+	info   fs.FileInfo
+	aead   cipher.AEAD
+	chunks int64
+	pos    int64
+	index  int64 // of the chunk in plain, -1 if none
+	plain  []byte
+	sealed []byte
+	err    error // of the last chunk which failed to decrypt
+}
+
+func (d *decryptingReader) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *decryptingReader) Close() error { return d.f.Close() }
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.info.Size() {
+		return 0, io.EOF
+	}
+	index := d.pos / atRestChunkSize
+	if index != d.index {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-index*atRestChunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// load decrypts the chunk of the given index.
+func (d *decryptingReader) load(index int64) error {
+	if d.sealed == nil {
+		d.sealed = make([]byte, atRestChunkSize+atRestTagSize)
+	}
+	off := int64(atRestHeaderSize) + index*(atRestChunkSize+atRestTagSize)
+	n, err := d.f.ReadAt(d.sealed, off)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	d.index = -1
+	d.plain, err = d.aead.Open(d.plain[:0], chunkNonce(d.aead, index, index == d.chunks-1), d.sealed[:n], nil)
+	if err != nil {
+		d.err = fmt.Errorf("%s: chunk %d: %w", d.f.Name(), index, err)
+		return d.err
+	}
+	d.index = index
+	return nil
+}
+
+// encryptingWriter encrypts what is written to it into w. The last chunk
+// is only written by Close.
+type encryptingWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	index int64
+	buf   []byte
+}
+
+// encrypt returns a writer encrypting into w, which must be closed to
+// complete the file, or w itself if a is nil.
+func (a *atRest) encrypt(w io.Writer) (io.WriteCloser, error) {
+	if a == nil {
+		return nopWriteCloser{w}, nil
+	}
+	header := make([]byte, atRestHeaderSize)
+	copy(header, atRestMagic)
+	if _, err := rand.Read(header[len(atRestMagic):]); err != nil {
+		return nil, err
+	}
+	aead, err := a.aead(header[len(atRestMagic):])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{w: w, aead: aead, buf: make([]byte, 0, atRestChunkSize+atRestTagSize)}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == atRestChunkSize {
+			// Only now is it known that the buffered chunk isn't the last.
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):atRestChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptingWriter) flush(last bool) error {
+	sealed := e.aead.Seal(e.buf[:0], chunkNonce(e.aead, e.index, last), e.buf, nil)
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.flush(true)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// seal returns data encrypted, or as it is if a is nil.
+func (a *atRest) seal(data []byte) ([]byte, error) {
+	if a == nil {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	w, err := a.encrypt(&buf)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), err
+}
+
+// serveFile serves the contents of the file p, like http.ServeFile.
+func (c *controller) serveFile(w http.ResponseWriter, r *http.Request, p string) {
+	if c.atRest == nil {
+		http.ServeFile(w, r, p)
+		return
+	}
+	f, err := c.atRest.open(p)
+	if err != nil {
+		c.internalError(w, r, "Error opening file:", err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.internalError(w, r, "Error opening file:", err)
+		return
+	}
+	if info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	// Past the headers, a chunk which was tampered with can only cut the
+	// response short.
+	if d, ok := f.(*decryptingReader); ok && d.err != nil {
+		c.log(r).Println("Error decrypting file:", d.err)
+	}
+}
+
+// isEncryptedFile reports whether the file p starts like an encrypted one.
+func isEncryptedFile(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(atRestMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == atRestMagic
+}
+
+// convert encrypts the file p in place, or decrypts it, through a
+// temporary file in the same directory. Files which already are as
+// wanted are left alone. It reports whether p was converted.
+func (a *atRest) convert(p string, decrypt bool) (bool, error) {
+	if isEncryptedFile(p) != decrypt {
+		return false, nil
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	var src io.ReadCloser
+	if decrypt {
+		src, err = a.open(p)
+	} else {
+		src, err = os.Open(p)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	dst := io.WriteCloser(nopWriteCloser{tmp})
+	if !decrypt {
+		dst, err = a.encrypt(tmp)
+	}
+	if err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if err == nil {
+		err = dst.Close()
+	}
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), p)
+}
+
+// encryptCommand implements "gosfs encrypt", which encrypts the existing
+// files of a share before serving it with -encrypt-key-file, or decrypts
+// them again.
+func encryptCommand(args []string) {
+	set := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	keyFile := set.String("encrypt-key-file", "", "file of the key to encrypt with")
+	keyCommand := set.String("encrypt-key-command", "", "command printing the key to encrypt with")
+	decrypt := set.Bool("decrypt", false, "decrypt the files instead")
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: %s encrypt [flags] path...\n", os.Args[0])
+		set.PrintDefaults()
+	}
+	set.Parse(args)
+	if (*keyFile == "") == (*keyCommand == "") || set.NArg() == 0 {
+		set.Usage()
+		os.Exit(2)
+	}
+	a, err := loadAtRestKey(*keyFile, *keyCommand)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading key:", err)
+		os.Exit(1)
+	}
+	failed := false
+	for _, root := range set.Args() {
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			converted, err := a.convert(p, *decrypt)
+			switch {
+			case err != nil:
+				fmt.Fprintf(os.Stderr, "Error converting %s: %v\n", p, err)
+				failed = true
+			case converted:
+				fmt.Println(p)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error walking directory:", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var audioExts = words(".mp3 .m4a .aac .ogg .oga .opus .flac .wav")
+
+func isAudio(name string) bool {
+	return audioExts[strings.ToLower(path.Ext(name))]
+}
+
+type Track struct {
+	Title string
+	Link  string
+	Tags
+}
+
+func (c *controller) newTrack(p, link string) Track {
+	t := Track{Link: link, Tags: c.readTags(p)}
+	switch {
+	case t.Artist != "" && t.Tags.Title != "":
+		t.Title = t.Artist + " - " + t.Tags.Title
+	case t.Tags.Title != "":
+		t.Title = t.Tags.Title
+	default:
+		t.Title = strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))
+	}
+	return t
+}
+
+// tracks returns the visible audio files of the directory at root, sorted by
+// name.
+func (c *controller) tracks(root string) ([]Track, error) {
+	dir, err := c.listDir(root, listOptions{Sort: SortByName, Order: OrderAsc})
+	if err != nil {
+		return nil, err
+	}
+	var tracks []Track
+	for _, f := range dir.Files {
+		if !f.IsDir && isAudio(f.Name) {
+			tracks = append(tracks, c.newTrack(filepath.Join(root, f.Name), f.Link))
+		}
+	}
+	return tracks, nil
+}
+
+// audioPlayer plays a single file, or every track of a directory in order.
+func (c *controller) audioPlayer(w http.ResponseWriter, r *http.Request, p string, info fs.FileInfo) {
+	pl := Player{
+		Kind:   "audio",
+		Name:   info.Name(),
+		Link:   (&url.URL{Path: r.URL.Path}).String(),
+		Parent: (&url.URL{Path: path.Dir(strings.TrimSuffix(r.URL.Path, "/"))}).String(),
+	}
+	if pl.Parent != "/" {
+		pl.Parent += "/"
+	}
+	root := filepath.Dir(p)
+	if info.IsDir() {
+		root = p
+		pl.Parent = pl.Link
+		pl.Playlist = pl.Link + "?playlist=m3u"
+	}
+	tracks, err := c.tracks(root)
+	if err != nil {
+		c.internalError(w, r, "Error listing tracks:", err)
+		return
+	}
+	if info.IsDir() {
+		if len(tracks) == 0 {
+			http.Error(w, "no audio files in this directory", http.StatusNotFound)
+			return
+		}
+		pl.Link = tracks[0].Link
+	} else {
+		// Show the tags of the file being played.
+		t := c.newTrack(p, pl.Link)
+		pl.Name = t.Title
+	}
+	pl.Tracks = tracks
+	if err = playerTemplate.Execute(w, pl); err != nil {
+		c.internalError(w, r, "Error rendering player page:", err)
+	}
+}
+
+// playlist serves an extended M3U playlist of the directory's audio files
+// with absolute URLs, so that it can be opened in any media player.
+func (c *controller) playlist(w http.ResponseWriter, r *http.Request, root string) {
+	tracks, err := c.tracks(root)
+	if err != nil {
+		c.internalError(w, r, "Error listing tracks:", err)
+		return
+	}
+	name := path.Base(strings.TrimSuffix(r.URL.Path, "/"))
+	if name == "/" || name == "." {
+		name = "gosfs"
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name+".m3u"))
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, t := range tracks {
+		fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", t.Title, c.urls.link(r, t.Link))
+	}
+}
+
+// isAudioRequest reports whether the request targets the audio player or
+// playlist of the file or directory at p.
+func isAudioRequest(r *http.Request, p string, info os.FileInfo) bool {
+	q := r.URL.Query()
+	if info.IsDir() {
+		return q.Get("play") == "1" || q.Get("playlist") == "m3u"
+	}
+	return q.Get("play") == "1" && isAudio(p)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audited actions.
+const (
+	ActionUpload = "upload"
+	ActionEdit   = "edit"
+	ActionDelete = "delete"
+	ActionMove   = "move"
+	ActionMkdir  = "mkdir"
+	ActionShare  = "share"
+	ActionTag    = "tag"
+)
+
+const (
+	auditFileName     = "audit.log"
+	DefaultAuditLimit = 100
+)
+
+// AuditEntry records a single write operation.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	User      string    `json:"user,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	RequestID string    `json:"request_id,omitempty"`
+	Paths     []string  `json:"paths"`
+	// Fields are the values of the upload fields.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to a file which is never
+// rewritten, so that it can be shipped or archived by external tools.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openAuditLog(dataDir string) (*auditLog, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, auditFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+func (a *auditLog) append(e AuditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err = a.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// audit records action on the given share-relative paths by the client of r.
+func (c *controller) audit(w http.ResponseWriter, r *http.Request, action string, paths ...string) {
+	c.auditFields(w, r, action, nil, paths...)
+}
+
+// auditFields records action along with the values of upload fields.
+func (c *controller) auditFields(w http.ResponseWriter, r *http.Request, action string, fields map[string]string, paths ...string) {
+	if c.auditLog == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		User:      c.user(r),
+		ClientIP:  clientIP(r),
+		RequestID: requestID(r),
+		Paths:     paths,
+		Fields:    fields,
+	}
+	if err := c.auditLog.append(e); err != nil {
+		c.log(r).Println("Error writing audit log:", err)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	if i := strings.LastIndexByte(r.RemoteAddr, ':'); i >= 0 {
+		return strings.Trim(r.RemoteAddr[:i], "[]")
+	}
+	return r.RemoteAddr
+}
+
+// auditQuery returns the most recent audit entries matching the action,
+// user, path (prefix), since and until parameters, oldest first.
+func (c *controller) auditQuery(w http.ResponseWriter, r *http.Request) {
+	if c.auditLog == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	limit := DefaultAuditLimit
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	var since, until time.Time
+	var err error
+	if since, err = parseDate(q.Get("since")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if until, err = parseDate(q.Get("until")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(c.auditLog.file.Name())
+	if err != nil {
+		c.internalError(w, r, "Error reading audit log:", err)
+		return
+	}
+	defer f.Close()
+	entries := []AuditEntry{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		if !auditMatch(e, q.Get("action"), q.Get("user"), q.Get("path"), since, until) {
+			continue
+		}
+		if len(entries) == limit {
+			entries = entries[1:]
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		c.internalError(w, r, "Error reading audit log:", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	c.writeJSON(w, r, struct {
+		Entries []AuditEntry `json:"entries"`
+	}{entries})
+}
+
+func auditMatch(e AuditEntry, action, user, prefix string, since, until time.Time) bool {
+	if (action != "" && e.Action != action) || (user != "" && e.User != user) {
+		return false
+	}
+	if (!since.IsZero() && e.Time.Before(since)) || (!until.IsZero() && !e.Time.Before(until)) {
+		return false
+	}
+	if prefix == "" {
+		return true
+	}
+	for _, p := range e.Paths {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Authentication modes, which requests need credentials.
+const (
+	AuthWrite = "write" // anonymous read, authenticated write
+	AuthAll   = "all"
+)
+
+// users maps names to passwords, either in plain text or as {SHA256}<hex>.
+type users map[string]string
+
+// userStore holds the users of the -users file, which the admin API
+// changes at runtime.
+type userStore struct {
+	file string
+
+	mu    sync.RWMutex
+	users users
+}
+
+// loadUsers reads "name:password" lines, blank lines and lines starting
+// with # are skipped.
+func loadUsers(file string) (*userStore, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	u := users{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"name:password\"", file, n)
+		}
+		u[kv[0]] = kv[1]
+	}
+	return &userStore{file: file, users: u}, sc.Err()
+}
+
+func (s *userStore) check(name, password string) bool {
+	s.mu.RLock()
+	want, ok := s.users[name]
+	s.mu.RUnlock()
+	got := password
+	if strings.HasPrefix(want, "{SHA256}") {
+		sum := sha256.Sum256([]byte(password))
+		want, got = strings.ToLower(strings.TrimPrefix(want, "{SHA256}")), hex.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1 && ok
+}
+
+func (s *userStore) exists(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.users[name]
+	return ok
+}
+
+func (s *userStore) names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedKeys(s.users)
+}
+
+// set adds the user or changes its password, which is stored hashed.
+func (s *userStore) set(name, password string) error {
+	sum := sha256.Sum256([]byte(password))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[name] = "{SHA256}" + hex.EncodeToString(sum[:])
+	return s.save()
+}
+
+func (s *userStore) remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return false, nil
+	}
+	delete(s.users, name)
+	return true, s.save()
+}
+
+// save must be called with s.mu held. It rewrites the users file, keeping
+// its comments and the order of the users.
+func (s *userStore) save() error {
+	b, err := os.ReadFile(s.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var out bytes.Buffer
+	written := map[string]bool{}
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			out.WriteString(line)
+			continue
+		}
+		name := strings.SplitN(trimmed, ":", 2)[0]
+		if password, ok := s.users[name]; ok && !written[name] {
+			fmt.Fprintf(&out, "%s:%s\n", name, password)
+			written[name] = true
+		}
+	}
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	for _, name := range sortedKeys(s.users) {
+		if !written[name] {
+			fmt.Fprintf(&out, "%s:%s\n", name, s.users[name])
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), "."+filepath.Base(s.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0o600); err == nil {
+		_, err = tmp.Write(out.Bytes())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mutating reports whether r changes files or server state.
+func mutating(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.URL.Query().Get("edit") == "1"
+	}
+	return true
+}
+
+// authenticate requires HTTP basic authentication or an API token for the
+// requests the auth mode protects. Signed URLs, shares and requests with
+// the admin token don't need credentials.
+func (c *controller) authenticate(hdlr http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name, password, ok := req.BasicAuth()
+		if ok && c.users.check(name, password) {
+			hdlr.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), userKey, name)))
+			return
+		}
+		if name, ok := c.bearerUser(req); ok && c.users.exists(name) {
+			hdlr.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), userKey, name)))
+			return
+		}
+		// The admin page holds no data, its API calls carry the admin token.
+		// DLNA clients can't authenticate, and only browse with POSTs.
+		exempt := isSigned(req) || c.isAdmin(req) || strings.HasPrefix(req.URL.Path, "/s/") ||
+			req.URL.Path == "/healthz" || req.URL.Path == "/admin" ||
+			c.dlna != nil && strings.HasPrefix(req.URL.Path, "/dlna/")
+		if exempt || (c.authMode == AuthWrite && !mutating(req)) {
+			hdlr.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="gosfs", charset="UTF-8"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+	})
+}
+
+// user returns the name of the authenticated user of r. Without configured
+// users, the unverified basic auth name is used, which is what proxies in
+// front of gosfs pass on.
+func (c *controller) user(r *http.Request) string {
+	if name, ok := r.Context().Value(userKey).(string); ok {
+		return name
+	}
+	if c.users == nil {
+		name, _, _ := r.BasicAuth()
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// serverURLs returns the URLs the server listening on bindAddr and port can
+// be opened at: the external URL if there is one, otherwise localhost
+// followed by the addresses of the network interfaces when bindAddr is
+// unspecified. Link-local addresses are left out, their URLs need a zone.
+func (b *urlBuilder) serverURLs(bindAddr string, port int) []string {
+	if b.external != nil {
+		return []string{b.external.String() + "/"}
+	}
+	hostURL := func(host string) string {
+		return (&url.URL{Scheme: "http", Host: net.JoinHostPort(host, strconv.Itoa(port)), Path: "/"}).String()
+	}
+	ip := net.ParseIP(bindAddr)
+	if bindAddr != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{hostURL(bindAddr)}
+	}
+	// 0.0.0.0 only listens on IPv4, :: on both.
+	v4only := ip != nil && ip.To4() != nil
+	urls := []string{hostURL("localhost")}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return urls
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() || (v4only && ipnet.IP.To4() == nil) {
+			continue
+		}
+		urls = append(urls, hostURL(ipnet.IP.String()))
+	}
+	return urls
+}
+
+// printBanner prints the URLs of the server, and with qr a QR code of the
+// first one reachable from other devices, if any.
+func printBanner(w io.Writer, urls []string, qr bool) {
+	fmt.Fprintln(w, "\ngosfs is serving at:")
+	for _, u := range urls {
+		fmt.Fprintln(w, "  "+u)
+	}
+	fmt.Fprintln(w)
+	if !qr {
+		return
+	}
+	target := urls[0]
+	if len(urls) > 1 {
+		// Skip localhost, phones can't open it.
+		target = urls[1]
+	}
+	code, err := encodeQR([]byte(target))
+	if err != nil {
+		return
+	}
+	fmt.Fprint(w, code.text())
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// cacheRule assigns a Cache-Control value to the request paths matching
+// pattern, which may use ** like ignore files. The pattern "default"
+// matches any path not matched by another rule.
+type cacheRule struct {
+	pattern string
+	value   string
+}
+
+// cacheRules is a repeatable flag of "pattern: value" rules, the first
+// matching rule wins.
+type cacheRules []cacheRule
+
+func (rules *cacheRules) String() string {
+	var s []string
+	for _, r := range *rules {
+		s = append(s, r.pattern+": "+r.value)
+	}
+	return strings.Join(s, "; ")
+}
+
+func (rules *cacheRules) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i < 0 {
+		return fmt.Errorf("invalid cache rule %q, expected \"pattern: value\"", v)
+	}
+	pattern, value := strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:])
+	if pattern == "" || value == "" {
+		return fmt.Errorf("invalid cache rule %q, expected \"pattern: value\"", v)
+	}
+	*rules = append(*rules, cacheRule{pattern: pattern, value: value})
+	return nil
+}
+
+// lookup returns the Cache-Control value for the request path p.
+func (rules cacheRules) lookup(p string) string {
+	def := ""
+	for _, r := range rules {
+		if r.pattern == "default" {
+			if def == "" {
+				def = r.value
+			}
+			continue
+		}
+		pattern := strings.Trim(r.pattern, "/")
+		target := strings.Trim(p, "/")
+		if matchGlob(pattern, target) {
+			return r.value
+		}
+	}
+	return def
+}
+
+// cacheControl sets the configured Cache-Control header on GET and HEAD
+// responses. Handlers setting their own value take precedence.
+func (c *controller) cacheControl(hdlr http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			if v := c.cacheRules.lookup(req.URL.Path); v != "" {
+				w.Header().Set("Cache-Control", v)
+			}
+		}
+		hdlr.ServeHTTP(w, req)
+	})
+}
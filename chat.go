@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Chat services which can be told about uploads.
+const (
+	ChatSlack    = "slack"
+	ChatMatrix   = "matrix"
+	ChatTelegram = "telegram"
+)
+
+const (
+	defaultTelegramURL = "https://api.telegram.org"
+	// chatLinkTTL is the lifetime of the signed links to files uploaded in
+	// drop box mode, which can't be downloaded otherwise.
+	chatLinkTTL = 7 * 24 * time.Hour
+)
+
+// chatNotifier posts a message, with the name, size, uploader and link of
+// the file, to a chat for every upload below dir.
+type chatNotifier struct {
+	service string
+	url     string // Slack incoming webhook, Matrix homeserver or Telegram Bot API
+	room    string // Matrix room or Telegram chat ID
+	token   string // Matrix access token or Telegram bot token
+	dir     string // share path prefix of the watched directory
+}
+
+// chatNotifiers is a repeatable flag of "service [url] [room=...]
+// [token=...] [dir=/prefix]" notifiers.
+type chatNotifiers []chatNotifier
+
+func (chats *chatNotifiers) String() string {
+	var s []string
+	for _, n := range *chats {
+		s = append(s, n.service+" "+n.dir)
+	}
+	return strings.Join(s, "; ")
+}
+
+func (chats *chatNotifiers) Set(v string) error {
+	fields := strings.Fields(v)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty chat notifier")
+	}
+	n := chatNotifier{service: fields[0], dir: "/"}
+	opts := fields[1:]
+	if len(opts) > 0 && !strings.Contains(opts[0], "=") {
+		u, err := url.Parse(opts[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid chat url %q", opts[0])
+		}
+		n.url = strings.TrimSuffix(opts[0], "/")
+		opts = opts[1:]
+	}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid chat notifier option %q", opt)
+		}
+		switch kv[0] {
+		case "room", "chat":
+			n.room = kv[1]
+		case "token":
+			n.token = kv[1]
+		case "dir":
+			n.dir = path.Clean("/" + kv[1])
+		default:
+			return fmt.Errorf("unknown chat notifier option %q", kv[0])
+		}
+	}
+	switch n.service {
+	case ChatSlack:
+		if n.url == "" {
+			return fmt.Errorf("missing Slack webhook url")
+		}
+	case ChatMatrix:
+		if n.url == "" || n.room == "" || n.token == "" {
+			return fmt.Errorf("matrix needs the homeserver url, room= and token=")
+		}
+	case ChatTelegram:
+		if n.room == "" || n.token == "" {
+			return fmt.Errorf("telegram needs chat= and token=")
+		}
+		if n.url == "" {
+			n.url = defaultTelegramURL
+		}
+	default:
+		return fmt.Errorf("unknown chat service %q, expected %s, %s or %s", n.service, ChatSlack, ChatMatrix, ChatTelegram)
+	}
+	*chats = append(*chats, n)
+	return nil
+}
+
+// watches reports whether n is interested in the file at the share path p.
+func (n chatNotifier) watches(p string) bool {
+	return n.dir == "/" || p == n.dir || strings.HasPrefix(p, n.dir+"/")
+}
+
+// chatLink returns the absolute URL of the uploaded file at the share
+// path p, signed if it can't be downloaded otherwise.
+func (c *controller) chatLink(r *http.Request, p string) string {
+	if c.settings.get().DropBox && c.signingKey != "" {
+		return c.urls.link(r, signPath(c.signingKey, http.MethodGet, p, time.Now().Add(chatLinkTTL)))
+	}
+	return c.urls.url(r, p)
+}
+
+// chatUpload is what chat messages tell about an upload.
+type chatUpload struct {
+	name, size, dir, uploader, link string
+}
+
+func newChatUpload(ev WebhookEvent) chatUpload {
+	uploader := ev.User
+	if uploader == "" {
+		uploader = ev.RemoteAddr
+		if i := strings.LastIndexByte(uploader, ':'); i >= 0 {
+			uploader = strings.Trim(uploader[:i], "[]")
+		}
+	}
+	return chatUpload{
+		name:     path.Base(ev.Path),
+		size:     formatBytes(ev.Size),
+		dir:      path.Dir(ev.Path),
+		uploader: uploader,
+		link:     ev.link,
+	}
+}
+
+func (u chatUpload) text() string {
+	return fmt.Sprintf("%s (%s) was uploaded to %s by %s: %s", u.name, u.size, u.dir, u.uploader, u.link)
+}
+
+func (u chatUpload) html() string {
+	return fmt.Sprintf(`<a href="%s">%s</a> (%s) was uploaded to %s by %s`, html.EscapeString(u.link),
+		html.EscapeString(u.name), u.size, html.EscapeString(u.dir), html.EscapeString(u.uploader))
+}
+
+// slack formats the message in Slack's mrkdwn, which only escapes &, <
+// and >.
+func (u chatUpload) slack() string {
+	esc := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+	return fmt.Sprintf("<%s|%s> (%s) was uploaded to %s by %s", u.link, esc(u.name), u.size, esc(u.dir), esc(u.uploader))
+}
+
+// postChat posts the message about ev to n, retrying failed attempts with
+// exponential backoff like webhook deliveries.
+func (c *controller) postChat(n chatNotifier, ev WebhookEvent) {
+	logger := requestLogger{Logger: c.logger, id: ev.RequestID}
+	client := &http.Client{Timeout: webhookTimeout}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := n.request(ev)
+		if err != nil {
+			logger.Printf("Error preparing %s message: %v\n", n.service, err)
+			return
+		}
+		if err = sendChat(client, req); err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			logger.Printf("Error posting upload of %s to %s, giving up: %v\n", ev.Path, n.service, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// request returns the request posting the message about ev to the chat.
+func (n chatNotifier) request(ev WebhookEvent) (*http.Request, error) {
+	up := newChatUpload(ev)
+	var method, u string
+	var msg any
+	switch n.service {
+	case ChatSlack:
+		method, u = http.MethodPost, n.url
+		msg = map[string]string{"text": up.slack()}
+	case ChatMatrix:
+		// The transaction ID makes retries idempotent.
+		txn := fmt.Sprintf("gosfs-%d-%s", ev.Time.UnixNano(), ev.Path)
+		method = http.MethodPut
+		u = n.url + "/_matrix/client/v3/rooms/" + url.PathEscape(n.room) + "/send/m.room.message/" + url.PathEscape(txn)
+		msg = map[string]string{
+			"msgtype":        "m.text",
+			"body":           up.text(),
+			"format":         "org.matrix.custom.html",
+			"formatted_body": up.html(),
+		}
+	case ChatTelegram:
+		method, u = http.MethodPost, n.url+"/bot"+n.token+"/sendMessage"
+		msg = map[string]string{
+			"chat_id":    n.room,
+			"text":       up.html(),
+			"parse_mode": "HTML",
+		}
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.service == ChatMatrix {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	return req, nil
+}
+
+func sendChat(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
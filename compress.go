@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const DefaultCompressMinSize = 1024
+
+// compressibleTypes are the media types worth compressing, anything else
+// (images, video, archives) is usually compressed already.
+var compressibleTypes = words(`application/json application/javascript application/xml
+	application/xhtml+xml image/svg+xml application/vnd.apple.mpegurl audio/x-mpegurl text/yaml`)
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	// Event streams must reach the client unbuffered.
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// acceptedEncoding picks the preferred supported coding of the request's
+// Accept-Encoding header, or an empty string.
+func acceptedEncoding(r *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if (coding == "gzip" || coding == "deflate") && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the start of the response until it can decide
+// whether to compress: the response must be a complete 200 of a
+// compressible type, not encoded already, and at least minSize bytes long.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	copier   *copier
+	head     bool
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	// Responses without a body don't need any decision.
+	if status == http.StatusNotModified || status == http.StatusNoContent || status < 200 {
+		cw.decide(false)
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection under cw.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide fixes the encoding and writes the headers and buffered data.
+func (cw *compressWriter) decide(enough bool) error {
+	if cw.decided {
+		return nil
+	}
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if compressible(h.Get("Content-Type")) {
+		addVary(h, "Accept-Encoding")
+	}
+	if cw.head && len(cw.buf) == 0 {
+		// HEAD responses have no body to measure, but must get the
+		// headers of the GET response.
+		n, err := strconv.Atoi(h.Get("Content-Length"))
+		enough = err == nil && n >= cw.minSize
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+	}
+	if enough && cw.wouldCompress() {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		switch {
+		case cw.head:
+			// Nothing to encode.
+		case cw.encoding == "gzip":
+			cw.enc, _ = gzip.NewWriterLevel(cw.ResponseWriter, gzip.DefaultCompression)
+		default:
+			cw.enc, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// wouldCompress reports whether the response qualifies for compression,
+// given it is long enough.
+func (cw *compressWriter) wouldCompress() bool {
+	h := cw.Header()
+	return cw.encoding != "" && cw.status == http.StatusOK &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		compressible(h.Get("Content-Type"))
+}
+
+func (cw *compressWriter) Flush() {
+	cw.decide(true)
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+func (cw *compressWriter) close() error {
+	if err := cw.decide(false); err != nil {
+		return err
+	}
+	if cw.enc != nil {
+		return cw.enc.Close()
+	}
+	return nil
+}
+
+// compress negotiates gzip or deflate compression of compressible
+// responses. Brotli isn't offered as the standard library lacks an encoder.
+func (c *controller) compress(hdlr http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       acceptedEncoding(req),
+			minSize:        c.compressMinSize,
+			copier:         c.copier,
+			head:           req.Method == http.MethodHead,
+		}
+		if req.Header.Get("Range") != "" {
+			// Ranges are served as they are, but still vary with the
+			// Accept-Encoding of the full response.
+			cw.encoding = ""
+		}
+		defer cw.close()
+		hdlr.ServeHTTP(cw, req)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logFile is the log written to -log-file, which can be reopened after
+// it was rotated, on SIGUSR1 on Unix.
+type logFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	lf := &logFile{path: path}
+	return lf, lf.reopen()
+}
+
+func (lf *logFile) reopen() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	lf.mu.Lock()
+	old := lf.f
+	lf.f = f
+	lf.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (lf *logFile) Write(b []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Write(b)
+}
+
+// watchReopen reopens lf whenever asked to, until ctx is done.
+func watchReopen(ctx context.Context, lf *logFile, logger *log.Logger) {
+	reopen := make(chan os.Signal, 1)
+	if !notifyReopen(reopen) {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reopen:
+			if err := lf.reopen(); err != nil {
+				logger.Println("Error reopening log file:", err)
+				continue
+			}
+			logger.Println("Reopened log file")
+		}
+	}
+}
+
+// writePIDFile writes the process ID to path, unless it holds the ID of
+// another gosfs which is still running.
+func writePIDFile(path string) error {
+	if b, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("process %d of %s is still running", pid, path)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
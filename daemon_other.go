@@ -0,0 +1,30 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReopen relays SIGUSR1, which logrotate and friends send after
+// rotating the log, to c.
+func notifyReopen(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR1)
+	return true
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// startService fails outside of Windows, daemons are started by their
+// service managers as ordinary processes.
+func startService(name string) (<-chan struct{}, error) {
+	return nil, errors.New("-service is only supported on Windows")
+}
+
+func serviceStopped() {}
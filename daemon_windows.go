@@ -0,0 +1,166 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	svcWin32OwnProcess = 0x10
+
+	svcStopped        = 1
+	svcStopPending    = 3
+	svcRunning        = 4
+	svcAcceptStop     = 1
+	svcAcceptShutdown = 4
+
+	svcControlStop        = 1
+	svcControlInterrogate = 4
+	svcControlShutdown    = 5
+
+	errorCallNotImplemented = 120
+	// svcStopWait is the time the service manager is told to wait for
+	// the shutdown.
+	svcStopWait = 30 * time.Second
+
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// service is the state of the process as a Windows service, there is only
+// one per process.
+var service struct {
+	name    *uint16
+	handle  uintptr
+	started chan error    // of ServiceMain registering the handler
+	stop    chan struct{} // closed on a stop or shutdown control
+	exit    chan struct{} // closed once stopped, ends ServiceMain
+	done    chan struct{} // closed once the dispatcher returned
+	once    sync.Once
+}
+
+func setServiceStatus(state, accepts uint32, wait time.Duration) error {
+	st := serviceStatus{
+		ServiceType:      svcWin32OwnProcess,
+		CurrentState:     state,
+		ControlsAccepted: accepts,
+		WaitHint:         uint32(wait / time.Millisecond),
+	}
+	if r, _, err := procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&st))); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// serviceHandler is the HandlerEx of the service, stop and shutdown
+// controls shut the server down like SIGTERM.
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case svcControlStop, svcControlShutdown:
+		setServiceStatus(svcStopPending, 0, svcStopWait)
+		service.once.Do(func() { close(service.stop) })
+	case svcControlInterrogate:
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+// serviceMain is the ServiceMain of the service, it runs until the service
+// reported being stopped.
+func serviceMain(argc, argv uintptr) uintptr {
+	h, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(service.name)), syscall.NewCallback(serviceHandler), 0)
+	if h == 0 {
+		service.started <- err
+		return 0
+	}
+	service.handle = h
+	service.started <- setServiceStatus(svcRunning, svcAcceptStop|svcAcceptShutdown, 0)
+	<-service.exit
+	return 0
+}
+
+// startService connects the process to the service control manager, which
+// started it as the service name. The returned channel is closed once the
+// service is asked to stop.
+func startService(name string) (<-chan struct{}, error) {
+	var err error
+	if service.name, err = syscall.UTF16PtrFromString(name); err != nil {
+		return nil, err
+	}
+	service.started = make(chan error, 1)
+	service.stop = make(chan struct{})
+	service.exit = make(chan struct{})
+	service.done = make(chan struct{})
+	go func() {
+		// The dispatcher occupies its thread until the service stopped.
+		runtime.LockOSThread()
+		table := []serviceTableEntry{{name: service.name, proc: syscall.NewCallback(serviceMain)}, {}}
+		if r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+			service.started <- err
+		}
+		close(service.done)
+	}()
+	if err := <-service.started; err != nil {
+		return nil, err
+	}
+	return service.stop, nil
+}
+
+// serviceStopped reports the service as stopped, once the server exited.
+func serviceStopped() {
+	if service.handle == 0 {
+		return
+	}
+	setServiceStatus(svcStopped, 0, 0)
+	close(service.exit)
+	select {
+	case <-service.done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// notifyReopen does nothing, Windows has no signal to reopen logs on.
+func notifyReopen(c chan<- os.Signal) bool {
+	return false
+}
+
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	return syscall.GetExitCodeProcess(h, &code) == nil && code == stillActive
+}
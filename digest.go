@@ -0,0 +1,117 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestCacheEntries caps the number of file digests kept in memory.
+const digestCacheEntries = 4096
+
+type fileDigest struct {
+	path    string
+	modTime time.Time
+	size    int64
+	sum     []byte
+}
+
+// digestCache keeps the SHA-256 digests of files, validated like the file
+// cache entries, so that large files aren't hashed for every request.
+type digestCache struct {
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newDigestCache() *digestCache {
+	return &digestCache{lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// sum returns the digest of the file at p, hashing it as a job of pool
+// unless a digest of its current version is cached.
+func (dc *digestCache) sum(ctx context.Context, pool *workerPool, a *atRest, p string, info fs.FileInfo) ([]byte, error) {
+	dc.mu.Lock()
+	if el, ok := dc.entries[p]; ok {
+		fd := el.Value.(*fileDigest)
+		if fd.modTime.Equal(info.ModTime()) && fd.size == info.Size() {
+			dc.lru.MoveToFront(el)
+			dc.mu.Unlock()
+			return fd.sum, nil
+		}
+		dc.lru.Remove(el)
+		delete(dc.entries, p)
+	}
+	dc.mu.Unlock()
+
+	var sum []byte
+	err := pool.run(ctx, "digest", p, func(ctx context.Context) error {
+		f, err := a.open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, &contextReader{ctx: ctx, r: f}); err != nil {
+			return err
+		}
+		sum = h.Sum(nil)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if _, ok := dc.entries[p]; !ok {
+		dc.entries[p] = dc.lru.PushFront(&fileDigest{path: p, modTime: info.ModTime(), size: info.Size(), sum: sum})
+		if dc.lru.Len() > digestCacheEntries {
+			oldest := dc.lru.Back()
+			dc.lru.Remove(oldest)
+			delete(dc.entries, oldest.Value.(*fileDigest).path)
+		}
+	}
+	return sum, nil
+}
+
+// wantsDigest reports whether the client of r asked for the SHA-256 digest
+// of the file with Want-Repr-Digest (RFC 9530).
+func wantsDigest(r *http.Request) bool {
+	for _, pref := range strings.Split(r.Header.Get("Want-Repr-Digest"), ",") {
+		alg, weight, _ := strings.Cut(strings.TrimSpace(pref), "=")
+		if strings.EqualFold(alg, "sha-256") && strings.TrimSpace(weight) != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// setDigest adds the Repr-Digest header of the file at p, the digest of
+// its unencoded content, which clients such as "gosfs get" verify their
+// downloads with.
+func (c *controller) setDigest(w http.ResponseWriter, r *http.Request, p string, info fs.FileInfo) {
+	var sum []byte
+	if c.scrubber != nil {
+		// Checksums taken on upload or by a scrub save hashing the file.
+		if stored, ok := c.scrubber.sums.get(r.URL.Path); ok && stored.current(info) {
+			sum, _ = hex.DecodeString(stored.SHA256)
+		}
+	}
+	if sum == nil {
+		var err error
+		if sum, err = c.digests.sum(r.Context(), c.workers, c.atRest, p, info); err != nil {
+			c.log(r).Println("Error hashing file:", err)
+			return
+		}
+	}
+	w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+}
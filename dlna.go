@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dlnaDeviceType        = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaContentDirectory  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaConnectionManager = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	// Announcements are valid for dlnaMaxAge and repeated well before.
+	dlnaMaxAge         = 30 * time.Minute
+	dlnaNotifyInterval = 10 * time.Minute
+	dlnaMaxSearchDelay = 5 * time.Second
+	dlnaServerHeader   = "Linux UPnP/1.0 DLNADOC/1.50 gosfs/1.0"
+	// dlnaFeatures tells clients that files can be seeked with range
+	// requests and streamed.
+	dlnaFeatures = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+	dlnaRootID   = "0"
+)
+
+//go:embed content-directory.xml
+var contentDirectorySCPD string
+
+//go:embed connection-manager.xml
+var connectionManagerSCPD string
+
+const dlnaDeviceDescription = `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>` + dlnaDeviceType + `</deviceType>
+    <friendlyName>%s</friendlyName>
+    <manufacturer>gosfs</manufacturer>
+    <manufacturerURL>https://github.com/ntk148v/gosfs</manufacturerURL>
+    <modelName>gosfs</modelName>
+    <UDN>uuid:%s</UDN>
+    <dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+    <presentationURL>/</presentationURL>
+    <serviceList>
+      <service>
+        <serviceType>` + dlnaContentDirectory + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/dlna/content-directory.xml</SCPDURL>
+        <controlURL>/dlna/control/content-directory</controlURL>
+        <eventSubURL>/dlna/event/content-directory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>` + dlnaConnectionManager + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/dlna/connection-manager.xml</SCPDURL>
+        <controlURL>/dlna/control/connection-manager</controlURL>
+        <eventSubURL>/dlna/event/connection-manager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>
+`
+
+// dlna announces gosfs as a UPnP AV media server on the LAN with SSDP, so
+// that TVs and consoles find it. The controller serves the descriptions
+// and the content directory under /dlna/, the files themselves as usual.
+type dlna struct {
+	name string
+	uuid string
+	port int
+}
+
+func newDLNA(name, rootDir string, port int) *dlna {
+	host, _ := os.Hostname()
+	if name == "" {
+		name = "gosfs on " + host
+	}
+	// Derived from the share rather than random, so that clients recognize
+	// the server across restarts.
+	sum := sha1.Sum([]byte(host + "\x00" + rootDir))
+	sum[6] = sum[6]&0x0f | 0x50 // version 5
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+	return &dlna{name: name, uuid: uuid, port: port}
+}
+
+// types returns the notification types of the device and its services.
+func (d *dlna) types() []string {
+	return []string{"upnp:rootdevice", "uuid:" + d.uuid, dlnaDeviceType, dlnaContentDirectory, dlnaConnectionManager}
+}
+
+func (d *dlna) usn(nt string) string {
+	if nt == "uuid:"+d.uuid {
+		return nt
+	}
+	return "uuid:" + d.uuid + "::" + nt
+}
+
+// location returns the URL of the device description for clients that
+// reach this host at localIP.
+func (d *dlna) location(localIP net.IP) string {
+	return "http://" + net.JoinHostPort(localIP.String(), strconv.Itoa(d.port)) + "/dlna/device.xml"
+}
+
+// start answers searches of clients and announces the server until ctx is
+// done, then says goodbye. The returned channel is closed after that.
+func (d *dlna) start(ctx context.Context, logger *log.Logger) (<-chan struct{}, error) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		ticker := time.NewTicker(dlnaNotifyInterval)
+		defer ticker.Stop()
+		d.notify(logger, conn, group, "ssdp:alive")
+		for {
+			select {
+			case <-ticker.C:
+				d.notify(logger, conn, group, "ssdp:alive")
+			case <-ctx.Done():
+				listener.Close()
+				d.notify(logger, conn, group, "ssdp:byebye")
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, src, err := listener.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Println("Error reading SSDP message:", err)
+				}
+				return
+			}
+			d.search(conn, buf[:n], src)
+		}
+	}()
+	logger.Printf("Announcing DLNA media server %q\n", d.name)
+	return done, nil
+}
+
+// notify multicasts an announcement of the given kind for every type.
+func (d *dlna) notify(logger *log.Logger, conn *net.UDPConn, group *net.UDPAddr, nts string) {
+	localIP, err := localIPFor(group)
+	if err != nil {
+		logger.Println("Error announcing DLNA media server:", err)
+		return
+	}
+	for _, nt := range d.types() {
+		msg := "NOTIFY * HTTP/1.1\r\nHOST: " + ssdpAddr +
+			"\r\nCACHE-CONTROL: max-age=" + strconv.Itoa(int(dlnaMaxAge/time.Second)) +
+			"\r\nLOCATION: " + d.location(localIP) +
+			"\r\nNT: " + nt + "\r\nNTS: " + nts +
+			"\r\nSERVER: " + dlnaServerHeader + "\r\nUSN: " + d.usn(nt) + "\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(msg), group); err != nil {
+			logger.Println("Error announcing DLNA media server:", err)
+			return
+		}
+	}
+}
+
+// search answers an M-SEARCH for the device or its services, after a
+// random delay of up to the MX seconds the client asked for.
+func (d *dlna) search(conn *net.UDPConn, msg []byte, src *net.UDPAddr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+		return
+	}
+	st := req.Header.Get("ST")
+	var matches []string
+	for _, t := range d.types() {
+		if st == "ssdp:all" || st == t {
+			matches = append(matches, t)
+		}
+	}
+	localIP, err := localIPFor(src)
+	if len(matches) == 0 || err != nil {
+		return
+	}
+	delay := dlnaMaxSearchDelay
+	if mx, err := strconv.Atoi(req.Header.Get("MX")); err == nil && mx >= 0 && time.Duration(mx)*time.Second < delay {
+		delay = time.Duration(mx) * time.Second
+	}
+	if delay > 0 {
+		delay = time.Duration(rand.Int63n(int64(delay)))
+	}
+	time.AfterFunc(delay, func() {
+		for _, t := range matches {
+			resp := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=" + strconv.Itoa(int(dlnaMaxAge/time.Second)) +
+				"\r\nEXT:\r\nLOCATION: " + d.location(localIP) +
+				"\r\nSERVER: " + dlnaServerHeader + "\r\nST: " + t + "\r\nUSN: " + d.usn(t) + "\r\n\r\n"
+			if _, err := conn.WriteToUDP([]byte(resp), src); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// localIPFor returns the address of this host on the network towards dst.
+func localIPFor(dst *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// dlnaMedia returns the UPnP class and the MIME type of files which DLNA
+// clients can play, or empty strings for other files.
+func dlnaMedia(name string) (string, string) {
+	var class string
+	switch fileKind(name, false) {
+	case KindVideo:
+		class = "object.item.videoItem"
+	case KindAudio:
+		class = "object.item.audioItem.musicTrack"
+	case KindImage:
+		class = "object.item.imageItem.photo"
+	default:
+		return "", ""
+	}
+	typ, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+	if err != nil {
+		typ = "application/octet-stream"
+	}
+	return class, typ
+}
+
+// dlnaHeaders adds the DLNA headers for media files to responses for
+// clients asking for them.
+func dlnaHeaders(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Header.Get("getcontentFeatures.dlna.org") != "1" {
+		return
+	}
+	class, _ := dlnaMedia(name)
+	if class == "" {
+		return
+	}
+	// Set as is, some clients don't match header names case-insensitively
+	w.Header()["contentFeatures.dlna.org"] = []string{dlnaFeatures}
+	mode := "Streaming"
+	if strings.HasPrefix(class, "object.item.imageItem") {
+		mode = "Interactive"
+	}
+	w.Header()["transferMode.dlna.org"] = []string{mode}
+}
+
+type didlLite struct {
+	XMLName    xml.Name     `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ DIDL-Lite"`
+	DC         string       `xml:"xmlns:dc,attr"`
+	UPnP       string       `xml:"xmlns:upnp,attr"`
+	Containers []didlObject `xml:"container"`
+	Items      []didlObject `xml:"item"`
+}
+
+type didlObject struct {
+	ID         string   `xml:"id,attr"`
+	ParentID   string   `xml:"parentID,attr"`
+	Restricted string   `xml:"restricted,attr"`
+	Title      string   `xml:"dc:title"`
+	Date       string   `xml:"dc:date,omitempty"`
+	Class      string   `xml:"upnp:class"`
+	Artist     string   `xml:"upnp:artist,omitempty"`
+	Album      string   `xml:"upnp:album,omitempty"`
+	Res        *didlRes `xml:"res,omitempty"`
+}
+
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Size         int64  `xml:"size,attr"`
+	URL          string `xml:",chardata"`
+}
+
+// dlnaID returns the object ID of the share path p, which is the path
+// itself, except for the root.
+func dlnaID(p string) string {
+	if p == "/" {
+		return dlnaRootID
+	}
+	return p
+}
+
+// dlnaObject describes the file at the share path p, with a URL at base
+// for media files.
+func (c *controller) dlnaObject(base, p string, info os.FileInfo) didlObject {
+	obj := didlObject{
+		ID:         dlnaID(p),
+		ParentID:   "-1",
+		Restricted: "1",
+		Title:      path.Base(p),
+		Date:       info.ModTime().UTC().Format("2006-01-02"),
+	}
+	if p != "/" {
+		obj.ParentID = dlnaID(strings.TrimSuffix(path.Dir(strings.TrimSuffix(p, "/")), "/") + "/")
+	} else {
+		obj.Title = c.dlna.name
+	}
+	if info.IsDir() {
+		obj.Class = "object.container.storageFolder"
+		return obj
+	}
+	class, typ := dlnaMedia(p)
+	obj.Class = class
+	obj.Res = &didlRes{
+		ProtocolInfo: "http-get:*:" + typ + ":" + dlnaFeatures,
+		Size:         c.atRest.plainInfo(info).Size(),
+		URL:          base + (&url.URL{Path: p}).String(),
+	}
+	if isAudio(p) {
+		tags := c.readTags(c.fsPath(p))
+		if tags.Title != "" {
+			obj.Title = tags.Title
+		}
+		obj.Artist, obj.Album = tags.Artist, tags.Album
+	}
+	return obj
+}
+
+// upnpError is a UPnP error code and description, sent as a SOAP fault.
+type upnpError struct {
+	code        int
+	description string
+}
+
+var (
+	errInvalidAction = upnpError{401, "Invalid Action"}
+	errInvalidArgs   = upnpError{402, "Invalid Args"}
+	errNoSuchObject  = upnpError{701, "No such object"}
+	errNoContainer   = upnpError{710, "No such container"}
+)
+
+// dlnaBrowse implements the Browse action of the content directory, over
+// the visible directories and media files.
+func (c *controller) dlnaBrowse(r *http.Request, args map[string]string) ([]string, *upnpError) {
+	p := args["ObjectID"]
+	if p == dlnaRootID {
+		p = "/"
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	if !strings.HasPrefix(p, "/") || clean != p {
+		return nil, &errNoSuchObject
+	}
+	file := c.fsPath(p)
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() != strings.HasSuffix(p, "/") || c.isHidden(p, info.IsDir()) || !c.allowed(file) {
+		return nil, &errNoSuchObject
+	}
+	if !info.IsDir() {
+		if class, _ := dlnaMedia(p); class == "" {
+			return nil, &errNoSuchObject
+		}
+	}
+	start, err := strconv.Atoi(args["StartingIndex"])
+	if err != nil || start < 0 {
+		start = 0
+	}
+	count, err := strconv.Atoi(args["RequestedCount"])
+	if err != nil || count < 0 {
+		count = 0
+	}
+
+	base := "http://" + r.Host
+	result := didlLite{DC: "http://purl.org/dc/elements/1.1/", UPnP: "urn:schemas-upnp-org:metadata-1-0/upnp/"}
+	add := func(obj didlObject) {
+		if obj.Res == nil {
+			result.Containers = append(result.Containers, obj)
+		} else {
+			result.Items = append(result.Items, obj)
+		}
+	}
+	var total int
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		add(c.dlnaObject(base, p, info))
+		total = 1
+	case "BrowseDirectChildren":
+		if !info.IsDir() {
+			return nil, &errNoContainer
+		}
+		dir, err := c.listDir(file, listOptions{Sort: SortByName, Order: OrderAsc})
+		if err != nil {
+			c.log(r).Println("Error listing files in directory", err)
+			return nil, &errNoSuchObject
+		}
+		var children []File
+		for _, f := range dir.Files {
+			if class, _ := dlnaMedia(f.Name); f.IsDir || class != "" {
+				children = append(children, f)
+			}
+		}
+		total = len(children)
+		if start > total {
+			start = total
+		}
+		end := total
+		if count > 0 && start+count < end {
+			end = start + count
+		}
+		for _, f := range children[start:end] {
+			info, err := os.Stat(filepath.Join(file, f.Name))
+			if err != nil {
+				continue
+			}
+			add(c.dlnaObject(base, p+f.Name, info))
+		}
+	default:
+		return nil, &errInvalidArgs
+	}
+	didl, err := xml.Marshal(result)
+	if err != nil {
+		c.log(r).Println("Error encoding DIDL-Lite:", err)
+		return nil, &upnpError{501, "Action Failed"}
+	}
+	returned := len(result.Containers) + len(result.Items)
+	return []string{
+		"Result", string(didl),
+		"NumberReturned", strconv.Itoa(returned),
+		"TotalMatches", strconv.Itoa(total),
+		"UpdateID", "0",
+	}, nil
+}
+
+// dlnaDescription serves the description of the device and its services.
+func (c *controller) dlnaDescription(w http.ResponseWriter, r *http.Request) {
+	var body string
+	switch r.URL.Path {
+	case "/dlna/device.xml":
+		var name bytes.Buffer
+		xml.EscapeText(&name, []byte(c.dlna.name))
+		body = fmt.Sprintf(dlnaDeviceDescription, name.String(), c.dlna.uuid)
+	case "/dlna/content-directory.xml":
+		body = contentDirectorySCPD
+	case "/dlna/connection-manager.xml":
+		body = connectionManagerSCPD
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+}
+
+// dlnaControl invokes the SOAP actions of the services.
+func (c *controller) dlnaControl(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	i := strings.LastIndexByte(action, '#')
+	if i < 0 {
+		soapFault(w, errInvalidAction)
+		return
+	}
+	service, name := action[:i], action[i+1:]
+	args, err := soapArgs(r.Body)
+	if err != nil {
+		soapFault(w, errInvalidArgs)
+		return
+	}
+	var out []string
+	var uerr *upnpError
+	switch {
+	case service == dlnaContentDirectory && r.URL.Path == "/dlna/control/content-directory":
+		switch name {
+		case "Browse":
+			out, uerr = c.dlnaBrowse(r, args)
+		case "GetSearchCapabilities":
+			out = []string{"SearchCaps", ""}
+		case "GetSortCapabilities":
+			out = []string{"SortCaps", ""}
+		case "GetSystemUpdateID":
+			out = []string{"Id", "0"}
+		default:
+			uerr = &errInvalidAction
+		}
+	case service == dlnaConnectionManager && r.URL.Path == "/dlna/control/connection-manager":
+		switch name {
+		case "GetProtocolInfo":
+			out = []string{"Source", "http-get:*:video/*:*,http-get:*:audio/*:*,http-get:*:image/*:*", "Sink", ""}
+		case "GetCurrentConnectionIDs":
+			out = []string{"ConnectionIDs", "0"}
+		case "GetCurrentConnectionInfo":
+			out = []string{
+				"RcsID", "-1",
+				"AVTransportID", "-1",
+				"ProtocolInfo", "",
+				"PeerConnectionManager", "",
+				"PeerConnectionID", "-1",
+				"Direction", "Output",
+				"Status", "OK",
+			}
+		default:
+			uerr = &errInvalidAction
+		}
+	default:
+		uerr = &errInvalidAction
+	}
+	if uerr != nil {
+		soapFault(w, *uerr)
+		return
+	}
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%sResponse xmlns:u="%s">`, name, service)
+	for i := 0; i+1 < len(out); i += 2 {
+		fmt.Fprintf(&body, "<%s>", out[i])
+		xml.EscapeText(&body, []byte(out[i+1]))
+		fmt.Fprintf(&body, "</%s>", out[i])
+	}
+	fmt.Fprintf(&body, "</u:%sResponse></s:Body></s:Envelope>", name)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Write(body.Bytes())
+}
+
+func soapFault(w http.ResponseWriter, uerr upnpError) {
+	var desc bytes.Buffer
+	xml.EscapeText(&desc, []byte(uerr.description))
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, uerr.code, desc.String())
+}
+
+// dlnaSubscribe accepts event subscriptions. No events are sent, as the
+// evented state doesn't change, but some clients insist on subscribing.
+func (c *controller) dlnaSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "SUBSCRIBE" {
+		sid := r.Header.Get("SID")
+		if sid == "" {
+			sid = "uuid:" + newRequestID()
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-"+strconv.Itoa(int(dlnaMaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusOK)
+}
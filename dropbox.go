@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+)
+
+// readable reports whether existing files may be listed or downloaded by
+// the client of r, which drop box mode forbids unless the URL is signed.
+func (c *controller) readable(r *http.Request) bool {
+	return !c.settings.get().DropBox || isSigned(r)
+}
+
+// dropBoxPage shows the upload form for directories in drop box mode and
+// refuses everything else.
+func (c *controller) dropBoxPage(w http.ResponseWriter, r *http.Request, p string, info fs.FileInfo) {
+	if info == nil || !info.IsDir() {
+		http.Error(w, "downloads are disabled", http.StatusForbidden)
+		return
+	}
+	display, err := c.relPath(p, true)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	c.renderIndex(w, r, Dir{
+		DisplayPath:  display,
+		Breadcrumbs:  breadcrumbs(display),
+		DropBox:      true,
+		UploadFields: c.uploadFields(display),
+	})
+}
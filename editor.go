@@ -0,0 +1,187 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const DefaultEditMaxSize = 1 << 20 // 1MiB
+
+//go:embed editor.html
+var editorContent string
+
+var editorTemplate = template.Must(template.New("editor").Parse(editorContent))
+
+type Editor struct {
+	Name    string
+	Link    string
+	Parent  string
+	ETag    string
+	Content string
+	Error   string
+}
+
+// fileETag derives a weak validator from the modification time and size.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// edit shows a small text file in an editor on GET and saves it on POST.
+// Saving requires the ETag the editor was loaded with, either as form field
+// or If-Match header, so concurrent edits don't silently overwrite each
+// other.
+func (c *controller) edit(w http.ResponseWriter, r *http.Request, p string, info fs.FileInfo) {
+	if !c.settings.get().EditEnabled {
+		http.Error(w, "editing is disabled", http.StatusForbidden)
+		return
+	}
+	if info.Size() > c.editMaxSize {
+		http.Error(w, "file is too large to edit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if info.Mode().Perm()&0o200 == 0 {
+		http.Error(w, "file is read-only", http.StatusForbidden)
+		return
+	}
+	ed := Editor{
+		Name:   info.Name(),
+		Link:   (&url.URL{Path: r.URL.Path}).String(),
+		Parent: (&url.URL{Path: path.Dir(r.URL.Path)}).String(),
+		ETag:   fileETag(info),
+	}
+	if ed.Parent != "/" {
+		ed.Parent += "/"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		b, err := c.atRest.readFile(p)
+		if err != nil {
+			c.internalError(w, r, "Error reading file for editing:", err)
+			return
+		}
+		if len(b) > 0 && !isText(b) {
+			http.Error(w, "only text files can be edited", http.StatusUnsupportedMediaType)
+			return
+		}
+		ed.Content = string(b)
+		c.renderEditor(w, r, ed, http.StatusOK)
+	case http.MethodPost, http.MethodPut:
+		c.save(w, r, p, ed)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *controller) save(w http.ResponseWriter, r *http.Request, p string, ed Editor) {
+	r.Body = http.MaxBytesReader(w, r.Body, c.editMaxSize+4096)
+	var (
+		content string
+		etag    = r.Header.Get("If-Match")
+		form    = strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") ||
+			strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	)
+	if form {
+		if err := r.ParseMultipartForm(c.editMaxSize); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content = r.PostFormValue("content")
+		if etag == "" {
+			etag = r.PostFormValue("etag")
+		}
+		// Browsers submit textareas with CRLF line endings.
+		content = strings.ReplaceAll(content, "\r\n", "\n")
+	} else {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		content = string(b)
+	}
+	if int64(len(content)) > c.editMaxSize || !utf8.ValidString(content) {
+		http.Error(w, "content must be valid UTF-8 text within the size limit", http.StatusBadRequest)
+		return
+	}
+	if etag == "" {
+		http.Error(w, "missing ETag, load the file before saving it", http.StatusPreconditionRequired)
+		return
+	}
+	if etag != ed.ETag {
+		if !form {
+			http.Error(w, "file has been modified in the meantime", http.StatusPreconditionFailed)
+			return
+		}
+		// Keep the user's changes so they can be merged by hand.
+		ed.Content = content
+		ed.Error = "The file has been modified by someone else since you opened it, reload to see their version."
+		c.renderEditor(w, r, ed, http.StatusConflict)
+		return
+	}
+
+	data, err := c.atRest.seal([]byte(content))
+	if err == nil {
+		err = writeFileAtomic(c.journal, p, data)
+	}
+	if err != nil {
+		c.log(r).Println("Error saving edited file:", err)
+		http.Error(w, "unable to save file", http.StatusInternalServerError)
+		return
+	}
+	c.log(r).Printf("Edited file: %s, size: %d\n", r.URL.Path, len(content))
+	c.audit(w, r, ActionEdit, r.URL.Path)
+	c.replicate(r.URL.Path)
+	if form {
+		http.Redirect(w, r, ed.Link+"?edit=1", http.StatusSeeOther)
+		return
+	}
+	if info, err := os.Stat(p); err == nil {
+		w.Header().Set("ETag", fileETag(c.atRest.plainInfo(info)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeFileAtomic replaces the file at p through a temporary file in the
+// same directory, keeping the permissions of the original. The rename is
+// recorded in j.
+func writeFileAtomic(j *journal, p string, data []byte) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return j.rename(tmp.Name(), p)
+}
+
+func (c *controller) renderEditor(w http.ResponseWriter, r *http.Request, ed Editor, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := editorTemplate.Execute(w, ed); err != nil {
+		c.log(r).Println("Error rendering editor page:", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// encryptionHeader carries the encryption metadata of files uploaded with
+// PUT, and of downloads of encrypted files.
+const encryptionHeader = "X-Gosfs-Encryption"
+
+// maxEncryptionSize bounds the encryption metadata, which has to fit into
+// a header.
+const maxEncryptionSize = 4096
+
+// checkEncryption refuses encryption metadata which can't be returned in
+// a header: it has to be printable ASCII, e.g. base64 encoded JSON.
+func checkEncryption(s string) error {
+	if len(s) > maxEncryptionSize {
+		return fmt.Errorf("encryption metadata exceeds %d bytes", maxEncryptionSize)
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return fmt.Errorf("encryption metadata must be printable ASCII, e.g. base64")
+		}
+	}
+	return nil
+}
+
+// setEncryption replaces the encryption metadata of the file uploaded to
+// the share path rel, so that a plain upload replacing an encrypted file
+// isn't taken for encrypted.
+func (c *controller) setEncryption(r *http.Request, rel, encryption string) {
+	m := c.meta.get(rel)
+	if m.Encryption == encryption {
+		return
+	}
+	m.Encryption = encryption
+	if err := c.meta.set(rel, m); err != nil {
+		c.log(r).Printf("Error storing encryption metadata of %s: %v\n", rel, err)
+	}
+}
+
+// setMeta shows the metadata m of the file in listings. Encrypted files
+// get no previews or thumbnails, they'd only show noise.
+func (f *File) setMeta(m Metadata) {
+	f.Tags = m.Tags
+	if m.Encryption != "" {
+		f.Encrypted = true
+		f.Encryption = m.Encryption
+		f.Preview, f.Thumb = "", ""
+	}
+}
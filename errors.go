@@ -0,0 +1,86 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+//go:embed error.html
+var errorContent string
+
+var errorTemplate = template.Must(template.New("error").Parse(errorContent))
+
+// Formats of error responses.
+const (
+	errorText = iota
+	errorJSON
+	errorHTML
+)
+
+// APIError is the body of error responses to API clients.
+type APIError struct {
+	// Code is a stable, machine-readable reason, the snake cased status
+	// text unless the error has a more specific one.
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// errorCode returns the generic code of errors with the given status.
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// errorFormat decides how errors are shown to the client of r: as JSON to
+// API clients and scripts, as a page to browsers and as plain text to the
+// rest, e.g. curl and the fetches of the web UI.
+func errorFormat(r *http.Request) int {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r) || r.Header.Get("X-Requested-With") == "XMLHttpRequest":
+		return errorJSON
+	case strings.Contains(r.Header.Get("Accept"), "text/html"):
+		return errorHTML
+	}
+	return errorText
+}
+
+// writeError responds with the error in the format the client expects.
+// Plain text errors get their request ID from the tracing middleware.
+func writeError(w http.ResponseWriter, r *http.Request, status int, e APIError) {
+	if e.Code == "" {
+		e.Code = errorCode(status)
+	}
+	e.RequestID = requestID(r)
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("X-Content-Type-Options", "nosniff")
+	switch errorFormat(r) {
+	case errorJSON:
+		h.Set("Cache-Control", "no-store")
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(e)
+	case errorHTML:
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		errorTemplate.Execute(w, struct {
+			APIError
+			Status     int
+			StatusText string
+		}{e, status, http.StatusText(status)})
+	default:
+		http.Error(w, e.Message, status)
+	}
+}
+
+// internalError responds to a failure of the server, which is logged
+// along with the request ID. Its details, such as paths, aren't shown to
+// clients.
+func (c *controller) internalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	c.log(r).Println(msg, err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
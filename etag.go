@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etagSeed changes with every start, so that pages rendered with different
+// server options are never mistaken for each other.
+var etagSeed = time.Now().UnixNano()
+
+func weakETag(h hash.Hash) string {
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// listingETag summarizes everything a rendered listing page depends on: the
+// representation, the query, the directory itself and the shown entries.
+func listingETag(dir Dir, modTime time.Time, r *http.Request) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%d\x00%t\x00%s\x00%s\x00%d\x00%d\x00%s\x00", etagSeed, wantsJSON(r),
+		r.URL.RawQuery, dir.DisplayPath, modTime.UnixNano(), dir.Total, dir.Readme)
+	for _, f := range dir.UploadFields {
+		fmt.Fprintf(h, "%s\x00%s\x00%t\x00", f.Name, f.Label, f.Required)
+	}
+	for _, f := range dir.Files {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s\x00%t\x00%s\x00%s\x00%s\x00", f.Name, f.RawSize, f.RawModTime.UnixNano(), strings.Join(f.Tags, ","), f.Starred, f.Mode, f.Owner, f.Encryption)
+	}
+	return weakETag(h)
+}
+
+// etagMatch reports whether the If-None-Match header lists etag, weak
+// comparison is used as mandated for GET and HEAD.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the validators and answers with 304 when the client's
+// copy is still fresh. If-Modified-Since is only consulted in the absence
+// of If-None-Match. A zero modTime omits Last-Modified.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	addVary(w.Header(), "Accept")
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	fresh := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		fresh = etagMatch(inm, etag)
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.IsZero() {
+		fresh = !modTime.Truncate(time.Second).After(ims)
+	}
+	if fresh {
+		h := w.Header()
+		delete(h, "Content-Type")
+		delete(h, "Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return fresh
+}
+
+// writeJSON encodes v with an ETag derived from the encoded body, so that
+// polling API clients can revalidate cheaply.
+func (c *controller) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		c.internalError(w, r, "Error encoding JSON response:", err)
+		return
+	}
+	h := sha1.New()
+	h.Write(buf.Bytes())
+	if notModified(w, r, weakETag(h), time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
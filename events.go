@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWatchInterval = 2 * time.Second
+	// watchHistory is the number of recent events kept per directory, which
+	// reconnecting clients are caught up with.
+	watchHistory = 128
+	// watchIdle is how long a directory is still polled after its last
+	// subscriber left, so that clients reconnecting don't miss events.
+	watchIdle = 30 * time.Second
+	// eventStreamDuration ends streams before the server's write timeout
+	// does, the browser then reconnects transparently.
+	eventStreamDuration = DefaultWriteTimeout - time.Second
+	// watchMaxDirs bounds the directories watched for a recursive watch.
+	watchMaxDirs = 1000
+)
+
+// Event is a change of a directory entry. Created and modified files come
+// with their size and modification time.
+type Event struct {
+	ID      uint64     `json:"id,omitempty"` // none for entries found while watching
+	Type    string     `json:"type"`         // create, modify or delete
+	Path    string     `json:"path"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"mod_time,omitempty"`
+}
+
+type entryState struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// watch polls a single directory for changes on behalf of its subscribers.
+type watch struct {
+	subs    map[chan Event]struct{}
+	history []Event
+	idle    time.Time
+}
+
+// watcher detects changes by periodically comparing snapshots of the
+// directories clients are viewing, as there is no portable file system
+// notification API in the standard library. Only watched directories are
+// polled.
+type watcher struct {
+	interval time.Duration
+	snapshot func(dir, display string) (map[string]entryState, error)
+
+	mu      sync.Mutex
+	watches map[string]*watch
+	lastID  uint64
+}
+
+func newWatcher(interval time.Duration, snapshot func(dir, display string) (map[string]entryState, error)) *watcher {
+	return &watcher{
+		interval: interval,
+		snapshot: snapshot,
+		watches:  map[string]*watch{},
+		// Event IDs increase across restarts so stale IDs replay nothing.
+		lastID: uint64(time.Now().UnixNano()),
+	}
+}
+
+// subscribe returns a channel of the events of dir after lastID and a
+// function to cancel the subscription.
+func (wt *watcher) subscribe(dir, display string, lastID uint64) (chan Event, func()) {
+	ch := make(chan Event, watchHistory)
+	return ch, wt.subscribeTo(ch, dir, display, lastID)
+}
+
+// subscribeTo sends the events of dir after lastID to ch, which may be
+// shared by the subscriptions of several directories, until the returned
+// function is called.
+func (wt *watcher) subscribeTo(ch chan Event, dir, display string, lastID uint64) func() {
+	wt.mu.Lock()
+	wa, ok := wt.watches[dir]
+	if !ok {
+		wa = &watch{subs: map[chan Event]struct{}{}}
+		wt.watches[dir] = wa
+		go wt.poll(dir, display, wa)
+	}
+	for _, ev := range wa.history {
+		if ev.ID > lastID {
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+	wa.subs[ch] = struct{}{}
+	wt.mu.Unlock()
+	return func() {
+		wt.mu.Lock()
+		delete(wa.subs, ch)
+		if len(wa.subs) == 0 {
+			wa.idle = time.Now()
+		}
+		wt.mu.Unlock()
+	}
+}
+
+func (wt *watcher) poll(dir, display string, wa *watch) {
+	prev, _ := wt.snapshot(dir, display)
+	ticker := time.NewTicker(wt.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		wt.mu.Lock()
+		if len(wa.subs) == 0 && time.Since(wa.idle) > watchIdle {
+			delete(wt.watches, dir)
+			wt.mu.Unlock()
+			return
+		}
+		wt.mu.Unlock()
+
+		cur, err := wt.snapshot(dir, display)
+		if err != nil {
+			// Gone directories report the deletion of every entry.
+			cur = nil
+		}
+		wt.publish(wa, diffSnapshots(display, prev, cur))
+		prev = cur
+	}
+}
+
+func (wt *watcher) publish(wa *watch, events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	for _, ev := range events {
+		wt.lastID++
+		ev.ID = wt.lastID
+		wa.history = append(wa.history, ev)
+		for ch := range wa.subs {
+			select {
+			case ch <- ev:
+			default:
+				// Slow clients miss events rather than blocking the others.
+			}
+		}
+	}
+	if n := len(wa.history) - watchHistory; n > 0 {
+		wa.history = append([]Event(nil), wa.history[n:]...)
+	}
+}
+
+func (st entryState) event(typ, p string) Event {
+	ev := Event{Type: typ, Path: p}
+	if !st.isDir {
+		ev.Size = st.size
+	}
+	t := st.modTime.UTC()
+	ev.ModTime = &t
+	return ev
+}
+
+func diffSnapshots(display string, prev, cur map[string]entryState) []Event {
+	var events []Event
+	for name, st := range cur {
+		old, ok := prev[name]
+		switch {
+		case !ok:
+			events = append(events, st.event("create", display+name))
+		case old != st:
+			events = append(events, st.event("modify", display+name))
+		}
+	}
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			events = append(events, Event{Type: "delete", Path: display + name})
+		}
+	}
+	return events
+}
+
+// snapshot records the state of the visible entries of dir.
+func (c *controller) snapshot(dir, display string) (map[string]entryState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	snap := make(map[string]entryState, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == IgnoreFileName || c.isHidden(display+name, entry.IsDir()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			name += "/"
+		}
+		snap[name] = entryState{size: info.Size(), modTime: info.ModTime(), isDir: info.IsDir()}
+	}
+	return snap, nil
+}
+
+// events streams the changes of the directory given by the path parameter
+// as Server-Sent Events.
+func (c *controller) events(w http.ResponseWriter, r *http.Request) {
+	if c.noListing || !c.readable(r) || c.watcher == nil {
+		http.NotFound(w, r)
+		return
+	}
+	display := path.Clean("/" + r.URL.Query().Get("path"))
+	if display != "/" {
+		display += "/"
+	}
+	dir := c.fsPath(display)
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() || c.isHidden(display, true) || !c.allowed(dir) {
+		http.NotFound(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	events, cancel := c.watcher.subscribe(dir, display, lastID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	timeout := time.NewTimer(eventStreamDuration)
+	defer timeout.Stop()
+	for {
+		select {
+		case ev := <-events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				c.log(r).Println("Error encoding event:", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, b)
+			flusher.Flush()
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// watch streams the changes below the directory given by the path
+// parameter over a WebSocket, one JSON event per message, for automation.
+// With recursive=true, subdirectories are watched too, including the ones
+// created while watching, whose entries are reported as created.
+func (c *controller) watch(w http.ResponseWriter, r *http.Request) {
+	if c.noListing || !c.readable(r) || c.watcher == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	display := path.Clean("/" + q.Get("path"))
+	if display != "/" {
+		display += "/"
+	}
+	dir := c.fsPath(display)
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() || c.isHidden(display, true) || !c.allowed(dir) {
+		http.NotFound(w, r)
+		return
+	}
+	recursive := q.Get("recursive") == "true"
+	dirs := []string{display}
+	if recursive {
+		if dirs, err = c.watchDirs(display); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	lastID, _ := strconv.ParseUint(q.Get("last_id"), 10, 64)
+
+	ws, ok := upgradeWebSocket(w, r)
+	if !ok || !c.sockets.add(ws) {
+		return
+	}
+	defer c.sockets.remove(ws)
+
+	events := make(chan Event, watchHistory)
+	subs := map[string]func(){}
+	defer func() {
+		for _, cancel := range subs {
+			cancel()
+		}
+	}()
+	subscribe := func(display string) {
+		if _, ok := subs[display]; !ok && len(subs) < watchMaxDirs {
+			subs[display] = c.watcher.subscribeTo(events, c.fsPath(display), display, lastID)
+		}
+	}
+	for _, d := range dirs {
+		subscribe(d)
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	var pending []Event
+	for {
+		var ev Event
+		if len(pending) > 0 {
+			ev, pending = pending[0], pending[1:]
+		} else {
+			select {
+			case ev = <-events:
+			case <-ping.C:
+				if ws.write(wsPing, nil) != nil {
+					return
+				}
+				continue
+			case <-ws.closed:
+				return
+			}
+		}
+		if recursive && strings.HasSuffix(ev.Path, "/") {
+			switch ev.Type {
+			case "create":
+				subscribe(ev.Path)
+				// Entries created before the directory was watched
+				snap, _ := c.snapshot(c.fsPath(ev.Path), ev.Path)
+				for name, st := range snap {
+					pending = append(pending, st.event("create", ev.Path+name))
+				}
+			case "delete":
+				for d, cancel := range subs {
+					if strings.HasPrefix(d, ev.Path) {
+						cancel()
+						delete(subs, d)
+					}
+				}
+			}
+		}
+		b, err := json.Marshal(ev)
+		if err != nil {
+			c.log(r).Println("Error encoding event:", err)
+			return
+		}
+		if ws.write(wsText, b) != nil {
+			return
+		}
+	}
+}
+
+// watchDirs returns the visible directories of the tree at the share path
+// display, failing if there are more than can be watched.
+func (c *controller) watchDirs(display string) ([]string, error) {
+	root := c.fsPath(display)
+	var dirs []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		rel, err := c.relPath(p, true)
+		if err != nil || p != root && c.isHidden(rel, true) {
+			return filepath.SkipDir
+		}
+		if len(dirs) == watchMaxDirs {
+			return fmt.Errorf("more than %d directories to watch, watch a subdirectory instead", watchMaxDirs)
+		}
+		dirs = append(dirs, rel)
+		return nil
+	})
+	return dirs, err
+}
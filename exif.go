@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errNotImage = errors.New("unsupported image format")
+
+// unstrippable are the image formats whose metadata can't be stripped.
+// Where it has to be, they are refused rather than served with it.
+var unstrippable = map[string]bool{".heic": true, ".heif": true, ".webp": true, ".tif": true, ".tiff": true}
+
+// stripsExif reports whether metadata should be removed from the image at
+// the share relative path rel, either because it lies below one of the
+// configured prefixes, because its share strips it, see Share.StripExif,
+// or because the client asked for it.
+func (c *controller) stripsExif(r *http.Request, rel string, shared bool) bool {
+	switch ext := strings.ToLower(path.Ext(rel)); {
+	case ext == ".jpg", ext == ".jpeg", ext == ".png", unstrippable[ext]:
+	default:
+		return false
+	}
+	if shared || r.URL.Query().Get("strip-exif") == "1" {
+		return true
+	}
+	for _, prefix := range c.stripExif {
+		if rel == prefix || strings.HasPrefix(rel, strings.TrimSuffix(prefix, "/")+"/") || prefix == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveStripped serves the image at p without its EXIF, XMP and text
+// metadata. The pixel data is copied untouched, so this is lossless, but
+// viewers relying on the EXIF orientation may show the image rotated.
+func (c *controller) serveStripped(w http.ResponseWriter, r *http.Request, p string) {
+	if unstrippable[strings.ToLower(filepath.Ext(p))] {
+		http.Error(w, "image metadata can't be stripped from this format", http.StatusForbidden)
+		return
+	}
+	f, err := c.atRest.open(p)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(info.Size()))
+	if err = stripMetadata(&buf, bufio.NewReader(f)); err != nil {
+		c.log(r).Println("Error stripping image metadata:", err)
+		http.Error(w, "unable to strip image metadata", http.StatusUnprocessableEntity)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(buf.Bytes()))
+}
+
+func stripMetadata(w io.Writer, r *bufio.Reader) error {
+	magic, err := r.Peek(8)
+	if err != nil {
+		return errNotImage
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xff, 0xd8}):
+		return stripJPEG(w, r)
+	case bytes.Equal(magic, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNG(w, r)
+	}
+	return errNotImage
+}
+
+// stripJPEG drops the APP1 (EXIF, XMP) and APP13 (IPTC) segments.
+func stripJPEG(w io.Writer, r *bufio.Reader) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		return err
+	}
+	if _, err := w.Write(soi); err != nil {
+		return err
+	}
+	for {
+		marker := make([]byte, 2)
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return err
+		}
+		if marker[0] != 0xff {
+			return errNotImage
+		}
+		// Start of scan, the rest is entropy coded data.
+		if marker[1] == 0xda {
+			if _, err := w.Write(marker); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint16(length)) - 2
+		if n < 0 {
+			return errNotImage
+		}
+		if marker[1] == 0xe1 || marker[1] == 0xed {
+			if _, err := io.CopyN(io.Discard, r, n); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := w.Write(append(marker, length...)); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return err
+		}
+	}
+}
+
+// pngMetadata are the chunk types removed from PNG files.
+var pngMetadata = map[string]bool{"eXIf": true, "tEXt": true, "iTXt": true, "zTXt": true, "tIME": true}
+
+func stripPNG(w io.Writer, r *bufio.Reader) error {
+	if _, err := io.CopyN(w, r, 8); err != nil {
+		return err
+	}
+	for {
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Data plus the trailing CRC.
+		n := int64(binary.BigEndian.Uint32(hdr)) + 4
+		if pngMetadata[string(hdr[4:])] {
+			if _, err := io.CopyN(io.Discard, r, n); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := w.Write(hdr); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return err
+		}
+		if string(hdr[4:]) == "IEND" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// shareExpiryInterval is the time between checks for expired shares.
+const shareExpiryInterval = time.Minute
+
+// expireShares ends the shares which expired every shareExpiryInterval
+// until ctx is done, archiving their contents into archiveDir or deleting
+// them if the shares asked for it. Shares whose action failed are retried
+// on the next check.
+func (c *controller) expireShares(ctx context.Context, archiveDir string) {
+	ticker := time.NewTicker(shareExpiryInterval)
+	defer ticker.Stop()
+	for {
+		for _, sh := range c.shareStore.expire() {
+			c.endShare(ctx, sh, archiveDir)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// endShare applies the expiry action of sh, removes it and notifies the
+// webhooks.
+func (c *controller) endShare(ctx context.Context, sh Share, archiveDir string) {
+	ev := WebhookEvent{Event: EventShareExpired, Path: sh.Path, Token: sh.Token, Action: sh.OnExpiry}
+	if sh.OnExpiry != ExpiryKeep {
+		var removed []string
+		err := c.workers.run(ctx, "share-expiry", sh.Path, func(ctx context.Context) error {
+			contents, err := c.shareContents(sh)
+			if err != nil {
+				return err
+			}
+			if sh.OnExpiry == ExpiryArchive {
+				if err := c.archiveShare(ctx, sh, contents, archiveDir); err != nil {
+					return err
+				}
+			}
+			removed, err = c.removeContents(contents)
+			return err
+		})
+		for _, rel := range removed {
+			c.replicate(rel)
+		}
+		if err != nil {
+			c.logger.Printf("Error applying %s to expired share %s of %s: %v\n", sh.OnExpiry, sh.Token, sh.Path, err)
+			return
+		}
+		c.logger.Printf("Share %s expired, applied %s to %s\n", sh.Token, sh.OnExpiry, sh.Path)
+	}
+	if err := c.shareStore.end(sh.Token); err != nil {
+		c.logger.Println("Error saving shares:", err)
+	}
+	c.emit(ev)
+}
+
+// shareContent is a file or directory of an expired share.
+type shareContent struct {
+	rel  string
+	file string
+	info fs.FileInfo
+}
+
+// shareContents lists the contents of sh in all layers, the shared file or
+// what the shared directory holds, but not the directory itself. Hidden
+// and ignored entries, which the share never exposed, are left out, and so
+// are links. Directories come before their contents.
+func (c *controller) shareContents(sh Share) ([]shareContent, error) {
+	var contents []shareContent
+	for _, l := range c.layers() {
+		root := filepath.Join(l.dir, filepath.FromSlash(sh.Path))
+		if _, err := os.Lstat(root); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == root && d.IsDir() {
+				return nil
+			}
+			rel, err := c.relPath(p, d.IsDir())
+			if err != nil {
+				return err
+			}
+			if c.isHidden(rel, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			contents = append(contents, shareContent{rel: rel, file: p, info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// removeContents removes the files of contents, and then the directories
+// they leave empty. It returns the share paths removed.
+func (c *controller) removeContents(contents []shareContent) ([]string, error) {
+	var removed []string
+	for i := len(contents) - 1; i >= 0; i-- {
+		e := contents[i]
+		if e.info.IsDir() {
+			// Kept for what the share didn't expose
+			if entries, err := os.ReadDir(e.file); err != nil || len(entries) > 0 {
+				continue
+			}
+		}
+		if err := c.journal.remove(e.file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		removed = append(removed, e.rel)
+	}
+	return removed, nil
+}
+
+// archiveShare writes the contents of sh to <token>-<expiry>.tar.gz in dir,
+// of each path the one in the first layer.
+func (c *controller) archiveShare(ctx context.Context, sh Share, contents []shareContent, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := sh.Token + "-" + sh.Expires.UTC().Format(snapshotTimeFormat) + ".tar.gz"
+	tmp, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	gw := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gw)
+	err = archiveContents(ctx, tw, contents)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// archiveContents writes contents to tw by share path, skipping the paths
+// written already.
+func archiveContents(ctx context.Context, tw *tar.Writer, contents []shareContent) error {
+	seen := map[string]bool{}
+	for _, e := range contents {
+		if seen[e.rel] {
+			continue
+		}
+		seen[e.rel] = true
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		hdr, err := tar.FileInfoHeader(e.info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = strings.TrimPrefix(e.rel, "/")
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if e.info.IsDir() {
+			continue
+		}
+		f, err := os.Open(e.file)
+		if err != nil {
+			return err
+		}
+		// Files growing while archived are cut at the size in the header.
+		_, err = io.CopyN(tw, &contextReader{ctx: ctx, r: f}, hdr.Size)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// exposeLease is the lifetime requested for port mappings, which are
+	// renewed halfway through and removed on shutdown.
+	exposeLease   = time.Hour
+	natpmpPort    = 5351
+	ssdpAddr      = "239.255.255.250:1900"
+	ssdpTimeout   = 2 * time.Second
+	upnpTimeout   = 5 * time.Second
+	upnpMaxLength = 1 << 20
+)
+
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// portMapper maps a TCP port of this host on the router.
+type portMapper interface {
+	// add maps port for lifetime, returning the public address.
+	add(ctx context.Context, port int, lifetime time.Duration) (net.IP, int, error)
+	remove(ctx context.Context, port int) error
+	String() string
+}
+
+// expose maps port on the local router with NAT-PMP or, failing that,
+// UPnP, logs the public URL and keeps the mapping alive until ctx is done.
+// The returned channel is closed once the mapping has been removed again.
+func expose(ctx context.Context, logger *log.Logger, port int) (<-chan struct{}, error) {
+	var errs []string
+	for _, discover := range []func(context.Context) (portMapper, error){discoverNATPMP, discoverUPnP} {
+		m, err := discover(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		ip, extPort, err := m.add(ctx, port, exposeLease)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", m, err))
+			continue
+		}
+		logger.Printf("WARNING: port %d is mapped by the %s, the files are reachable from the internet at http://%s\n",
+			port, m, net.JoinHostPort(ip.String(), strconv.Itoa(extPort)))
+		done := make(chan struct{})
+		go keepMapped(ctx, logger, m, port, done)
+		return done, nil
+	}
+	return nil, fmt.Errorf("no port mapping: %s", strings.Join(errs, "; "))
+}
+
+func keepMapped(ctx context.Context, logger *log.Logger, m portMapper, port int, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(exposeLease / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, _, err := m.add(ctx, port, exposeLease); err != nil {
+				logger.Println("Error renewing port mapping:", err)
+			}
+		case <-ctx.Done():
+			rctx, cancel := context.WithTimeout(context.Background(), upnpTimeout)
+			if err := m.remove(rctx, port); err != nil {
+				logger.Println("Error removing port mapping:", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// natpmp implements RFC 6886.
+type natpmp struct {
+	gateway net.IP
+}
+
+func discoverNATPMP(ctx context.Context) (portMapper, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return nil, fmt.Errorf("NAT-PMP: %s", err)
+	}
+	return &natpmp{gateway: gw}, nil
+}
+
+func (n *natpmp) String() string { return "NAT-PMP gateway " + n.gateway.String() }
+
+// call sends req to the gateway, retransmitting with doubling timeouts as
+// the RFC asks for, and returns a response of at least size bytes.
+func (n *natpmp) call(ctx context.Context, req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: n.gateway, Port: natpmpPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for i := 0; i < 4 && ctx.Err() == nil; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+		nr, err := conn.Read(buf)
+		if err != nil {
+			continue
+		}
+		if nr < size || buf[1] != req[1]+128 {
+			return nil, errors.New("malformed response")
+		}
+		if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+			return nil, fmt.Errorf("result code %d", code)
+		}
+		return buf[:nr], nil
+	}
+	return nil, errors.New("no response")
+}
+
+func (n *natpmp) add(ctx context.Context, port int, lifetime time.Duration) (net.IP, int, error) {
+	res, err := n.call(ctx, []byte{0, 0}, 12)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.IP(append([]byte(nil), res[8:12]...))
+	extPort, err := n.mapTCP(ctx, port, port, lifetime)
+	return ip, extPort, err
+}
+
+func (n *natpmp) remove(ctx context.Context, port int) error {
+	_, err := n.mapTCP(ctx, port, 0, 0)
+	return err
+}
+
+func (n *natpmp) mapTCP(ctx context.Context, port, extPort int, lifetime time.Duration) (int, error) {
+	req := make([]byte, 12)
+	req[1] = 2 // map TCP
+	binary.BigEndian.PutUint16(req[4:], uint16(port))
+	binary.BigEndian.PutUint16(req[6:], uint16(extPort))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	res, err := n.call(ctx, req, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(res[10:12])), nil
+}
+
+// defaultGateway reads the IPv4 default route from the kernel, which is
+// only exposed this way on Linux.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, errors.New("default gateway unknown")
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		// The address is in host byte order, little endian on all
+		// platforms gosfs is commonly run on.
+		return net.IPv4(b[3], b[2], b[1], b[0]), nil
+	}
+	return nil, errors.New("no default route")
+}
+
+// upnp talks to the WAN connection service of an Internet Gateway Device.
+type upnp struct {
+	controlURL string
+	service    string
+	localIP    string
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+func (d *upnpDevice) find(service string) string {
+	for _, s := range d.Services {
+		if s.ServiceType == service {
+			return s.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if u := d.Devices[i].find(service); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+func discoverUPnP(ctx context.Context) (portMapper, error) {
+	location, err := ssdpSearch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP: %s", err)
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, upnpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP: %s", err)
+	}
+	defer resp.Body.Close()
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, upnpMaxLength)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("UPnP: device description: %s", err)
+	}
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+	for _, service := range upnpServices {
+		control := root.Device.find(service)
+		if control == "" {
+			continue
+		}
+		ref, err := url.Parse(control)
+		if err != nil {
+			return nil, fmt.Errorf("UPnP: %s", err)
+		}
+		// The router needs our address on its side of the network.
+		conn, err := net.Dial("udp", base.Host)
+		if err != nil {
+			return nil, fmt.Errorf("UPnP: %s", err)
+		}
+		localIP := conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+		return &upnp{controlURL: base.ResolveReference(ref).String(), service: service, localIP: localIP}, nil
+	}
+	return nil, errors.New("UPnP: no WAN connection service")
+}
+
+// ssdpSearch returns the description URL of the first gateway answering.
+func ssdpSearch(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	for _, service := range upnpServices {
+		msg := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpAddr + "\r\nST: " + service +
+			"\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+		if _, err := conn.WriteTo([]byte(msg), dst); err != nil {
+			return "", err
+		}
+	}
+	deadline := time.Now().Add(ssdpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", errors.New("no gateway found")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+func (u *upnp) String() string { return "UPnP gateway " + u.controlURL }
+
+// soap invokes action with the given arguments, returning the response
+// arguments.
+func (u *upnp) soap(ctx context.Context, action string, args ...string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	ctx, cancel := context.WithTimeout(ctx, upnpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.service, action))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := soapArgs(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return out, fmt.Errorf("%s: error %s %s", action, out["errorCode"], out["errorDescription"])
+	}
+	return out, nil
+}
+
+// soapArgs collects the leaf elements of a SOAP message, which hold the
+// arguments of the action or, for faults, the UPnP error.
+func soapArgs(r io.Reader) (map[string]string, error) {
+	args := map[string]string{}
+	dec := xml.NewDecoder(io.LimitReader(r, upnpMaxLength))
+	var name string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return args, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if name != "" {
+				args[name] += string(t)
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
+
+func (u *upnp) add(ctx context.Context, port int, lifetime time.Duration) (net.IP, int, error) {
+	p := strconv.Itoa(port)
+	args := []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", p,
+		"NewProtocol", "TCP",
+		"NewInternalPort", p,
+		"NewInternalClient", u.localIP,
+		"NewEnabled", "1",
+		"NewPortMappingDescription", "gosfs",
+		"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second)),
+	}
+	out, err := u.soap(ctx, "AddPortMapping", args...)
+	if err != nil && out["errorCode"] == "725" {
+		// OnlyPermanentLeasesSupported, removed on shutdown all the same.
+		args[len(args)-1] = "0"
+		_, err = u.soap(ctx, "AddPortMapping", args...)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	out, err = u.soap(ctx, "GetExternalIPAddress")
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(out["NewExternalIPAddress"]))
+	if ip == nil {
+		return nil, 0, errors.New("gateway has no external address")
+	}
+	return ip, port, nil
+}
+
+func (u *upnp) remove(ctx context.Context, port int) error {
+	_, err := u.soap(ctx, "DeletePortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(port),
+		"NewProtocol", "TCP")
+	return err
+}
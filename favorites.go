@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// maxFavorites caps the files a single user can star.
+const maxFavorites = 1000
+
+// favoriteStore keeps the files and directories each user starred, by
+// share path. Clients which aren't authenticated share the favorites of
+// the empty user name.
+type favoriteStore struct {
+	store docStore
+
+	mu    sync.Mutex
+	users map[string][]string // by user, in the order starred
+}
+
+func loadFavorites(store docStore) (*favoriteStore, error) {
+	s := &favoriteStore{store: store, users: map[string][]string{}}
+	if _, err := store.load(favoritesDoc, &s.users); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *favoriteStore) list(user string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.users[user]...)
+}
+
+// starred returns the set of paths user starred.
+func (s *favoriteStore) starred(user string) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set := make(map[string]bool, len(s.users[user]))
+	for _, p := range s.users[user] {
+		set[p] = true
+	}
+	return set
+}
+
+// star adds p to or removes it from the favorites of user, reporting
+// whether the number of favorites would exceed the limit.
+func (s *favoriteStore) star(user, p string, on bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	favorites := []string{}
+	for _, f := range s.users[user] {
+		if f != p {
+			favorites = append(favorites, f)
+		}
+	}
+	if on {
+		if len(favorites) >= maxFavorites {
+			return false, nil
+		}
+		favorites = append(favorites, p)
+	}
+	if len(favorites) == 0 {
+		delete(s.users, user)
+	} else {
+		s.users[user] = favorites
+	}
+	return true, s.store.save(favoritesDoc, s.users)
+}
+
+// markStarred flags the files of a listing the client starred.
+func (c *controller) markStarred(r *http.Request, display string, files []File) {
+	starred := c.favoriteStore.starred(c.user(r))
+	for i := range files {
+		files[i].Starred = starred[display+files[i].Name]
+	}
+}
+
+// favorites lists the files the client starred (GET), or stars (PUT) or
+// unstars (DELETE) the one given by the path parameter.
+func (c *controller) favorites(w http.ResponseWriter, r *http.Request) {
+	if c.noListing || !c.readable(r) {
+		http.NotFound(w, r)
+		return
+	}
+	user := c.user(r)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodDelete:
+		rel, ok := c.entryParam(w, r)
+		if !ok {
+			return
+		}
+		if rel == "/" {
+			http.Error(w, "the root can't be starred", http.StatusBadRequest)
+			return
+		}
+		ok, err := c.favoriteStore.star(user, rel, r.Method == http.MethodPut)
+		if err != nil {
+			c.internalError(w, r, "Error saving favorites:", err)
+			return
+		}
+		if !ok {
+			http.Error(w, "too many favorites", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files := []File{}
+	for _, rel := range c.favoriteStore.list(user) {
+		// Favorites which were removed or hidden since are skipped rather
+		// than dropped, they may come back.
+		p := c.fsPath(rel)
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() != strings.HasSuffix(rel, "/") ||
+			c.isHidden(rel, info.IsDir()) || !c.allowed(p) {
+			continue
+		}
+		parent := path.Dir(strings.TrimSuffix(rel, "/"))
+		if parent != "/" {
+			parent += "/"
+		}
+		f := newFile(parent, c.atRest.plainInfo(info))
+		f.Name = strings.TrimPrefix(parent, "/") + f.Name
+		f.setMeta(c.meta.get(rel))
+		f.Starred = true
+		files = append(files, f)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r) {
+		c.writeJSON(w, r, struct {
+			Files []File `json:"files"`
+		}{files})
+		return
+	}
+	c.renderIndex(w, r, Dir{
+		DisplayPath: "/",
+		Breadcrumbs: breadcrumbs("/"),
+		View:        "Starred files",
+		Files:       files,
+		Page:        1,
+		Pages:       1,
+		Total:       len(files),
+	})
+}
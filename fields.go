@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadFieldsFileName is the per-directory file declaring the form fields
+// of uploads into the directory and the ones below it, one per line as
+// "name [label]", where a trailing ? makes the field optional. Blank lines
+// and # comments are skipped.
+const UploadFieldsFileName = ".gosfsfields"
+
+// uploadFieldHeader prefixes the headers carrying the fields of PUT
+// uploads, e.g. X-Gosfs-Field-Ticket.
+const uploadFieldHeader = "X-Gosfs-Field-"
+
+var validFieldName = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// checkFieldName refuses names which aren't valid or are taken by the
+// upload form.
+func checkFieldName(name string) error {
+	if !validFieldName.MatchString(name) || name == "files" || name == "paths" || name == "encryption" {
+		return fmt.Errorf("invalid upload field name %q, expected letters, digits, _ and -, other than files, paths and encryption", name)
+	}
+	return nil
+}
+
+// UploadField is a form field uploaders fill in, whose value is stored in
+// the metadata of the uploaded files and in the audit log.
+type UploadField struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Required bool   `json:"required"`
+}
+
+func parseUploadFields(sc *bufio.Scanner) ([]UploadField, error) {
+	var fields []UploadField
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, label, _ := strings.Cut(line, " ")
+		f := UploadField{Name: strings.ToLower(strings.TrimSuffix(name, "?")), Label: strings.TrimSpace(label)}
+		f.Required = !strings.HasSuffix(name, "?")
+		if err := checkFieldName(f.Name); err != nil {
+			return nil, err
+		}
+		if f.Label == "" {
+			f.Label = f.Name
+		}
+		fields = append(fields, f)
+	}
+	return fields, sc.Err()
+}
+
+type uploadFieldsEntry struct {
+	modTime time.Time
+	size    int64
+	fields  []UploadField
+}
+
+// uploadFieldsCache keeps parsed field files, reloading them when they
+// change.
+type uploadFieldsCache struct {
+	mu      sync.Mutex
+	entries map[string]uploadFieldsEntry
+}
+
+// load returns the fields declared in the given directory, and whether it
+// declares any.
+func (fc *uploadFieldsCache) load(dir string) ([]UploadField, bool) {
+	p := filepath.Join(dir, UploadFieldsFileName)
+	info, err := os.Stat(p)
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err != nil {
+		delete(fc.entries, p)
+		return nil, false
+	}
+	if e, ok := fc.entries[p]; ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.fields, true
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	fields, err := parseUploadFields(bufio.NewScanner(f))
+	if err != nil {
+		// Better to ask for nothing than to refuse every upload.
+		fields = nil
+	}
+	if fc.entries == nil {
+		fc.entries = map[string]uploadFieldsEntry{}
+	}
+	fc.entries[p] = uploadFieldsEntry{modTime: info.ModTime(), size: info.Size(), fields: fields}
+	return fields, true
+}
+
+// uploadFields returns the fields of uploads into the directory at the
+// share path display: those of its upload policy, overridden by the ones
+// of the nearest field file up the tree.
+func (c *controller) uploadFields(display string) []UploadField {
+	var fields []UploadField
+	for _, name := range c.uploadPolicies.lookup(display).fields {
+		fields = append(fields, UploadField{Name: name, Label: name, Required: true})
+	}
+	for dir := path.Clean("/" + display); ; dir = path.Dir(dir) {
+		if declared, ok := c.uploadFieldFiles.load(c.fsPath(dir)); ok {
+			for _, d := range declared {
+				fields = setUploadField(fields, d)
+			}
+			break
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	return fields
+}
+
+func hasUploadField(fields []UploadField, name string) bool {
+	for _, f := range fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func setUploadField(fields []UploadField, f UploadField) []UploadField {
+	for i := range fields {
+		if fields[i].Name == f.Name {
+			fields[i] = f
+			return fields
+		}
+	}
+	return append(fields, f)
+}
+
+// checkUploadFields returns the values of the given fields, or an error
+// naming the required ones which are missing or too long.
+func checkUploadFields(fields []UploadField, values map[string]string) (map[string]string, *APIError) {
+	var missing []string
+	checked := map[string]string{}
+	for _, f := range fields {
+		v := strings.TrimSpace(values[f.Name])
+		if len(v) > maxMetaValue || f.Required && v == "" {
+			missing = append(missing, f.Name)
+			continue
+		}
+		if v != "" {
+			checked[f.Name] = v
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, &APIError{
+			Code:    "missing_fields",
+			Message: fmt.Sprintf("the upload needs the fields %s, of at most %d bytes", strings.Join(missing, ", "), maxMetaValue),
+			Details: map[string]interface{}{"fields": missing},
+		}
+	}
+	return checked, nil
+}
+
+// headerFields returns the field values of a PUT upload.
+func headerFields(r *http.Request) map[string]string {
+	values := map[string]string{}
+	for k, v := range r.Header {
+		if len(v) > 0 && len(k) > len(uploadFieldHeader) && strings.EqualFold(k[:len(uploadFieldHeader)], uploadFieldHeader) {
+			values[strings.ToLower(k[len(uploadFieldHeader):])] = v[0]
+		}
+	}
+	return values
+}
+
+// storeUploadFields adds the field values to the metadata of the uploaded
+// file at the share path rel.
+func (c *controller) storeUploadFields(r *http.Request, rel string, values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	m := c.meta.get(rel)
+	vals := make(map[string]string, len(m.Values)+len(values))
+	for k, v := range m.Values {
+		vals[k] = v
+	}
+	for k, v := range values {
+		vals[k] = v
+	}
+	m.Values = vals
+	err := m.normalize()
+	if err == nil {
+		err = c.meta.set(rel, m)
+	}
+	if err != nil {
+		c.log(r).Printf("Error storing upload fields of %s: %v\n", rel, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFileCacheSize    = 32 << 20  // 32MiB
+	DefaultFileCacheMaxFile = 512 << 10 // 512KiB
+)
+
+type cachedFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+// fileCache is a size capped LRU cache of small file contents. Entries are
+// validated against the file's modification time and size on every lookup,
+// so a changed file is read again instead of served stale.
+type fileCache struct {
+	maxSize int64
+	maxFile int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newFileCache(maxSize, maxFile int64) *fileCache {
+	return &fileCache{
+		maxSize: maxSize,
+		maxFile: maxFile,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (fc *fileCache) get(p string, info fs.FileInfo) ([]byte, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	el, ok := fc.entries[p]
+	if !ok {
+		return nil, false
+	}
+	cf := el.Value.(*cachedFile)
+	if !cf.modTime.Equal(info.ModTime()) || cf.size != info.Size() {
+		fc.remove(el)
+		return nil, false
+	}
+	fc.lru.MoveToFront(el)
+	return cf.data, true
+}
+
+func (fc *fileCache) put(p string, info fs.FileInfo, data []byte) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if el, ok := fc.entries[p]; ok {
+		fc.remove(el)
+	}
+	fc.entries[p] = fc.lru.PushFront(&cachedFile{path: p, modTime: info.ModTime(), size: info.Size(), data: data})
+	fc.size += int64(len(data))
+	for fc.size > fc.maxSize {
+		fc.remove(fc.lru.Back())
+	}
+}
+
+// remove must be called with fc.mu held.
+func (fc *fileCache) remove(el *list.Element) {
+	cf := fc.lru.Remove(el).(*cachedFile)
+	delete(fc.entries, cf.path)
+	fc.size -= int64(len(cf.data))
+}
+
+// serveCached serves small files from memory, loading them into the cache
+// on a miss. It reports whether a response was written.
+func (c *controller) serveCached(w http.ResponseWriter, r *http.Request, p string, info fs.FileInfo) bool {
+	if c.fileCache == nil || info.Size() > c.fileCache.maxFile {
+		return false
+	}
+	data, ok := c.fileCache.get(p, info)
+	if !ok {
+		f, err := c.atRest.open(p)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		// Read at most one byte more than expected to notice concurrent growth.
+		data, err = io.ReadAll(io.LimitReader(f, info.Size()+1))
+		if err != nil || int64(len(data)) != info.Size() {
+			return false
+		}
+		c.fileCache.put(p, info, data)
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(data))
+	return true
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxUploadPathLength bounds the relative paths of files in folder uploads.
+const maxUploadPathLength = 4096
+
+// target resolves the file addressed by the URL path of a write request,
+// responding with an error if it may not be written.
+func (c *controller) target(w http.ResponseWriter, r *http.Request) (string, os.FileInfo, bool) {
+	p := c.fsPath(r.URL.Path)
+	info, _ := os.Stat(p)
+	if c.isHidden(r.URL.Path, info != nil && info.IsDir()) || !c.allowed(p) {
+		http.NotFound(w, r)
+		return "", nil, false
+	}
+	if p == filepath.Clean(c.rootDir) {
+		http.Error(w, "the root directory can't be changed", http.StatusForbidden)
+		return "", nil, false
+	}
+	return p, info, true
+}
+
+// formAction handles the forms posted to file URLs, which is only the
+// editor's.
+func (c *controller) formAction(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("edit") != "1" {
+		http.Error(w, "unknown form action, only edit=1 is supported", http.StatusBadRequest)
+		return
+	}
+	c.editFile(w, r)
+}
+
+func (c *controller) editFile(w http.ResponseWriter, r *http.Request) {
+	p, info, ok := c.target(w, r)
+	if !ok {
+		return
+	}
+	if info == nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	c.edit(w, r, p, c.atRest.plainInfo(info))
+}
+
+// put stores the request body as the file at the URL path, replacing an
+// existing one unless in drop box mode, where it gets a unique name, or the
+// upload policy says otherwise. The directory must exist. With edit=1, it
+// saves the file like the editor.
+func (c *controller) put(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("edit") == "1" {
+		c.editFile(w, r)
+		return
+	}
+	p, info, ok := c.target(w, r)
+	if !ok {
+		return
+	}
+	if info != nil && info.IsDir() || strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "can't upload to a directory", http.StatusConflict)
+		return
+	}
+	if parent, err := os.Stat(c.fsPath(path.Dir(r.URL.Path))); err != nil || !parent.IsDir() {
+		http.Error(w, "parent directory doesn't exist", http.StatusConflict)
+		return
+	}
+	// The parent may be in another union directory than the file.
+	if !c.makeParents(w, r, "", p) {
+		return
+	}
+	parent := path.Dir(r.URL.Path)
+	if parent != "/" {
+		parent += "/"
+	}
+	values, apiErr := checkUploadFields(c.uploadFields(parent), headerFields(r))
+	if apiErr != nil {
+		writeError(w, r, http.StatusBadRequest, *apiErr)
+		return
+	}
+	encryption := r.Header.Get(encryptionHeader)
+	if err := checkEncryption(encryption); err != nil {
+		http.Error(w, "invalid encryption metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy := c.uploadPolicy(r.URL.Path, c.settings.get().DropBox)
+	switch {
+	case !policy.allows(p):
+		http.Error(w, policy.typeError(p), http.StatusUnsupportedMediaType)
+		return
+	case info != nil && policy.collision == CollisionReject:
+		http.Error(w, "file exists", http.StatusConflict)
+		return
+	case r.ContentLength > policy.maxSize:
+		c.uploadTooLarge(w, r, uploadLimitError{LimitFileSize, policy.maxSize})
+		return
+	}
+	if !c.beginUpload(w) {
+		return
+	}
+	defer c.uploads.end()
+	done := c.trackUpload(w, r, r.URL.Path)
+	defer done()
+
+	src := &limitedFile{r: r.Body, max: policy.maxSize}
+	target, n, err := c.storeFile(r.Context(), src, p, policy.collision)
+	switch {
+	case src.exceeded:
+		c.uploadTooLarge(w, r, uploadLimitError{LimitFileSize, policy.maxSize})
+		return
+	case os.IsExist(err):
+		http.Error(w, "file exists", http.StatusConflict)
+		return
+	case errors.Is(err, errSpoolFull):
+		c.spoolFull(w, r)
+		return
+	case r.Context().Err() != nil:
+		c.log(r).Printf("Upload of %s aborted, the client went away\n", r.URL.Path)
+		return
+	case err != nil:
+		c.internalError(w, r, "Error storing uploaded file:", err)
+		return
+	}
+	c.log(r).Printf("Uploaded file: %s, file size: %d\n", target, n)
+	rel, err := c.relPath(target, false)
+	if err != nil {
+		c.internalError(w, r, "Error locating uploaded file:", err)
+		return
+	}
+	c.storeUploadFields(r, rel, values)
+	c.setEncryption(r, rel, encryption)
+	c.auditFields(w, r, ActionUpload, values, rel)
+	c.notify(r, WebhookEvent{Event: EventUpload, Path: rel, Size: n})
+	c.replicate(rel)
+	if info != nil && target == p {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", (&url.URL{Path: rel}).String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// remove deletes the file or empty directory at the URL path, if enabled.
+func (c *controller) remove(w http.ResponseWriter, r *http.Request) {
+	if !c.deleteEnabled || c.settings.get().DropBox {
+		http.Error(w, "deleting is disabled", http.StatusForbidden)
+		return
+	}
+	p, info, ok := c.target(w, r)
+	if !ok {
+		return
+	}
+	if info == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := c.journal.remove(p); err != nil {
+		if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			http.Error(w, "directory is not empty", http.StatusConflict)
+			return
+		}
+		c.log(r).Println("Error deleting file:", err)
+		http.Error(w, "unable to delete file", http.StatusInternalServerError)
+		return
+	}
+	rel, _ := c.relPath(p, info.IsDir())
+	c.log(r).Printf("Deleted %s\n", rel)
+	c.audit(w, r, ActionDelete, rel)
+	c.notify(r, WebhookEvent{Event: EventDelete, Path: rel})
+	if !info.IsDir() {
+		c.replicate(rel)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// move renames the file or directory at the URL path to the share path of
+// the Destination header, a path or URL as with WebDAV, if deleting is
+// enabled. Unlike with WebDAV, existing files are only replaced with
+// "Overwrite: T". The metadata of the files moves along.
+func (c *controller) move(w http.ResponseWriter, r *http.Request) {
+	if !c.deleteEnabled || c.settings.get().DropBox {
+		http.Error(w, "moving is disabled", http.StatusForbidden)
+		return
+	}
+	p, info, ok := c.target(w, r)
+	if !ok {
+		return
+	}
+	if info == nil {
+		http.NotFound(w, r)
+		return
+	}
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		http.Error(w, "missing or invalid Destination header", http.StatusBadRequest)
+		return
+	}
+	from, _ := c.relPath(p, info.IsDir())
+	to := path.Clean("/" + dest.Path)
+	if src := strings.TrimSuffix(from, "/"); to == src || strings.HasPrefix(to, src+"/") {
+		http.Error(w, "can't move a file onto itself or a directory into itself", http.StatusForbidden)
+		return
+	}
+	dst := c.fsPath(to)
+	existing, _ := os.Lstat(dst)
+	if to == "/" || c.isHidden(to, info.IsDir()) || !c.allowed(dst) {
+		http.Error(w, "the destination can't be written", http.StatusForbidden)
+		return
+	}
+	if parent, err := os.Stat(c.fsPath(path.Dir(to))); err != nil || !parent.IsDir() {
+		http.Error(w, "parent directory doesn't exist", http.StatusConflict)
+		return
+	}
+	if policy := c.uploadPolicy(to, false); !info.IsDir() && !policy.allows(dst) {
+		http.Error(w, policy.typeError(dst), http.StatusUnsupportedMediaType)
+		return
+	}
+	switch {
+	case existing != nil && existing.IsDir():
+		http.Error(w, "the destination is a directory", http.StatusConflict)
+		return
+	case existing != nil && r.Header.Get("Overwrite") != "T":
+		http.Error(w, "the destination exists", http.StatusPreconditionFailed)
+		return
+	}
+	// The parent may be in another union directory than the destination.
+	if !c.makeParents(w, r, "", dst) {
+		return
+	}
+	if err := c.journal.rename(p, dst); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			http.Error(w, "can't move between file systems", http.StatusConflict)
+			return
+		}
+		c.log(r).Println("Error moving file:", err)
+		http.Error(w, "unable to move file", http.StatusInternalServerError)
+		return
+	}
+	to, _ = c.relPath(dst, info.IsDir())
+	c.log(r).Printf("Moved %s to %s\n", from, to)
+	if err := c.meta.move(from, to); err != nil {
+		c.log(r).Printf("Error moving metadata of %s: %v\n", from, err)
+	}
+	c.audit(w, r, ActionMove, from, to)
+	c.notify(r, WebhookEvent{Event: EventMove, Path: from, To: to})
+	// Replicas follow file by file, the old ones are removed.
+	filepath.WalkDir(dst, func(file string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			rel, _ := c.relPath(file, false)
+			c.replicate(strings.TrimSuffix(from, "/") + strings.TrimPrefix(rel, strings.TrimSuffix(to, "/")))
+			c.replicate(rel)
+		}
+		return nil
+	})
+	w.Header().Set("Location", (&url.URL{Path: to}).String())
+	if existing != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// uploadName returns the path, relative to the upload directory, of the
+// file in part. Folder uploads give it in a paths field preceding the file,
+// or as the file name itself, which browsers fill with the relative path
+// of files in directories. Paths can't climb out of the upload directory.
+func uploadName(part *multipart.Part, explicit string) (string, error) {
+	name := explicit
+	if name == "" {
+		name = part.FileName()
+		if _, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition")); err == nil &&
+			strings.Contains(params["filename"], "/") {
+			name = params["filename"]
+		}
+	}
+	if strings.Contains(name, "\\") {
+		return "", fmt.Errorf("invalid upload path %q, expected slashes", name)
+	}
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return "", fmt.Errorf("invalid upload path %q", explicit)
+	}
+	return name, nil
+}
+
+// makeParents creates the missing directories between dir and the file at
+// target, responding with an error if that fails.
+func (c *controller) makeParents(w http.ResponseWriter, r *http.Request, dir, target string) bool {
+	parent := filepath.Dir(target)
+	if parent == dir {
+		return true
+	}
+	if _, err := os.Stat(parent); !os.IsNotExist(err) {
+		return true
+	}
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		c.log(r).Println("Error creating directory:", err)
+		http.Error(w, "unable to create directory", http.StatusInternalServerError)
+		return false
+	}
+	if rel, err := c.relPath(parent, true); err == nil {
+		c.audit(w, r, ActionMkdir, rel)
+	}
+	return true
+}
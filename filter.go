@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filterParams are the query parameters understood by listFilter.
+var filterParams = []string{"filter", "ext", "kind", "min-size", "max-size", "after", "before", "tag", "meta"}
+
+// listFilter narrows down directory listings. Zero values disable the
+// corresponding check.
+type listFilter struct {
+	Glob    string
+	Exts    []string
+	Kinds   []string // see fileKind
+	MinSize int64
+	MaxSize int64
+	After   time.Time
+	Before  time.Time
+	// Tags and Meta must all be attached to an entry, see Metadata.
+	Tags []string
+	Meta map[string]string
+}
+
+func parseListFilter(q url.Values) (listFilter, error) {
+	var (
+		f   listFilter
+		err error
+	)
+	if f.Glob = q.Get("filter"); f.Glob != "" {
+		if _, err = path.Match(f.Glob, ""); err != nil {
+			return f, fmt.Errorf("invalid filter %q: %w", f.Glob, err)
+		}
+	}
+	for _, ext := range strings.Split(q.Get("ext"), ",") {
+		if ext = strings.TrimPrefix(strings.TrimSpace(ext), "."); ext != "" {
+			f.Exts = append(f.Exts, "."+strings.ToLower(ext))
+		}
+	}
+	for _, kind := range strings.Split(q.Get("kind"), ",") {
+		if kind = strings.ToLower(strings.TrimSpace(kind)); kind == "" {
+			continue
+		}
+		if !containsString(kinds, kind) {
+			return f, fmt.Errorf("invalid kind %q", kind)
+		}
+		f.Kinds = append(f.Kinds, kind)
+	}
+	if f.MinSize, err = parseSize(q.Get("min-size")); err != nil {
+		return f, err
+	}
+	if f.MaxSize, err = parseSize(q.Get("max-size")); err != nil {
+		return f, err
+	}
+	if f.After, err = parseDate(q.Get("after")); err != nil {
+		return f, err
+	}
+	if f.Before, err = parseDate(q.Get("before")); err != nil {
+		return f, err
+	}
+	for _, tag := range strings.Split(q.Get("tag"), ",") {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			f.Tags = append(f.Tags, tag)
+		}
+	}
+	for _, kv := range strings.Split(q.Get("meta"), ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return f, fmt.Errorf("invalid meta filter %q, expected key=value", kv)
+		}
+		if f.Meta == nil {
+			f.Meta = map[string]string{}
+		}
+		f.Meta[pair[0]] = pair[1]
+	}
+	return f, nil
+}
+
+// fileOnly reports whether the filter uses criteria which only make sense
+// for regular files, in which case directories are hidden.
+func (f listFilter) fileOnly() bool {
+	return len(f.Exts) > 0 || f.MinSize > 0 || f.MaxSize > 0
+}
+
+// needsInfo reports whether the filter checks details which require
+// stat'ing every entry.
+func (f listFilter) needsInfo() bool {
+	return f.MinSize > 0 || f.MaxSize > 0 || !f.After.IsZero() || !f.Before.IsZero()
+}
+
+// needsMeta reports whether the filter checks the metadata of entries.
+func (f listFilter) needsMeta() bool {
+	return len(f.Tags) > 0 || len(f.Meta) > 0
+}
+
+// matchName applies the checks which only need the name of an entry.
+func (f listFilter) matchName(name string, isDir bool) bool {
+	if isDir && f.fileOnly() {
+		return false
+	}
+	if f.Glob != "" {
+		if ok, _ := path.Match(f.Glob, name); !ok {
+			return false
+		}
+	}
+	if len(f.Kinds) > 0 && !containsString(f.Kinds, fileKind(name, isDir)) {
+		return false
+	}
+	if len(f.Exts) > 0 {
+		ext, ok := strings.ToLower(path.Ext(name)), false
+		for _, e := range f.Exts {
+			if e == ext {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchInfo applies the size and modification time checks.
+func (f listFilter) matchInfo(info fs.FileInfo) bool {
+	if f.MinSize > 0 && info.Size() < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return false
+	}
+	if !f.After.IsZero() && info.ModTime().Before(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !info.ModTime().Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+// parseSize parses human friendly sizes such as 512, 10k, 1M, 2GiB or 1.5GB.
+// Both decimal and binary suffixes are treated as powers of 1024.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	num := strings.TrimRightFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	unit := strings.ToUpper(strings.TrimSpace(s[len(num):]))
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	i := strings.Index("KMGTPE", unit)
+	switch {
+	case unit == "":
+	case len(unit) == 1 && i >= 0:
+		n *= float64(int64(1) << (10 * uint(i+1)))
+	default:
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	return int64(n), nil
+}
+
+// parseDate accepts either a plain date or a full RFC 3339 timestamp.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
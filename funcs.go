@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// templateFuncs are the functions of the listing template, which custom
+// templates (-index-template) can build different UIs with.
+//
+//	ago t            relative time, e.g. "5 minutes ago"
+//	bytes n          size in units, e.g. "1.2 MB"
+//	date layout t    t formatted with the Go layout
+//	mime name        media type by the extension of name
+//	kind name        kind of the file, see kinds; directories end with /
+//	kinds            all kinds
+//	icon kind        URL of the icon of a kind
+//	url link         absolute URL of a link, see -external-url
+//	action a link    URL of action a on the file at link: download, view,
+//	                 play, edit, thumb, qr, torrent or zip
+func (c *controller) templateFuncs(r *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"ago":   func(t time.Time) string { return ago(time.Since(t)) },
+		"bytes": formatBytes,
+		"date":  func(layout string, t time.Time) string { return t.Format(layout) },
+		"mime":  func(name string) string { return mime.TypeByExtension(path.Ext(name)) },
+		"kind":  func(name string) string { return fileKind(name, strings.HasSuffix(name, "/")) },
+		"kinds": func() []string { return kinds },
+		"icon":  func(kind string) string { return "/icons/" + kind + ".svg" },
+		"url":   func(link string) string { return c.urls.link(r, link) },
+		"action": func(action, link string) (string, error) {
+			return fileAction(c.urls.link(r, link), action, link)
+		},
+	}
+}
+
+// fileAction returns the URL of an action on the file at link, whose
+// absolute URL is abs.
+func fileAction(abs, action, link string) (string, error) {
+	switch action {
+	case "download":
+		return link, nil
+	case "view", "play", "edit", "torrent":
+		return link + "?" + action + "=1", nil
+	case "zip":
+		return link + "?archive=zip", nil
+	case "thumb":
+		return "/thumb" + link, nil
+	case "qr":
+		return "/qr?target=" + url.QueryEscape(abs), nil
+	}
+	return "", fmt.Errorf("unknown action %q", action)
+}
+
+// ago humanizes the duration d in the past.
+func ago(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return "1 " + unit + " ago"
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int64(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return plural(int64(d/time.Hour), "hour")
+	case d < 30*24*time.Hour:
+		return plural(int64(d/(24*time.Hour)), "day")
+	case d < 365*24*time.Hour:
+		return plural(int64(d/(30*24*time.Hour)), "month")
+	}
+	return plural(int64(d/(365*24*time.Hour)), "year")
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultGetSegments   = 4
+	DefaultGetSegmentMin = 64 << 20 // 64MiB
+	DefaultGetRetries    = 8
+	// getBackoff is the first wait before retrying, doubled up to
+	// getBackoffMax with every failed attempt.
+	getBackoff    = 500 * time.Millisecond
+	getBackoffMax = 30 * time.Second
+	// getStallTimeout cancels responses which stop sending data.
+	getStallTimeout = 60 * time.Second
+	// getSaveEvery is the number of bytes downloaded between saves of the
+	// progress.
+	getSaveEvery = 4 << 20
+)
+
+var errRemoteChanged = errors.New("the file changed on the server")
+
+// getSegment is a byte range of a download, up to End exclusive or to the
+// end of the file if End is -1, of which Done bytes are written.
+type getSegment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+func (s *getSegment) complete() bool {
+	return s.End >= 0 && s.Start+s.Done >= s.End
+}
+
+// getState is the progress of a download, kept next to the partial file in
+// <file>.part.json, so that an interrupted download continues where it
+// stopped as long as the file on the server is the same.
+type getState struct {
+	URL          string        `json:"url"`
+	Size         int64         `json:"size"`
+	ETag         string        `json:"etag,omitempty"`
+	LastModified string        `json:"last_modified,omitempty"`
+	Segments     []*getSegment `json:"segments"`
+}
+
+// getter downloads files for "gosfs get".
+type getter struct {
+	client     *http.Client
+	token      string
+	segments   int
+	segmentMin int64
+	retries    int
+	verify     bool
+}
+
+// request makes a request for rawURL which asks for the digest of the
+// file, and its unencoded content so that the digest applies.
+func (g *getter) request(ctx context.Context, method, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Want-Repr-Digest", "sha-256=10")
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	return req, nil
+}
+
+// retryable reports whether a failed attempt is worth repeating, and how
+// long the server asked to wait.
+func retryable(resp *http.Response, err error) (bool, time.Duration) {
+	if err != nil {
+		return true, 0
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		wait, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return true, time.Duration(wait) * time.Second
+	}
+	return false, 0
+}
+
+// backoff waits before attempt n, at least min, unless ctx is done first.
+func backoff(ctx context.Context, n int, min time.Duration) error {
+	d := getBackoff << n
+	if d > getBackoffMax || d <= 0 {
+		d = getBackoffMax
+	}
+	// Jitter keeps the segments of a download from retrying in lockstep.
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	if d < min {
+		d = min
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// probe fetches the headers of the file at rawURL.
+func (g *getter) probe(ctx context.Context, rawURL string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := g.request(ctx, http.MethodHead, rawURL)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := g.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if retry, wait := retryable(resp, err); retry && attempt < g.retries && ctx.Err() == nil {
+			if err := backoff(ctx, attempt, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// download saves the file at rawURL to out, resuming an earlier attempt
+// if there is one, and verifies it against the digest the server sent.
+func (g *getter) download(ctx context.Context, rawURL, out string) (int64, bool, error) {
+	head, err := g.probe(ctx, rawURL)
+	if err != nil {
+		return 0, false, err
+	}
+	state := &getState{
+		URL:          rawURL,
+		Size:         head.ContentLength,
+		ETag:         head.Header.Get("ETag"),
+		LastModified: head.Header.Get("Last-Modified"),
+	}
+	part, stateFile := out+".part", out+".part.json"
+	if old, err := loadGetState(stateFile); err == nil && old.URL == state.URL && old.Size == state.Size &&
+		old.ETag == state.ETag && old.LastModified == state.LastModified {
+		if _, err := os.Stat(part); err == nil {
+			state = old
+		}
+	}
+	ranges := head.Header.Get("Accept-Ranges") == "bytes" && state.Size > 0
+	if state.Segments == nil {
+		state.Segments = splitSegments(state.Size, ranges, g.segments, g.segmentMin)
+		os.Remove(part)
+	}
+
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, false, err
+	}
+	d := &getDownload{getter: g, url: rawURL, state: state, stateFile: stateFile, file: f, ranges: ranges}
+	err = d.run(ctx)
+	if err != nil && !errors.Is(err, errRemoteChanged) {
+		d.save()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, errRemoteChanged) {
+		// Start over, the parts downloaded so far don't fit together.
+		os.Remove(part)
+		os.Remove(stateFile)
+		return g.download(ctx, rawURL, out)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	verified := false
+	if want, ok := parseDigest(head.Header.Get("Repr-Digest")); ok && g.verify {
+		sum, err := fileSHA256(part)
+		if err != nil {
+			return 0, false, err
+		}
+		if string(sum) != string(want) {
+			os.Remove(part)
+			os.Remove(stateFile)
+			return 0, false, errors.New("checksum mismatch, the download was discarded")
+		}
+		verified = true
+	}
+	info, err := os.Stat(part)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := os.Rename(part, out); err != nil {
+		return 0, false, err
+	}
+	os.Remove(stateFile)
+	return info.Size(), verified, nil
+}
+
+// splitSegments divides a file of size bytes into n segments if it can be
+// requested in ranges and is large enough.
+func splitSegments(size int64, ranges bool, n int, min int64) []*getSegment {
+	if size < 0 {
+		return []*getSegment{{End: -1}}
+	}
+	if !ranges || size < min || n < 2 {
+		return []*getSegment{{End: size}}
+	}
+	var segs []*getSegment
+	step := (size + int64(n) - 1) / int64(n)
+	for start := int64(0); start < size; start += step {
+		end := start + step
+		if end > size {
+			end = size
+		}
+		segs = append(segs, &getSegment{Start: start, End: end})
+	}
+	return segs
+}
+
+// getDownload is a download in progress, whose segments are fetched in
+// parallel.
+type getDownload struct {
+	*getter
+	url       string
+	stateFile string
+	file      *os.File
+	ranges    bool
+
+	mu      sync.Mutex // of state and unsaved
+	state   *getState
+	unsaved int64
+}
+
+func (d *getDownload) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(d.state.Segments))
+	for _, seg := range d.state.Segments {
+		go func(seg *getSegment) {
+			err := d.fetch(ctx, seg)
+			if err != nil {
+				// One failed segment fails the download.
+				cancel()
+			}
+			errs <- err
+		}(seg)
+	}
+	var first error
+	for range d.state.Segments {
+		if err := <-errs; err != nil && (first == nil || errors.Is(first, context.Canceled)) {
+			first = err
+		}
+	}
+	return first
+}
+
+// fetch downloads the rest of seg, retrying with backoff.
+func (d *getDownload) fetch(ctx context.Context, seg *getSegment) error {
+	failures := 0
+	for !seg.complete() {
+		progressed, err := d.attempt(ctx, seg)
+		if err == nil && seg.End < 0 {
+			// The whole file of unknown size arrived.
+			return nil
+		}
+		if err == nil {
+			continue
+		}
+		var status *getStatusError
+		if errors.As(err, &status) && !status.retry || errors.Is(err, errRemoteChanged) || ctx.Err() != nil {
+			return err
+		}
+		if progressed {
+			failures = 0
+		}
+		if failures >= d.retries {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v, retrying\n", d.url, err)
+		wait := time.Duration(0)
+		if status != nil {
+			wait = status.wait
+		}
+		if err := backoff(ctx, failures, wait); err != nil {
+			return err
+		}
+		failures++
+	}
+	return nil
+}
+
+type getStatusError struct {
+	status string
+	retry  bool
+	wait   time.Duration
+}
+
+func (e *getStatusError) Error() string {
+	return e.status
+}
+
+// attempt requests the rest of seg once and writes what arrives. It
+// reports whether any data was written.
+func (d *getDownload) attempt(ctx context.Context, seg *getSegment) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := d.request(ctx, http.MethodGet, d.url)
+	if err != nil {
+		return false, err
+	}
+	offset := seg.Start + seg.Done
+	ranged := d.ranges && (offset > 0 || seg.End >= 0 && seg.End < d.state.Size)
+	if ranged {
+		if seg.End >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, seg.End-1))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		// A changed file is sent whole instead of the range.
+		if d.state.ETag != "" && !strings.HasPrefix(d.state.ETag, "W/") {
+			req.Header.Set("If-Range", d.state.ETag)
+		} else if d.state.LastModified != "" {
+			req.Header.Set("If-Range", d.state.LastModified)
+		}
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case ranged && resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && (!ranged || len(d.state.Segments) == 1):
+		if ranged || seg.Done > 0 {
+			if len(d.state.Segments) > 1 || resp.Header.Get("ETag") != d.state.ETag {
+				return false, errRemoteChanged
+			}
+			// No ranges after all, start over.
+			if err := d.file.Truncate(0); err != nil {
+				return false, err
+			}
+			d.mu.Lock()
+			seg.Done = 0
+			d.mu.Unlock()
+		}
+	case resp.StatusCode == http.StatusOK:
+		return false, errRemoteChanged
+	default:
+		retry, wait := retryable(resp, nil)
+		return false, &getStatusError{status: resp.Status, retry: retry, wait: wait}
+	}
+
+	stall := time.AfterFunc(getStallTimeout, cancel)
+	defer stall.Stop()
+	buf := make([]byte, 256<<10)
+	progressed := false
+	for {
+		if seg.complete() {
+			return progressed, nil
+		}
+		limit := int64(len(buf))
+		if seg.End >= 0 && seg.End-(seg.Start+seg.Done) < limit {
+			limit = seg.End - (seg.Start + seg.Done)
+		}
+		n, err := resp.Body.Read(buf[:limit])
+		stall.Reset(getStallTimeout)
+		if n > 0 {
+			if _, werr := d.file.WriteAt(buf[:n], seg.Start+seg.Done); werr != nil {
+				return progressed, werr
+			}
+			progressed = true
+			d.advance(seg, int64(n))
+		}
+		if err == io.EOF {
+			if seg.End >= 0 && !seg.complete() {
+				return progressed, io.ErrUnexpectedEOF
+			}
+			return progressed, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil && !stall.Stop() {
+				return progressed, fmt.Errorf("no data for %s", getStallTimeout)
+			}
+			return progressed, err
+		}
+	}
+}
+
+// advance records n more bytes of seg as written, saving the progress
+// every getSaveEvery bytes.
+func (d *getDownload) advance(seg *getSegment, n int64) {
+	d.mu.Lock()
+	seg.Done += n
+	d.unsaved += n
+	save := d.unsaved >= getSaveEvery
+	d.mu.Unlock()
+	if save {
+		d.save()
+	}
+}
+
+// save writes the progress, after the data it covers was written.
+func (d *getDownload) save() {
+	d.mu.Lock()
+	d.unsaved = 0
+	b, err := json.Marshal(d.state)
+	d.mu.Unlock()
+	if err != nil {
+		return
+	}
+	if d.file.Sync() != nil {
+		return
+	}
+	tmp := d.stateFile + ".tmp"
+	if os.WriteFile(tmp, b, 0o644) == nil {
+		os.Rename(tmp, d.stateFile)
+	}
+}
+
+func loadGetState(p string) (*getState, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var s getState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// parseDigest returns the SHA-256 digest in a Repr-Digest header.
+func parseDigest(h string) ([]byte, bool) {
+	for _, d := range strings.Split(h, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(d), "=")
+		if !ok || !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err == nil && len(sum) == sha256.Size {
+			return sum, true
+		}
+	}
+	return nil, false
+}
+
+func fileSHA256(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// getCommand implements "gosfs get", which downloads files robustly:
+// interrupted downloads resume with range requests, large files are
+// fetched in parallel segments, failures are retried with backoff and
+// complete files are verified against the server's digest.
+func getCommand(args []string) {
+	set := flag.NewFlagSet("get", flag.ExitOnError)
+	output := set.String("o", "", "file to save to, only with a single URL (default the name in the URL)")
+	token := set.String("token", os.Getenv("GOSFS_TOKEN"), "API token sent as bearer token (default $GOSFS_TOKEN)")
+	segments := set.Int("segments", DefaultGetSegments, "number of parallel range requests for large files")
+	segmentMin := set.Int64("segment-min-size", DefaultGetSegmentMin, "min size of files downloaded in parallel segments (byte)")
+	retries := set.Int("retries", DefaultGetRetries, "attempts after failures without progress before giving up")
+	noVerify := set.Bool("no-verify", false, "skip checking downloads against the server's SHA-256 digest")
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: %s get [flags] url...\n", os.Args[0])
+		set.PrintDefaults()
+	}
+	set.Parse(args)
+	if set.NArg() == 0 || (*output != "" && set.NArg() > 1) {
+		set.Usage()
+		os.Exit(2)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = getStallTimeout
+	g := &getter{
+		client:     &http.Client{Transport: transport},
+		token:      *token,
+		segments:   *segments,
+		segmentMin: *segmentMin,
+		retries:    *retries,
+		verify:     !*noVerify,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	failed := false
+	for _, rawURL := range set.Args() {
+		out := *output
+		if out == "" {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", rawURL, err)
+				failed = true
+				continue
+			}
+			if out = path.Base(u.Path); out == "/" || out == "." {
+				out = "index.html"
+			}
+		}
+		n, verified, err := g.download(ctx, rawURL, out)
+		switch {
+		case ctx.Err() != nil:
+			fmt.Fprintf(os.Stderr, "%s: interrupted, run the command again to resume\n", rawURL)
+			os.Exit(1)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rawURL, err)
+			failed = true
+		case verified:
+			fmt.Fprintf(os.Stderr, "%s: saved %s to %s, sha-256 verified\n", rawURL, formatBytes(n), out)
+		default:
+			fmt.Fprintf(os.Stderr, "%s: saved %s to %s\n", rawURL, formatBytes(n), out)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
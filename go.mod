@@ -1,3 +1,3 @@
 module github.com/ntk148v/gosfs
 
-go 1.17
+go 1.24
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+const DefaultExclude = "Thumbs.db,desktop.ini"
+
+// hideRules decides which entries are invisible to clients. Hidden entries
+// are neither listed, searched nor served.
+type hideRules struct {
+	dotfiles bool
+	patterns []string
+}
+
+func newHideRules(dotfiles bool, exclude string) (hideRules, error) {
+	h := hideRules{dotfiles: dotfiles}
+	for _, p := range strings.Split(exclude, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return h, err
+		}
+		h.patterns = append(h.patterns, p)
+	}
+	return h, nil
+}
+
+// hidesName reports whether a single path component is hidden.
+func (h hideRules) hidesName(name string) bool {
+	if h.dotfiles && strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, p := range h.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hides reports whether any component of the slash separated path p is
+// hidden, so that files inside hidden directories are hidden as well.
+func (h hideRules) hides(p string) bool {
+	for _, name := range strings.Split(p, "/") {
+		if name != "" && h.hidesName(name) {
+			return true
+		}
+	}
+	return false
+}
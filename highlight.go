@@ -0,0 +1,200 @@
+package main
+
+import (
+	"html"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// language describes just enough of a syntax to highlight it.
+type language struct {
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string
+	keywords      map[string]bool
+	ignoreCase    bool
+}
+
+func words(s string) map[string]bool {
+	m := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var (
+	cLike = language{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'`",
+	}
+	scriptLike = language{
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+	languages = map[string]language{}
+)
+
+func init() {
+	def := func(l language, kw string, exts ...string) {
+		l.keywords = words(kw)
+		for _, ext := range exts {
+			languages[ext] = l
+		}
+	}
+	def(cLike, `break case chan const continue default defer else fallthrough for func go goto if
+		import interface map package range return select struct switch type var nil true false`, ".go")
+	def(cLike, `break case catch class const continue debugger default delete do else export extends
+		finally for function if import in instanceof let new return super switch this throw try typeof
+		var void while with yield async await null undefined true false interface type enum`,
+		".js", ".mjs", ".ts", ".tsx", ".jsx")
+	def(cLike, `auto break case char const continue default do double else enum extern float for goto
+		if inline int long register return short signed sizeof static struct switch typedef union
+		unsigned void volatile while class namespace template typename public private protected
+		virtual new delete this true false nullptr bool`, ".c", ".h", ".cc", ".cpp", ".hpp")
+	def(cLike, `abstract boolean break byte case catch char class const continue default do double
+		else enum extends final finally float for if implements import instanceof int interface long
+		new package private protected public return short static super switch this throw throws try
+		void while true false null val var fun when object`, ".java", ".kt", ".scala", ".cs")
+	def(cLike, `as break const continue crate else enum extern false fn for if impl in let loop match
+		mod move mut pub ref return self Self static struct super trait true type unsafe use where
+		while async await dyn`, ".rs")
+	def(scriptLike, `and as assert async await break class continue def del elif else except finally
+		for from global if import in is lambda nonlocal not or pass raise return try while with yield
+		None True False`, ".py")
+	def(scriptLike, `if then else elif fi for while until do done case esac function in return local
+		export exit`, ".sh", ".bash", ".zsh")
+	def(scriptLike, `begin end def class module if elsif else unless while until for in do return
+		yield nil true false self require`, ".rb")
+	def(scriptLike, `true false null yes no`, ".yaml", ".yml", ".toml", ".ini", ".conf", ".cfg")
+	def(language{quotes: "\""}, `true false null`, ".json")
+	def(language{lineComments: []string{"--"}, quotes: "'\"", ignoreCase: true}, `select from where insert into values
+		update set delete create table drop alter index join left right inner outer on group by
+		order having limit and or not null as distinct union`, ".sql")
+	def(language{blockComments: [][2]string{{"<!--", "-->"}}, quotes: "\""}, "", ".html", ".htm", ".xml", ".svg")
+}
+
+// textExts are plain text formats which are previewable without highlighting.
+var textExts = words(".txt .log .md .csv .tsv .diff .patch .env .properties .gitignore")
+
+// previewable guesses from the name whether a file is worth previewing.
+func previewable(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	_, ok := languages[ext]
+	return ok || textExts[ext]
+}
+
+// highlight tokenizes src for the language of name and returns the HTML of
+// every source line, with spans closed at line ends so that each line can
+// be rendered in its own table row.
+func highlight(name, src string) []string {
+	lang, ok := languages[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return splitLines(html.EscapeString(src))
+	}
+	var (
+		b strings.Builder
+		i int
+	)
+	emit := func(class, text string) {
+		if class == "" {
+			b.WriteString(html.EscapeString(text))
+			return
+		}
+		// Re-open the span on each line of multi-line tokens.
+		b.WriteString(`<span class="` + class + `">`)
+		b.WriteString(strings.ReplaceAll(html.EscapeString(text), "\n",
+			"</span>\n"+`<span class="`+class+`">`))
+		b.WriteString("</span>")
+	}
+	keyword := func(w string) bool {
+		if lang.ignoreCase {
+			w = strings.ToLower(w)
+		}
+		return lang.keywords[w]
+	}
+scan:
+	for i < len(src) {
+		rest := src[i:]
+		for _, lc := range lang.lineComments {
+			if strings.HasPrefix(rest, lc) {
+				end := strings.IndexByte(rest, '\n')
+				if end < 0 {
+					end = len(rest)
+				}
+				emit("comment", rest[:end])
+				i += end
+				continue scan
+			}
+		}
+		for _, bc := range lang.blockComments {
+			if strings.HasPrefix(rest, bc[0]) {
+				end := strings.Index(rest[len(bc[0]):], bc[1])
+				if end < 0 {
+					end = len(rest)
+				} else {
+					end += len(bc[0]) + len(bc[1])
+				}
+				emit("comment", rest[:end])
+				i += end
+				continue scan
+			}
+		}
+		ch := rest[0]
+		r, size := utf8.DecodeRuneInString(rest)
+		switch {
+		case strings.IndexByte(lang.quotes, ch) >= 0:
+			end := 1
+			for end < len(rest) && rest[end] != ch {
+				if rest[end] == '\\' && ch != '`' {
+					end++
+				} else if rest[end] == '\n' && ch != '`' {
+					break
+				}
+				end++
+			}
+			if end < len(rest) && rest[end] == ch {
+				end++
+			}
+			if end > len(rest) {
+				end = len(rest)
+			}
+			emit("string", rest[:end])
+			i += end
+		case ch >= '0' && ch <= '9':
+			end := strings.IndexFunc(rest, func(r rune) bool {
+				return !unicode.IsDigit(r) && !unicode.IsLetter(r) && r != '.' && r != '_'
+			})
+			if end < 0 {
+				end = len(rest)
+			}
+			emit("number", rest[:end])
+			i += end
+		case r == '_' || unicode.IsLetter(r):
+			end := strings.IndexFunc(rest, func(r rune) bool {
+				return !unicode.IsDigit(r) && !unicode.IsLetter(r) && r != '_'
+			})
+			if end < 0 {
+				end = len(rest)
+			}
+			if keyword(rest[:end]) {
+				emit("keyword", rest[:end])
+			} else {
+				emit("", rest[:end])
+			}
+			i += end
+		default:
+			emit("", rest[:size])
+			i += size
+		}
+	}
+	return splitLines(b.String())
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.Split(s, "\n")
+}
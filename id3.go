@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// Tags holds the interesting bits of an ID3 tag.
+type Tags struct {
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+}
+
+const maxID3Size = 1 << 20
+
+// readTags extracts tags from the ID3v2 header of the file, falling back to
+// an ID3v1 trailer. Missing or broken tags simply yield empty values.
+func (c *controller) readTags(p string) Tags {
+	f, err := c.atRest.open(p)
+	if err != nil {
+		return Tags{}
+	}
+	defer f.Close()
+	if t, ok := readID3v2(f); ok {
+		return t
+	}
+	return readID3v1(f)
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func readID3v2(f io.ReadSeeker) (Tags, bool) {
+	var t Tags
+	hdr := make([]byte, 10)
+	if _, err := io.ReadFull(f, hdr); err != nil || string(hdr[:3]) != "ID3" {
+		return t, false
+	}
+	version := hdr[3]
+	size := syncsafe(hdr[6:])
+	if version < 3 || version > 4 || size > maxID3Size {
+		return t, false
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(f, body); err != nil {
+		return t, false
+	}
+	if hdr[5]&0x40 != 0 && len(body) >= 4 {
+		// Skip the extended header.
+		ext := int(binary.BigEndian.Uint32(body))
+		if version == 4 {
+			ext = syncsafe(body)
+		} else {
+			ext += 4
+		}
+		if ext > len(body) {
+			return t, false
+		}
+		body = body[ext:]
+	}
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		n := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			n = syncsafe(body[4:8])
+		}
+		if n > len(body)-10 {
+			break
+		}
+		data := body[10 : 10+n]
+		switch id {
+		case "TIT2":
+			t.Title = decodeText(data)
+		case "TPE1":
+			t.Artist = decodeText(data)
+		case "TALB":
+			t.Album = decodeText(data)
+		}
+		body = body[10+n:]
+	}
+	return t, t != Tags{}
+}
+
+// decodeText decodes an ID3v2 text frame, the first byte selects the
+// encoding.
+func decodeText(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	enc, b := b[0], b[1:]
+	var s string
+	switch enc {
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if enc == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			if (b[0] == 0xff && b[1] == 0xfe) || (b[0] == 0xfe && b[1] == 0xff) {
+				b = b[2:]
+			}
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u = append(u, order.Uint16(b[i:]))
+		}
+		s = string(utf16.Decode(u))
+	case 3:
+		s = string(b)
+	default:
+		s = latin1(b)
+	}
+	// Multiple values are separated by NUL, only keep the first one.
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+func readID3v1(f io.ReadSeeker) Tags {
+	var t Tags
+	b := make([]byte, 128)
+	if _, err := f.Seek(-128, io.SeekEnd); err != nil {
+		return t
+	}
+	if _, err := io.ReadFull(f, b); err != nil || string(b[:3]) != "TAG" {
+		return t
+	}
+	field := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return strings.TrimSpace(latin1(b))
+	}
+	t.Title, t.Artist, t.Album = field(b[3:33]), field(b[33:63]), field(b[63:93])
+	return t
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IgnoreFileName is the per-directory file listing entries to hide, using
+// a subset of the .gitignore syntax: blank lines and # comments are skipped,
+// a leading ! re-includes, a trailing / only matches directories, patterns
+// containing a slash are relative to the directory holding the file while
+// others match names at any depth, and ** matches any number of directories.
+const IgnoreFileName = ".gosfsignore"
+
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreLevel holds the rules of one ignore file, base is the share
+// relative directory (without slashes) the file was found in.
+type ignoreLevel struct {
+	base  string
+	rules []ignoreRule
+}
+
+type ignoreEntry struct {
+	modTime time.Time
+	size    int64
+	rules   []ignoreRule
+}
+
+// ignoreCache keeps parsed ignore files, reloading them when they change.
+type ignoreCache struct {
+	mu      sync.Mutex
+	entries map[string]ignoreEntry
+}
+
+func parseIgnoreRules(sc *bufio.Scanner) []ignoreRule {
+	var rules []ignoreRule
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// load returns the rules of the ignore file in the given directory.
+func (ic *ignoreCache) load(dir string) []ignoreRule {
+	p := filepath.Join(dir, IgnoreFileName)
+	info, err := os.Stat(p)
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if err != nil {
+		delete(ic.entries, p)
+		return nil
+	}
+	if e, ok := ic.entries[p]; ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.rules
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	rules := parseIgnoreRules(bufio.NewScanner(f))
+	if ic.entries == nil {
+		ic.entries = map[string]ignoreEntry{}
+	}
+	ic.entries[p] = ignoreEntry{modTime: info.ModTime(), size: info.Size(), rules: rules}
+	return rules
+}
+
+// matchGlob matches a slash separated path against a pattern in which
+// ** stands for zero or more path components.
+func matchGlob(pattern, name string) bool {
+	return matchParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// ignoredBy evaluates the rules of all levels against the share relative
+// path rel, the last matching rule wins.
+func ignoredBy(levels []ignoreLevel, rel string, isDir bool) bool {
+	ignored := false
+	for _, l := range levels {
+		sub := rel
+		if l.base != "" {
+			sub = strings.TrimPrefix(rel, l.base+"/")
+		}
+		for _, r := range l.rules {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			target := sub
+			if !r.anchored {
+				target = path.Base(sub)
+			}
+			if matchGlob(r.pattern, target) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// ignoreLevels loads the ignore files applying to the entries of the share
+// relative directory dir, from the root down to dir itself.
+func (c *controller) ignoreLevels(dir string) []ignoreLevel {
+	dir = strings.Trim(dir, "/")
+	levels := []ignoreLevel{{rules: c.ignores.load(c.rootDir)}}
+	if dir == "" {
+		return levels
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		base := strings.Join(parts[:i+1], "/")
+		levels = append(levels, ignoreLevel{
+			base:  base,
+			rules: c.ignores.load(c.fsPath(base)),
+		})
+	}
+	return levels
+}
+
+// ignored reports whether the share relative path rel, or any of its parent
+// directories, is excluded by an ignore file.
+func (c *controller) ignored(rel string, isDir bool) bool {
+	rel = strings.Trim(rel, "/")
+	if rel == "" {
+		return false
+	}
+	levels := c.ignoreLevels("")
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		last := i == len(parts)-1
+		if ignoredBy(levels, p, isDir || !last) {
+			return true
+		}
+		if !last {
+			levels = append(levels, ignoreLevel{
+				base:  p,
+				rules: c.ignores.load(c.fsPath(p)),
+			})
+		}
+	}
+	return false
+}
+
+// isHidden combines the server wide hide rules with the ignore files, the
+// ignore and upload field files themselves are always hidden.
+func (c *controller) isHidden(rel string, isDir bool) bool {
+	if base := path.Base(rel); base == IgnoreFileName || base == UploadFieldsFileName {
+		return true
+	}
+	return c.hide.hides(rel) || c.ignored(rel, isDir)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DefaultIndexInterval = time.Minute
+	DefaultIndexMaxSize  = 1 << 20 // 1MiB
+	indexFileName        = "content-index.gob"
+	snippetRadius        = 80
+)
+
+// indexDoc is the indexed state of a single file, keyed by its share path.
+type indexDoc struct {
+	ModTime time.Time
+	Size    int64
+	Length  int
+	Terms   map[string]int
+}
+
+// indexer maintains an in-memory inverted index of the text files in root.
+// Changes are picked up by periodically rescanning root, and the index is
+// persisted to dataDir so restarts don't have to read every file again.
+type indexer struct {
+	logger   *log.Logger
+	root     string
+	dataDir  string
+	interval time.Duration
+	maxSize  int64
+	hidden   func(rel string, isDir bool) bool
+	pool     *workerPool
+
+	mu       sync.RWMutex
+	docs     map[string]*indexDoc
+	postings map[string]map[string]int
+}
+
+type ContentMatch struct {
+	Name    string  `json:"name"`
+	Link    string  `json:"link"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+func newIndexer(logger *log.Logger, root, dataDir string, interval time.Duration, maxSize int64, hidden func(string, bool) bool, pool *workerPool) *indexer {
+	return &indexer{
+		pool:     pool,
+		logger:   logger,
+		root:     root,
+		dataDir:  dataDir,
+		interval: interval,
+		maxSize:  maxSize,
+		hidden:   hidden,
+		docs:     map[string]*indexDoc{},
+		postings: map[string]map[string]int{},
+	}
+}
+
+// tokenize splits s into lower-cased words, ignoring single characters.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := words[:0]
+	for _, w := range words {
+		if utf8.RuneCountInString(w) > 1 {
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
+
+// isText sniffs the beginning of the file to decide whether it is worth
+// indexing.
+func isText(head []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(head), "text/")
+}
+
+func (ix *indexer) load() {
+	f, err := os.Open(filepath.Join(ix.dataDir, indexFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ix.logger.Println("Error loading content index:", err)
+		}
+		return
+	}
+	defer f.Close()
+	docs := map[string]*indexDoc{}
+	if err = gob.NewDecoder(f).Decode(&docs); err != nil {
+		ix.logger.Println("Error decoding content index, rebuilding:", err)
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for p, doc := range docs {
+		ix.add(p, doc)
+	}
+}
+
+func (ix *indexer) save() error {
+	if err := os.MkdirAll(ix.dataDir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(ix.dataDir, indexFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	ix.mu.RLock()
+	err = gob.NewEncoder(tmp).Encode(ix.docs)
+	ix.mu.RUnlock()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(ix.dataDir, indexFileName))
+}
+
+// add and remove must be called with ix.mu held.
+func (ix *indexer) add(p string, doc *indexDoc) {
+	ix.remove(p)
+	ix.docs[p] = doc
+	for term, tf := range doc.Terms {
+		if ix.postings[term] == nil {
+			ix.postings[term] = map[string]int{}
+		}
+		ix.postings[term][p] = tf
+	}
+}
+
+func (ix *indexer) remove(p string) {
+	doc, ok := ix.docs[p]
+	if !ok {
+		return
+	}
+	for term := range doc.Terms {
+		delete(ix.postings[term], p)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	delete(ix.docs, p)
+}
+
+// indexFile reads and tokenizes a single file. It returns nil for files
+// which don't look like text.
+func (ix *indexer) indexFile(p string, info fs.FileInfo) (*indexDoc, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(512)
+	if len(head) == 0 || !isText(head) {
+		return nil, nil
+	}
+	doc := &indexDoc{ModTime: info.ModTime(), Size: info.Size(), Terms: map[string]int{}}
+	sc := bufio.NewScanner(br)
+	sc.Buffer(make([]byte, 64<<10), int(ix.maxSize))
+	for sc.Scan() {
+		for _, t := range tokenize(sc.Text()) {
+			doc.Terms[t]++
+			doc.Length++
+		}
+	}
+	return doc, sc.Err()
+}
+
+// scan walks root once, reindexing new or modified files and dropping
+// deleted ones. It reports whether the index changed.
+func (ix *indexer) scan(ctx context.Context) bool {
+	seen := map[string]bool{}
+	changed := false
+	filepath.WalkDir(ix.root, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(ix.root, p)
+		if err != nil || p == ix.root {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if ix.hidden(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() == 0 || info.Size() > ix.maxSize {
+			return nil
+		}
+		ix.mu.RLock()
+		old, ok := ix.docs[rel]
+		ix.mu.RUnlock()
+		if ok && old.ModTime.Equal(info.ModTime()) && old.Size == info.Size() {
+			seen[rel] = true
+			return nil
+		}
+		doc, err := ix.indexFile(p, info)
+		if err != nil {
+			ix.logger.Printf("Error indexing %s: %s\n", rel, err)
+			return nil
+		}
+		if doc == nil {
+			return nil
+		}
+		seen[rel] = true
+		ix.mu.Lock()
+		ix.add(rel, doc)
+		ix.mu.Unlock()
+		changed = true
+		return nil
+	})
+	if ctx.Err() != nil {
+		// An interrupted walk hasn't seen everything, so don't prune.
+		return changed
+	}
+	ix.mu.Lock()
+	for p := range ix.docs {
+		if !seen[p] {
+			ix.remove(p)
+			changed = true
+		}
+	}
+	ix.mu.Unlock()
+	return changed
+}
+
+// run loads the persisted index and keeps it up to date until ctx is done.
+func (ix *indexer) run(ctx context.Context) {
+	ix.load()
+	ticker := time.NewTicker(ix.interval)
+	defer ticker.Stop()
+	for {
+		ix.pool.run(ctx, "index", ix.root, func(ctx context.Context) error {
+			start := time.Now()
+			if !ix.scan(ctx) {
+				return ctx.Err()
+			}
+			if err := ix.save(); err != nil {
+				ix.logger.Println("Error saving content index:", err)
+				return err
+			}
+			ix.mu.RLock()
+			ix.logger.Printf("Content index updated: %d files in %s\n", len(ix.docs), time.Since(start))
+			ix.mu.RUnlock()
+			return ctx.Err()
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// search ranks the documents containing every query term with tf-idf,
+// normalized by document length.
+func (ix *indexer) search(q string, limit int) []ContentMatch {
+	terms := tokenize(q)
+	if len(terms) == 0 {
+		return nil
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	scores := map[string]float64{}
+	for i, term := range terms {
+		posting := ix.postings[term]
+		idf := math.Log(1 + float64(len(ix.docs))/float64(1+len(posting)))
+		next := map[string]float64{}
+		for p, tf := range posting {
+			if _, ok := scores[p]; i > 0 && !ok {
+				continue
+			}
+			next[p] = scores[p] + float64(tf)*idf
+		}
+		scores = next
+	}
+	matches := make([]ContentMatch, 0, len(scores))
+	for p, score := range scores {
+		matches = append(matches, ContentMatch{
+			Name:  p,
+			Link:  (&url.URL{Path: "/" + p}).String(),
+			Score: score / math.Sqrt(float64(ix.docs[p].Length)),
+		})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// snippet returns the text surrounding the first occurrence of any of the
+// query terms in the file.
+func (ix *indexer) snippet(p string, terms []string) string {
+	f, err := os.Open(filepath.Join(ix.root, filepath.FromSlash(p)))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, ix.maxSize))
+	if err != nil {
+		return ""
+	}
+	text := string(b)
+	lower := strings.ToLower(text)
+	for _, t := range terms {
+		i := strings.Index(lower, t)
+		if i < 0 {
+			continue
+		}
+		start, end := i-snippetRadius, i+len(t)+snippetRadius
+		if start < 0 {
+			start = 0
+		}
+		if end > len(text) {
+			end = len(text)
+		}
+		// Don't cut multi-byte characters in half.
+		for start > 0 && !utf8.RuneStart(text[start]) {
+			start--
+		}
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end++
+		}
+		return strings.Join(strings.Fields(text[start:end]), " ")
+	}
+	return ""
+}
+
+func (c *controller) contentSearch(w http.ResponseWriter, r *http.Request) {
+	// Matches name the files, which listings may be meant to keep private
+	if c.indexer == nil || c.noListing || !c.readable(r) {
+		http.Error(w, "content search is disabled", http.StatusNotFound)
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "missing search query", http.StatusBadRequest)
+		return
+	}
+	limit := DefaultPageSize
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+	matches := c.indexer.search(q, limit)
+	terms := tokenize(q)
+	for i := range matches {
+		matches[i].Snippet = c.indexer.snippet(matches[i].Name, terms)
+	}
+	c.writeJSON(w, r, struct {
+		Query   string         `json:"query"`
+		Results []ContentMatch `json:"results"`
+	}{q, matches})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultStaleUploadAge = 24 * time.Hour
+	// janitorInterval is the time between sweeps of the share.
+	janitorInterval = time.Hour
+	// uploadTempInfix marks the temporary files uploads are written to,
+	// named ".<file>.upload-<random>" next to their target.
+	uploadTempInfix = ".upload-"
+)
+
+// janitor removes the temporary files of uploads which were interrupted
+// without cleaning up, e.g. by a crash or a power loss, once they haven't
+// been written to for maxAge. It sweeps the share, and the spool directory
+// if uploads aren't spooled next to their targets.
+type janitor struct {
+	logger *log.Logger
+	roots  []string
+	maxAge time.Duration
+	pool   *workerPool
+
+	removed   int64 // files, accessed atomically
+	reclaimed int64 // bytes, accessed atomically
+}
+
+func newJanitor(logger *log.Logger, roots []string, maxAge time.Duration, pool *workerPool) *janitor {
+	return &janitor{logger: logger, roots: roots, maxAge: maxAge, pool: pool}
+}
+
+// isUploadTemp reports whether name is the name of an upload's temporary
+// file.
+func isUploadTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, uploadTempInfix)
+}
+
+// run sweeps the share on start and then every janitorInterval until ctx
+// is done.
+func (j *janitor) run(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		j.pool.run(ctx, "janitor", j.roots[0], j.sweep)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep removes the stale temporary files of uploads.
+func (j *janitor) sweep(ctx context.Context) error {
+	var files, bytes int64
+	cutoff := time.Now().Add(-j.maxAge)
+	var err error
+	for _, root := range j.roots {
+		if err = j.sweepDir(ctx, root, cutoff, &files, &bytes); err != nil {
+			break
+		}
+	}
+	if files > 0 {
+		atomic.AddInt64(&j.removed, files)
+		atomic.AddInt64(&j.reclaimed, bytes)
+		j.logger.Printf("Removed %d stale uploads, reclaiming %s\n", files, formatBytes(bytes))
+	}
+	return err
+}
+
+// sweepDir removes the stale temporary files below root, counting them.
+func (j *janitor) sweepDir(ctx context.Context, root string, cutoff time.Time, files, bytes *int64) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped, not the whole sweep.
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !isUploadTemp(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			j.logger.Println("Error removing stale upload:", err)
+			return nil
+		}
+		*files++
+		*bytes += info.Size()
+		return nil
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Journaled operations.
+const (
+	JournalRename    = "rename"
+	JournalRemove    = "remove"
+	JournalRemoveAll = "remove_all"
+)
+
+const (
+	journalFileName = "journal.log"
+	// journalCompactSize is the size from which the journal is emptied once
+	// no operation is in flight.
+	journalCompactSize = 1 << 20
+)
+
+// journalEntry records the intent to apply an operation, or with only
+// the ID, that the operation of the ID was applied.
+type journalEntry struct {
+	ID   int64  `json:"id"`
+	Op   string `json:"op,omitempty"`
+	From string `json:"from,omitempty"` // of renames
+	Path string `json:"path,omitempty"`
+}
+
+// journal is the write-ahead journal of the mutations of the share, see
+// -journal. Each operation is recorded before it is applied, and once it
+// was, so that operations interrupted by a crash or power loss are redone
+// on the next start: the uploaded or edited file which was about to be
+// renamed into place is, and deletions are completed. All operations can
+// be redone any number of times. A nil journal applies the operations
+// without recording them.
+type journal struct {
+	mu       sync.Mutex
+	file     *os.File
+	nextID   int64
+	inFlight int
+	size     int64
+}
+
+// openJournal redoes the operations in the journal in dataDir which were
+// not applied, and empties it.
+func openJournal(dataDir string, logger *log.Logger) (*journal, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, journalFileName), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	pending := map[int64]journalEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last entry may have been cut off by the crash.
+			continue
+		}
+		if e.Op == "" {
+			delete(pending, e.ID)
+		} else {
+			pending[e.ID] = e
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	var entries []journalEntry
+	for _, e := range pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	for _, e := range entries {
+		if err := e.redo(); err != nil {
+			logger.Printf("Error redoing journaled %s of %s: %v\n", e.Op, e.Path, err)
+			continue
+		}
+		logger.Printf("Redid journaled %s of %s\n", e.Op, e.Path)
+	}
+	if err := f.Truncate(0); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &journal{file: f}, nil
+}
+
+// redo applies e if it wasn't, or completes it.
+func (e journalEntry) redo() error {
+	var err error
+	switch e.Op {
+	case JournalRename:
+		if err = os.Rename(e.From, e.Path); errors.Is(err, fs.ErrNotExist) {
+			// Renamed already, or the upload was removed.
+			return nil
+		}
+	case JournalRemove:
+		if err = os.Remove(e.Path); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+	case JournalRemoveAll:
+		err = os.RemoveAll(e.Path)
+	}
+	return err
+}
+
+// begin records the intent to apply e and returns its ID.
+func (j *journal) begin(e journalEntry) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.nextID++
+	e.ID = j.nextID
+	if err := j.write(e); err != nil {
+		return 0, err
+	}
+	if err := j.file.Sync(); err != nil {
+		return 0, err
+	}
+	j.inFlight++
+	return e.ID, nil
+}
+
+// end records that the operation id was applied, or failed.
+func (j *journal) end(id int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.write(journalEntry{ID: id})
+	if j.inFlight--; j.inFlight == 0 && j.size > journalCompactSize {
+		if j.file.Truncate(0) == nil {
+			j.size = 0
+		}
+	}
+}
+
+func (j *journal) write(e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n, err := j.file.Write(append(b, '\n'))
+	j.size += int64(n)
+	return err
+}
+
+// apply journals the operation e around fn.
+func (j *journal) apply(e journalEntry, fn func() error) error {
+	if j == nil {
+		return fn()
+	}
+	id, err := j.begin(e)
+	if err != nil {
+		return err
+	}
+	defer j.end(id)
+	if err = fn(); err != nil {
+		return err
+	}
+	// The end of the operation must not be recorded before it is durable.
+	syncDir(filepath.Dir(e.Path))
+	return nil
+}
+
+// rename renames from to to. The file from is synced first, so that the
+// rename can be redone with its complete contents.
+func (j *journal) rename(from, to string) error {
+	if j != nil {
+		// Directories have no contents of their own to sync.
+		if info, err := os.Stat(from); err != nil || !info.IsDir() {
+			if err := syncFile(from); err != nil {
+				return err
+			}
+		}
+	}
+	return j.apply(journalEntry{Op: JournalRename, From: from, Path: to}, func() error {
+		return os.Rename(from, to)
+	})
+}
+
+// remove removes the file or empty directory p.
+func (j *journal) remove(p string) error {
+	return j.apply(journalEntry{Op: JournalRemove, Path: p}, func() error {
+		return os.Remove(p)
+	})
+}
+
+// removeAll removes p and everything in it.
+func (j *journal) removeAll(p string) error {
+	return j.apply(journalEntry{Op: JournalRemoveAll, Path: p}, func() error {
+		return os.RemoveAll(p)
+	})
+}
+
+func syncFile(p string) error {
+	// Windows only flushes files opened for writing.
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// syncDir makes the changes of the entries of dir durable, where the
+// platform supports that.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
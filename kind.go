@@ -0,0 +1,80 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Kinds of files, as shown by the listing icons and used by the kind
+// filter and upload policies.
+const (
+	KindDir     = "dir"
+	KindImage   = "image"
+	KindVideo   = "video"
+	KindAudio   = "audio"
+	KindArchive = "archive"
+	KindCode    = "code"
+	KindDoc     = "doc"
+	KindFile    = "file" // anything else
+)
+
+var kinds = []string{KindDir, KindImage, KindVideo, KindAudio, KindArchive, KindCode, KindDoc, KindFile}
+
+var (
+	archiveExts = words(".zip .tar .gz .tgz .bz2 .tbz2 .xz .txz .zst .7z .rar .iso .dmg .deb .rpm .apk .jar")
+	docExts     = words(".pdf .doc .docx .odt .rtf .xls .xlsx .ods .ppt .pptx .odp .epub")
+)
+
+// fileKind classifies a file by its name.
+func fileKind(name string, isDir bool) string {
+	if isDir {
+		return KindDir
+	}
+	ext := strings.ToLower(path.Ext(name))
+	switch {
+	case isVideo(name):
+		return KindVideo
+	case isAudio(name):
+		return KindAudio
+	case thumbExts[ext] || strings.HasPrefix(mime.TypeByExtension(ext), "image/"):
+		return KindImage
+	case archiveExts[ext]:
+		return KindArchive
+	case docExts[ext] || textExts[ext]:
+		return KindDoc
+	}
+	if _, ok := languages[ext]; ok {
+		return KindCode
+	}
+	return KindFile
+}
+
+// icons are the listing icons of the kinds, 16x16 SVGs.
+var icons = map[string]string{
+	KindDir:     `<path d="M1 3h5l2 2h7v9H1z" fill="#f0b429"/>`,
+	KindImage:   `<path d="M2 2h12v12H2z" fill="#7cc4fa"/><path d="M2 14l4-5 3 3 2-2 3 4z" fill="#2d6a4f"/><circle cx="11" cy="5" r="1.5" fill="#fff"/>`,
+	KindVideo:   `<path d="M1 3h14v10H1z" fill="#6741d9"/><path d="M6 5v6l5-3z" fill="#fff"/>`,
+	KindAudio:   `<path d="M6 2l8-1v10h-1.5V4L7.5 4.6V13H6z" fill="#e64980"/><circle cx="4.5" cy="13" r="2" fill="#e64980"/><circle cx="11" cy="11" r="2" fill="#e64980"/>`,
+	KindArchive: `<path d="M2 1h12v14H2z" fill="#a47148"/><path d="M7 1h2v2H7zm0 4h2v2H7zm0 4h2v3H7z" fill="#fff"/>`,
+	KindCode:    `<path d="M3 1h7l3 3v11H3z" fill="#ced4da"/><path d="M7 7L5 9.5 7 12M9 7l2 2.5L9 12" stroke="#1c7ed6" stroke-width="1.2" fill="none"/>`,
+	KindDoc:     `<path d="M3 1h7l3 3v11H3z" fill="#ced4da"/><path d="M5 7h6M5 9h6M5 11h4" stroke="#495057"/>`,
+	KindFile:    `<path d="M3 1h7l3 3v11H3z" fill="#ced4da"/><path d="M10 1v3h3" fill="#adb5bd"/>`,
+}
+
+// icon serves the icon of a kind, /icons/<kind>.svg.
+func (c *controller) icon(w http.ResponseWriter, r *http.Request) {
+	kind := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/icons/"), ".svg")
+	shape, ok := icons[kind]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	// The icons only change with the server, like the pages embedding them.
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if r.Method != http.MethodHead {
+		w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="16" height="16" viewBox="0 0 16 16">` + shape + `</svg>`))
+	}
+}
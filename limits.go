@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	DefaultMaxRequestSize = 256 << 20 // 256MiB
+	DefaultMaxUploadFiles = 100
+)
+
+// Upload limits, as reported in 413 responses.
+const (
+	LimitFileSize    = "file_size"
+	LimitRequestSize = "request_size"
+	LimitFiles       = "files"
+)
+
+var errUploadTooLarge = errors.New("upload too large")
+
+// uploadLimitError is an upload exceeding one of the limits.
+type uploadLimitError struct {
+	limit string
+	max   int64
+}
+
+func (e uploadLimitError) Error() string {
+	switch e.limit {
+	case LimitFileSize:
+		return "file too large, the limit is " + formatBytes(e.max)
+	case LimitRequestSize:
+		return "upload too large, the limit is " + formatBytes(e.max) + " in total"
+	default:
+		return fmt.Sprintf("too many files, the limit is %d per upload", e.max)
+	}
+}
+
+// limitedFile fails reads with errUploadTooLarge once more than max bytes
+// were read, so that oversized files are cut off as they arrive.
+type limitedFile struct {
+	r        io.Reader
+	n, max   int64
+	exceeded bool
+}
+
+func (lf *limitedFile) Read(b []byte) (int, error) {
+	n, err := lf.r.Read(b)
+	lf.n += int64(n)
+	if lf.n > lf.max {
+		lf.exceeded = true
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// limitedBody is a request body cut off by http.MaxBytesReader, which
+// remembers whether the limit was hit.
+type limitedBody struct {
+	io.ReadCloser
+	n, max int64
+}
+
+func newLimitedBody(w http.ResponseWriter, body io.ReadCloser, max int64) *limitedBody {
+	return &limitedBody{ReadCloser: http.MaxBytesReader(w, body, max), max: max}
+}
+
+func (lb *limitedBody) Read(b []byte) (int, error) {
+	n, err := lb.ReadCloser.Read(b)
+	lb.n += int64(n)
+	return n, err
+}
+
+func (lb *limitedBody) exceeded() bool {
+	return lb.n >= lb.max
+}
+
+// uploadTooLarge responds with 413 to an upload exceeding a limit, and
+// makes the error visible to progress queries. The rest of the body isn't
+// read, the connection is closed instead.
+func (c *controller) uploadTooLarge(w http.ResponseWriter, r *http.Request, err uploadLimitError) {
+	if p, ok := r.Context().Value(progressKey).(*UploadProgress); ok {
+		c.uploads.update(p, func(p *UploadProgress) { p.Error = err.Error() })
+	}
+	w.Header().Set("Connection", "close")
+	writeError(w, r, http.StatusRequestEntityTooLarge, APIError{
+		Code:    "upload_too_large",
+		Message: err.Error(),
+		Details: map[string]interface{}{"limit": err.limit, "max": err.max},
+	})
+}
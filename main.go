@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"html/template"
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -26,29 +35,333 @@ const (
 	DefaultMaxUploadSize = 16 << 20 // 16MiB
 	DefaultReadTimeout   = 10 * time.Second
 	DefaultWriteTimeout  = 10 * time.Second
+	// DefaultShutdownTimeout is how long requests may run after a shutdown
+	// was requested, DefaultUploadDrainTimeout how long uploads may.
+	DefaultShutdownTimeout    = 5 * time.Second
+	DefaultUploadDrainTimeout = 30 * time.Second
+	// uploadCleanupTimeout is how long uploads which were cut off get to
+	// remove their partial files.
+	uploadCleanupTimeout = 5 * time.Second
+	DefaultSearchDepth   = 16
+	DefaultSearchTimeout = 5 * time.Second
+	DefaultSearchLimit   = 1000
+	DefaultPageSize      = 500
+	MaxPageSize          = 5000
+	readDirBatchSize     = 256
 )
 
 //go:embed index.html
 var indexContent string
 
 type controller struct {
-	logger        *log.Logger
+	logger *log.Logger
+	// serviceStop is closed when the Windows service is asked to stop.
+	serviceStop   <-chan struct{}
 	rootDir       string
-	maxUploadSize int
 	nextRequestID func() string
 	healthy       int64
+	searchDepth   int
+	searchTimeout time.Duration
+	indexer       *indexer
+	hide          hideRules
+	ignores       ignoreCache
+	// uploadFieldFiles caches the UploadFieldsFileName files.
+	uploadFieldFiles uploadFieldsCache
+	serveIndex       bool
+	noListing        bool
+	// realRoot is rootDir with symlinks resolved, used by the symlink policy.
+	realRoot string
+	// unions are the directories merged into the tree of rootDir.
+	unions         unionDirs
+	followSymlinks string
+	previewMaxSize int64
+	thumbs         *thumbnailer
+	transcoder     *transcoder
+	// stripExif lists the path prefixes whose images are served without
+	// metadata.
+	stripExif       []string
+	editMaxSize     int64
+	deleteEnabled   bool
+	charset         string
+	compressMinSize int
+	cacheRules      cacheRules
+	uploadPolicies  uploadPolicies
+	fileCache       *fileCache
+	archives        *archiveCache
+	origin          *origin
+	torrents        *torrentMaker
+	copier          *copier
+	digests         *digestCache
+	urls            *urlBuilder
+	spool           *spool
+	watcher         *watcher
+	uploads         *uploadTracker
+	webhooks        webhooks
+	chats           chatNotifiers
+	auditLog        *auditLog
+	journal         *journal
+	atRest          *atRest
+	scrubber        *scrubber
+	adminToken      string
+	shareStore      *shareStore
+	signingKey      string
+	users           *userStore
+	tokens          *tokenStore
+	authMode        string
+	stats           *statsStore
+	meta            *metaStore
+	favoriteStore   *favoriteStore
+	recentIndex     *recentIndex
+	replicator      *replicator
+	snapshotter     *snapshotter
+	janitor         *janitor
+	dlna            *dlna
+	workers         *workerPool
+	active          *activeTransfers
+	sockets         *webSockets
+	// maxRequestSize and maxUploadFiles limit uploads in addition to the
+	// size of files in the settings.
+	maxRequestSize int64
+	maxUploadFiles int
+	// shutdownTimeout bounds requests after a shutdown was requested,
+	// uploadDrainTimeout uploads.
+	shutdownTimeout    time.Duration
+	uploadDrainTimeout time.Duration
+	transfers          *transferStore
+	quotas             *quotaStore
+	// indexTemplate is the source of the listing template, the embedded
+	// one or -index-template.
+	indexTemplate string
+	// settings can be changed at runtime through the admin API.
+	settings *settingsStore
 }
 
 type File struct {
-	Link    string
-	Size    string
-	ModTime string
-	Name    string
+	Link    string   `json:"link"`
+	Size    string   `json:"-"`
+	ModTime string   `json:"-"`
+	Name    string   `json:"name"`
+	Preview string   `json:"-"`
+	Thumb   string   `json:"thumb,omitempty"`
+	IsDir   bool     `json:"is_dir"`
+	Kind    string   `json:"kind"`
+	Tags    []string `json:"tags,omitempty"`
+	Starred bool     `json:"starred,omitempty"`
+	Mode    string   `json:"mode"` // e.g. "-rw-r--r--"
+	Owner   string   `json:"owner,omitempty"`
+	// Encrypted files were encrypted by the client, which left Encryption
+	// to decrypt them, see Metadata.
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	Encryption string `json:"encryption,omitempty"`
+	// Raw values are kept for sorting, the formatted ones above are for display.
+	RawSize    int64     `json:"size"`
+	RawModTime time.Time `json:"mod_time"`
+}
+
+type Breadcrumb struct {
+	Name string
+	Link string
 }
 
 type Dir struct {
-	DisplayPath string
-	Files       []File
+	DisplayPath string        `json:"path"`
+	Parent      string        `json:"parent,omitempty"`
+	Breadcrumbs []Breadcrumb  `json:"-"`
+	Sort        string        `json:"sort"`
+	Order       string        `json:"order"`
+	Filter      url.Values    `json:"-"`
+	Query       string        `json:"-"`
+	View        string        `json:"-"` // title of views across directories
+	Readme      template.HTML `json:"-"`
+	HasAudio    bool          `json:"-"`
+	HasTorrent  bool          `json:"-"`
+	Shared      bool          `json:"-"`
+	DropBox     bool          `json:"-"`
+	Columns     []Column      `json:"-"`
+	// UploadFields are filled in on uploads into the directory.
+	UploadFields []UploadField `json:"upload_fields,omitempty"`
+	Files        []File        `json:"files"`
+	// Pagination state, Prev and Next are empty on the first and last page.
+	Page  int    `json:"page"`
+	Pages int    `json:"pages"`
+	Total int    `json:"total"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+}
+
+// listOptions holds the listing query parameters.
+type listOptions struct {
+	Sort   string
+	Order  string
+	Page   int
+	Limit  int
+	Filter listFilter
+	// filterQuery keeps the raw filter parameters so that they survive
+	// pagination and sorting links.
+	filterQuery url.Values
+}
+
+func parseListOptions(q url.Values) (listOptions, error) {
+	opts := listOptions{Sort: SortByName, Order: OrderAsc, Page: 1, Limit: DefaultPageSize}
+	switch s := q.Get("sort"); s {
+	case SortByName, SortBySize, SortByModTime, SortByKind:
+		opts.Sort = s
+	}
+	if q.Get("order") == OrderDesc {
+		opts.Order = OrderDesc
+	}
+	if p, err := strconv.Atoi(q.Get("page")); err == nil && p > 0 {
+		opts.Page = p
+	}
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+		opts.Limit = l
+		if l > MaxPageSize {
+			opts.Limit = MaxPageSize
+		}
+	}
+	opts.filterQuery = url.Values{}
+	for _, k := range filterParams {
+		if v := q.Get(k); v != "" {
+			opts.filterQuery.Set(k, v)
+		}
+	}
+	var err error
+	opts.Filter, err = parseListFilter(q)
+	return opts, err
+}
+
+// query encodes the options as a query string, omitting defaults.
+func (o listOptions) query() string {
+	q := url.Values{"sort": {o.Sort}, "order": {o.Order}}
+	for k, v := range o.filterQuery {
+		q[k] = v
+	}
+	if o.Page > 1 {
+		q.Set("page", strconv.Itoa(o.Page))
+	}
+	if o.Limit != DefaultPageSize {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return "?" + q.Encode()
+}
+
+// paginate fills in the page details and navigation links for a listing of
+// total entries and returns the range of the requested page. Out of range
+// pages are clamped to the last one, a limit of zero disables pagination.
+func (dir *Dir) paginate(opts listOptions, total int) (int, int) {
+	dir.Total = total
+	if opts.Limit <= 0 {
+		dir.Page, dir.Pages = 1, 1
+		return 0, total
+	}
+	dir.Pages = (dir.Total + opts.Limit - 1) / opts.Limit
+	if dir.Pages == 0 {
+		dir.Pages = 1
+	}
+	if opts.Page > dir.Pages {
+		opts.Page = dir.Pages
+	}
+	dir.Page = opts.Page
+	start := (opts.Page - 1) * opts.Limit
+	end := start + opts.Limit
+	if end > dir.Total {
+		end = dir.Total
+	}
+	if opts.Page > 1 {
+		prev := opts
+		prev.Page--
+		dir.Prev = prev.query()
+	}
+	if opts.Page < dir.Pages {
+		next := opts
+		next.Page++
+		dir.Next = next.query()
+	}
+	return start, end
+}
+
+// Column is a clickable listing header which toggles the sort order.
+type Column struct {
+	Label     string
+	Link      string
+	Indicator string
+}
+
+const (
+	SortByName    = "name"
+	SortBySize    = "size"
+	SortByModTime = "mtime"
+	SortByKind    = "kind" // groups files by kind, see fileKind
+	OrderAsc      = "asc"
+	OrderDesc     = "desc"
+)
+
+// sortColumns builds the listing headers for the current sort state.
+// Changing the sort order always goes back to the first page.
+func sortColumns(opts listOptions) []Column {
+	var cols []Column
+	for _, col := range []struct{ key, label string }{
+		{SortByName, "name"},
+		{SortBySize, "size"},
+		{SortByModTime, "modified"},
+		{SortByKind, "kind"},
+	} {
+		c := Column{Label: col.label}
+		next := opts
+		next.Sort, next.Order, next.Page = col.key, OrderAsc, 1
+		if col.key == opts.Sort {
+			if opts.Order == OrderAsc {
+				next.Order = OrderDesc
+				c.Indicator = "\u25B2"
+			} else {
+				c.Indicator = "\u25BC"
+			}
+		}
+		c.Link = next.query()
+		cols = append(cols, c)
+	}
+	return cols
+}
+
+// sortFiles sorts files in place by the given key and order, always keeping
+// directories ahead of regular files. Unknown keys fall back to name.
+func sortFiles(files []File, key, order string) {
+	less := func(a, b File) bool {
+		switch key {
+		case SortBySize:
+			if a.RawSize != b.RawSize {
+				return a.RawSize < b.RawSize
+			}
+		case SortByModTime:
+			if !a.RawModTime.Equal(b.RawModTime) {
+				return a.RawModTime.Before(b.RawModTime)
+			}
+		case SortByKind:
+			if a.Kind != b.Kind {
+				return a.Kind < b.Kind
+			}
+		}
+		return a.Name < b.Name
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if order == OrderDesc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// wantsJSON reports whether the client asked for a machine readable
+// response, either with ?format=json or through the Accept header.
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
 }
 
 func formatBytes(b int64) string {
@@ -71,114 +384,719 @@ func (c *controller) index(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Get path to render subdirectories as well as root
-	path := filepath.Join(c.rootDir, r.URL.Path)
+	path := c.fsPath(r.URL.Path)
 	file, _ := os.Stat(path)
+	file = c.atRest.plainInfo(file)
+	if c.isHidden(r.URL.Path, file != nil && file.IsDir()) || !c.allowed(path) {
+		http.NotFound(w, r)
+		return
+	}
+	if !c.readable(r) {
+		c.dropBoxPage(w, r, path, file)
+		return
+	}
+	if c.origin != nil && (file == nil || !file.IsDir()) && !strings.HasSuffix(r.URL.Path, "/") {
+		if !c.fromOrigin(w, r, path) {
+			return
+		}
+		file, _ = os.Stat(path)
+	}
 
 	// If there is file type, serve it directly
 	if file != nil && !file.Mode().IsDir() {
-		http.ServeFile(w, r, path)
+		if c.torrents != nil && r.URL.Query().Get("torrent") == "1" {
+			c.torrent(w, r, path, file)
+			return
+		}
+		// Encrypted files are only served as they are, along with what the
+		// client needs to decrypt them.
+		encryption := c.meta.get(r.URL.Path).Encryption
+		if encryption != "" {
+			w.Header().Set(encryptionHeader, encryption)
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		if encryption == "" && r.URL.Query().Get("view") == "1" {
+			c.preview(w, r, path, file)
+			return
+		}
+		if encryption == "" && r.URL.Query().Get("edit") == "1" {
+			c.edit(w, r, path, file)
+			return
+		}
+		if encryption == "" && r.URL.Query().Get("play") == "1" && isVideo(path) {
+			c.player(w, r, file)
+			return
+		}
+		if encryption == "" && isAudioRequest(r, path, file) {
+			c.audioPlayer(w, r, path, file)
+			return
+		}
+		if typ := c.contentType(path); typ != "" && encryption == "" {
+			w.Header().Set("Content-Type", typ)
+		}
+		if c.dlna != nil {
+			dlnaHeaders(w, r, path)
+		}
+		w, done := c.trackDownload(w, r, r.URL.Path)
+		defer done()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer c.countDownload(r, rec, r.URL.Path)
+		w = rec
+		if encryption == "" && c.stripsExif(r, r.URL.Path, false) {
+			c.serveStripped(w, r, path)
+			return
+		}
+		if c.atRest == nil && c.servePrecompressed(w, r, path) {
+			return
+		}
+		if wantsDigest(r) {
+			c.setDigest(w, r, path, file)
+		}
+		if c.serveCached(w, r, path, file) {
+			return
+		}
+		c.serveFile(w, r, path)
+		return
+	}
+	if file != nil && c.serveIndex {
+		indexPath := filepath.Join(path, "index.html")
+		if info, err := os.Stat(indexPath); err == nil && !info.IsDir() &&
+			!c.isHidden(r.URL.Path+"/index.html", false) {
+			// Relative links in the page only work below a trailing slash
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				u := *r.URL
+				u.Path += "/"
+				http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+				return
+			}
+			c.serveFile(w, r, indexPath)
+			return
+		}
+	}
+	if c.noListing {
+		http.NotFound(w, r)
+		return
+	}
+	if file != nil && r.URL.Query().Get("archive") == "zip" {
+		c.downloadArchive(w, r, path)
+		return
+	}
+	if file != nil && c.torrents != nil && r.URL.Query().Get("torrent") == "1" {
+		c.torrent(w, r, path, file)
+		return
+	}
+	if file != nil && isAudioRequest(r, path, file) {
+		if r.URL.Query().Get("playlist") == "m3u" {
+			c.playlist(w, r, path)
+		} else {
+			c.audioPlayer(w, r, path, file)
+		}
 		return
 	}
 	// Collect data
-	dir, err := c.listDir(path)
+	opts, err := parseListOptions(r.URL.Query())
 	if err != nil {
-		c.logger.Println("Error listing files in directory", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir, err := c.listDir(path, opts)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
 		return
 	}
-	t, err := template.New("index").Parse(indexContent)
 	if err != nil {
-		c.logger.Println("Error rendering index page:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		c.internalError(w, r, "Error listing files in directory", err)
+		return
+	}
+	dir.Columns = sortColumns(opts)
+	dir.UploadFields = c.uploadFields(dir.DisplayPath)
+	c.markStarred(r, dir.DisplayPath, dir.Files)
+	// The listing changes with its entries, which the directory mtime and the
+	// entries shown on the page capture.
+	modTime := file.ModTime()
+	for _, f := range dir.Files {
+		if f.RawModTime.After(modTime) {
+			modTime = f.RawModTime
+		}
+	}
+	if wantsJSON(r) {
+		if !notModified(w, r, listingETag(dir, modTime, r), modTime) {
+			c.writeJSON(w, r, dir)
+		}
 		return
 	}
-	if err = t.Execute(w, dir); err != nil {
-		c.logger.Println("Error rendering index page:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	dir.Readme = c.readme(r, path, dir.DisplayPath)
+	dir.HasTorrent = c.torrents != nil && dir.DisplayPath != "/"
+	for _, f := range dir.Files {
+		if !f.IsDir && isAudio(f.Name) {
+			dir.HasAudio = true
+			break
+		}
+	}
+	if notModified(w, r, listingETag(dir, modTime, r), modTime) {
 		return
 	}
+	c.renderIndex(w, r, dir)
+}
+
+// renderIndex renders the listing page into a buffer first, so that the
+// response has a Content-Length, for HEAD requests too, and failures are
+// reported as such rather than as truncated pages.
+func (c *controller) renderIndex(w http.ResponseWriter, r *http.Request, dir Dir) {
+	t, err := template.New("index").Funcs(c.templateFuncs(r)).Parse(c.indexTemplate)
+	if err != nil {
+		c.internalError(w, r, "Error rendering index page:", err)
+		return
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, dir); err != nil {
+		c.internalError(w, r, "Error rendering index page:", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if r.Method != http.MethodHead {
+		buf.WriteTo(w)
+	}
+}
+
+// beginUpload registers an upload with the tracker, refusing it while
+// the server shuts down. The caller must end it.
+func (c *controller) beginUpload(w http.ResponseWriter) bool {
+	if !c.uploads.begin() {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "the server is shutting down, retry later", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
 }
 
 func (c *controller) upload(w http.ResponseWriter, r *http.Request) {
-	// maximum upload of 16 MiB file
-	r.ParseMultipartForm(int64(c.maxUploadSize))
+	id, err := uploadID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.beginUpload(w) {
+		return
+	}
+	defer c.uploads.end()
+	// Track the progress so that it can be queried while the body arrives
+	progress := c.uploads.start(id, r.ContentLength)
+	r.Body = &progressReader{ReadCloser: r.Body, tracker: c.uploads, progress: progress}
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() { c.uploads.finish(progress, rec.status) }()
+	w = rec
+	w.Header().Set("X-Upload-Id", id)
+	r = r.WithContext(context.WithValue(r.Context(), progressKey, progress))
 
-	// Get handler for filename, size and headers
-	fhs := r.MultipartForm.File["files"]
+	display := uploadDir(r)
+	done := c.trackUpload(w, r, display)
+	defer done()
+	dir := c.fsPath(display)
+	if !c.storeFiles(w, r, dir, c.settings.get().DropBox) {
+		return
+	}
+	http.Redirect(w, r, r.Referer(), http.StatusFound)
+}
 
-	for _, fh := range fhs {
-		if fh.Size > int64(c.maxUploadSize) {
-			w.WriteHeader(http.StatusRequestEntityTooLarge)
-			return
+// uploadDir returns the share directory which r uploads to. The page names
+// it in the path parameter, other clients upload from the listing they
+// were referred by.
+func uploadDir(r *http.Request) string {
+	if p := r.URL.Query().Get("path"); p != "" {
+		return path.Clean("/" + p)
+	}
+	ref, err := url.Parse(r.Referer())
+	if err != nil {
+		return "/"
+	}
+	return path.Clean("/" + ref.Path)
+}
+
+// storeFiles saves the files of the multipart upload r into dir as they
+// arrive, under the upload policies of their directories. With keep,
+// existing files are never replaced, new ones get a unique name instead.
+// Uploads exceeding the size limits of files and requests, or the number
+// of files, are cut off once they do, leaving the files stored so far, as
+// are uploads of files the policies don't allow. The upload fields of dir
+// must precede the files.
+func (c *controller) storeFiles(w http.ResponseWriter, r *http.Request, dir string, keep bool) bool {
+	if r.ContentLength > c.maxRequestSize {
+		c.uploadTooLarge(w, r, uploadLimitError{LimitRequestSize, c.maxRequestSize})
+		return false
+	}
+	body := newLimitedBody(w, r.Body, c.maxRequestSize)
+	r.Body = body
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	var fields []UploadField
+	if display, err := c.relPath(dir, true); err == nil {
+		fields = c.uploadFields(display)
+	}
+	values := map[string]string{}
+	var checked map[string]string // once the first file arrived
+
+	files := 0
+	var nextPath string       // of the next file, from a paths field
+	var nextEncryption string // of the next file, from an encryption field
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
 		}
-		file, err := fh.Open()
 		if err != nil {
-			c.logger.Println("Error retrieving the file:", err)
+			if body.exceeded() {
+				c.uploadTooLarge(w, r, uploadLimitError{LimitRequestSize, c.maxRequestSize})
+				return false
+			}
+			c.log(r).Println("Error retrieving the file:", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			return false
+		}
+		switch {
+		case part.FormName() == "paths":
+			b, err := io.ReadAll(io.LimitReader(part, maxUploadPathLength+1))
+			if err != nil || len(b) > maxUploadPathLength {
+				http.Error(w, "invalid upload path", http.StatusBadRequest)
+				return false
+			}
+			nextPath = string(b)
+			continue
+		case part.FormName() == "encryption":
+			b, err := io.ReadAll(io.LimitReader(part, maxEncryptionSize+1))
+			if err == nil {
+				err = checkEncryption(string(b))
+			}
+			if err != nil {
+				http.Error(w, "invalid encryption metadata: "+err.Error(), http.StatusBadRequest)
+				return false
+			}
+			nextEncryption = string(b)
+			continue
+		case part.FormName() != "files" || part.FileName() == "":
+			if part.FileName() == "" && checked == nil && hasUploadField(fields, part.FormName()) {
+				b, _ := io.ReadAll(io.LimitReader(part, maxMetaValue+1))
+				values[part.FormName()] = string(b)
+			}
+			part.Close()
+			continue
+		}
+		if checked == nil {
+			var apiErr *APIError
+			if checked, apiErr = checkUploadFields(fields, values); apiErr != nil {
+				writeError(w, r, http.StatusBadRequest, *apiErr)
+				return false
+			}
+		}
+		if files++; files > c.maxUploadFiles {
+			c.uploadTooLarge(w, r, uploadLimitError{LimitFiles, int64(c.maxUploadFiles)})
+			return false
 		}
-		defer file.Close()
-		c.logger.Printf("Uploaded file: %+v, file size: %+v, MIME header: %+v\n",
-			fh.Filename, fh.Size, fh.Header)
 
-		// Create file
-		dst, err := os.OpenFile(filepath.Join(c.rootDir,
-			strings.TrimPrefix(r.Referer(), r.Header.Get("Origin")),
-			fh.Filename),
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		// Create file, and the directories of folder uploads
+		name, err := uploadName(part, nextPath)
+		encryption := nextEncryption
+		nextPath, nextEncryption = "", ""
 		if err != nil {
-			c.logger.Println("Error creating a new file:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
 		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if len(c.unions) > 0 {
+			if display, err := c.relPath(dir, true); err == nil {
+				target = c.fsPath(display + name)
+			}
+		}
+		rel, err := c.relPath(target, false)
+		if err != nil || c.isHidden(rel, false) {
+			c.log(r).Printf("Skipping hidden uploaded file: %s\n", name)
+			part.Close()
+			continue
+		}
+		if !c.allowed(target) {
+			http.Error(w, "target is not accessible under the symlink policy", http.StatusForbidden)
+			return false
+		}
+		policy := c.uploadPolicy(rel, keep)
+		if !policy.allows(name) {
+			http.Error(w, policy.typeError(name), http.StatusUnsupportedMediaType)
+			return false
+		}
+		if !c.makeParents(w, r, dir, target) {
+			return false
+		}
+		src := &limitedFile{r: part, max: policy.maxSize}
+		target, n, err := c.storeFile(r.Context(), src, target, policy.collision)
+		switch {
+		case src.exceeded:
+			c.uploadTooLarge(w, r, uploadLimitError{LimitFileSize, policy.maxSize})
+			return false
+		case os.IsExist(err):
+			http.Error(w, "file exists: "+name, http.StatusConflict)
+			return false
+		case errors.Is(err, errSpoolFull):
+			c.spoolFull(w, r)
+			return false
+		case r.Context().Err() != nil:
+			c.log(r).Printf("Upload of %s aborted, the client went away\n", name)
+			return false
+		case err != nil && body.exceeded():
+			c.uploadTooLarge(w, r, uploadLimitError{LimitRequestSize, c.maxRequestSize})
+			return false
+		case err != nil:
+			c.internalError(w, r, "Error storing uploaded file:", err)
+			return false
+		}
+		c.log(r).Printf("Uploaded file: %+v, file size: %+v, MIME header: %+v\n",
+			name, n, part.Header)
+		if rel, err := c.relPath(target, false); err == nil {
+			c.storeUploadFields(r, rel, checked)
+			c.setEncryption(r, rel, encryption)
+			c.auditFields(w, r, ActionUpload, checked, rel)
+			c.notify(r, WebhookEvent{Event: EventUpload, Path: rel, Size: n})
+			c.replicate(rel)
+		}
+	}
 
-		defer dst.Close()
-		// Copy the uploaded file to the created file on the filesystem
-		if _, err = io.Copy(dst, file); err != nil {
-			c.logger.Println("Error copying new file", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	return true
+}
+
+// storeFile writes an uploaded file through a temporary file next to
+// target, so that uploads which are cut off, e.g. by the shutdown, leave
+// no partial files behind. The collision policy decides what happens to
+// an existing file: it is replaced, the new one gets a unique name instead,
+// or storing fails with an os.ErrExist error. Once ctx is done, the copy
+// stops and nothing is stored. It returns the final path.
+func (c *controller) storeFile(ctx context.Context, src io.Reader, target, collision string) (string, int64, error) {
+	var reserved *os.File
+	var err error
+	switch collision {
+	case CollisionRename:
+		reserved, target, err = createUnique(target)
+	case CollisionReject:
+		reserved, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	}
+	if err != nil {
+		return target, 0, err
+	}
+	// A reserved file is replaced by the upload, or removed if it fails.
+	keep := reserved != nil
+	if keep {
+		reserved.Close()
+	}
+	src, buffered, err := c.spool.buffer(&contextReader{ctx: ctx, r: src})
+	var tmp *os.File
+	if err == nil {
+		tmp, err = c.spool.create(target)
+	}
+	if err != nil {
+		if keep {
+			os.Remove(target)
 		}
+		return target, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	// Buffered uploads are written at once, the rest count against the
+	// limit of the spool while they arrive.
+	var dst io.Writer = tmp
+	if !buffered && c.spool.max > 0 {
+		sw := &spoolWriter{w: tmp, spool: c.spool}
+		defer func() { c.spool.release(sw.n) }()
+		dst = sw
+	}
+	var sum hash.Hash
+	if c.scrubber != nil {
+		// The checksum scrubs verify the file with is taken on the way in.
+		sum = sha256.New()
+		src = io.TeeReader(src, sum)
+	}
+	var n int64
+	var enc io.WriteCloser
+	if c.atRest != nil {
+		// Close writes the last chunk.
+		enc, err = c.atRest.encrypt(dst)
+		dst = enc
+	}
+	if err == nil {
+		n, err = c.copier.copyContext(ctx, dst, src)
 	}
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = c.journal.rename(tmp.Name(), target)
+	}
+	if err == nil && sum != nil {
+		c.recordChecksum(target, sum.Sum(nil))
+	}
+	if err != nil && keep {
+		os.Remove(target)
+	}
+	return target, n, err
+}
 
-	http.Redirect(w, r, r.Referer(), http.StatusFound)
+// createUnique creates a new file at p, or if that exists, at p with a
+// counter appended to the name, and returns it along with its path.
+func createUnique(p string) (*os.File, string, error) {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) || i > 1000 {
+			return f, p, err
+		}
+		p = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
 }
 
-func (c *controller) listDir(root string) (Dir, error) {
-	dir := Dir{
-		DisplayPath: root,
-		Files:       []File{},
+// relPath returns the share-relative, slash-separated URL path of p,
+// which must be located inside rootDir or a union directory. Directories
+// get a trailing slash.
+func (c *controller) relPath(p string, isDir bool) (string, error) {
+	rel, err := filepath.Rel(c.layerOf(p).dir, p)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is outside of root directory", p)
+	}
+	if rel == "." {
+		return "/", nil
+	}
+	if isDir {
+		rel += "/"
+	}
+	return "/" + rel, nil
+}
+
+// breadcrumbs splits a share-relative directory path into clickable
+// components, starting with the share root.
+func breadcrumbs(display string) []Breadcrumb {
+	crumbs := []Breadcrumb{{Name: "/", Link: "/"}}
+	link := "/"
+	for _, name := range strings.Split(strings.Trim(display, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		link += name + "/"
+		crumbs = append(crumbs, Breadcrumb{
+			Name: name + "/",
+			Link: (&url.URL{Path: link}).String(),
+		})
 	}
+	return crumbs
+}
 
-	entries, err := os.ReadDir(root)
+// dirEntry is a listed entry whose details are only loaded when the
+// filter, the sort order or the requested page needs them.
+type dirEntry struct {
+	name  string
+	isDir bool
+	entry fs.DirEntry
+	info  fs.FileInfo
+}
+
+func (e *dirEntry) stat() (fs.FileInfo, error) {
+	if e.info == nil {
+		info, err := e.entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		e.info = info
+	}
+	return e.info, nil
+}
+
+// sortEntries sorts like sortFiles. Entries must have been stat'ed when
+// sorting by size or modification time.
+func sortEntries(entries []dirEntry, key, order string) {
+	less := func(a, b *dirEntry) bool {
+		switch key {
+		case SortBySize:
+			if !a.isDir && a.info.Size() != b.info.Size() {
+				return a.info.Size() < b.info.Size()
+			}
+		case SortByModTime:
+			if !a.info.ModTime().Equal(b.info.ModTime()) {
+				return a.info.ModTime().Before(b.info.ModTime())
+			}
+		case SortByKind:
+			if ka, kb := fileKind(a.name, a.isDir), fileKind(b.name, b.isDir); ka != kb {
+				return ka < kb
+			}
+		}
+		return a.name < b.name
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		if a.isDir != b.isDir {
+			return a.isDir
+		}
+		if order == OrderDesc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// listDir lists the visible entries of the directory at root for the page
+// requested by opts. Entries are only stat'ed when the filter or the sort
+// order needs it, otherwise just the ones on the page are, which keeps huge
+// directories cheap to browse.
+func (c *controller) listDir(root string, opts listOptions) (Dir, error) {
+	display, err := c.relPath(root, true)
 	if err != nil {
-		return dir, err
+		return Dir{}, err
 	}
+	dir := Dir{
+		DisplayPath: display,
+		Breadcrumbs: breadcrumbs(display),
+		Sort:        opts.Sort,
+		Order:       opts.Order,
+		Filter:      opts.filterQuery,
+		Files:       []File{},
+	}
+	if display != "/" {
+		dir.Parent = (&url.URL{Path: path.Dir(strings.TrimSuffix(display, "/"))}).String()
+		if dir.Parent != "/" {
+			dir.Parent += "/"
+		}
+	}
+
+	// Load the ignore files once for the whole directory instead of per entry.
+	levels := c.ignoreLevels(display)
+	prefix := strings.TrimPrefix(display, "/")
+	needInfo := opts.Sort == SortBySize || opts.Sort == SortByModTime || opts.Filter.needsInfo()
 
-	files := make([]fs.FileInfo, 0, len(entries))
-	for _, entry := range entries {
-		info, err := entry.Info()
+	// Union directories are merged, where names clash the first one wins.
+	var entries []dirEntry
+	dirs := []string{root}
+	var listed map[string]bool
+	if len(c.unions) > 0 {
+		dirs = c.dirLayers(display, root)
+		listed = make(map[string]bool)
+	}
+	for _, root := range dirs {
+		d, err := os.Open(root)
 		if err != nil {
-			continue
+			return dir, err
+		}
+		defer d.Close()
+
+		// Read entries in batches so that only the small dirEntry of each one is
+		// kept while the directory is scanned.
+		for {
+			batch, err := d.ReadDir(readDirBatchSize)
+			for _, entry := range batch {
+				name := entry.Name()
+				if name == IgnoreFileName || name == UploadFieldsFileName || c.hide.hidesName(name) ||
+					ignoredBy(levels, prefix+name, entry.IsDir()) {
+					continue
+				}
+				if listed != nil {
+					if listed[name] {
+						continue
+					}
+					listed[name] = true
+				}
+				e := dirEntry{name: name, isDir: entry.IsDir(), entry: entry}
+				if entry.Type()&fs.ModeSymlink != 0 {
+					// List links with the details of their target, if permitted.
+					target := filepath.Join(root, name)
+					if !c.allowed(target) {
+						continue
+					}
+					if e.info, err = os.Stat(target); err != nil {
+						continue
+					}
+					e.isDir = e.info.IsDir()
+				}
+				if !opts.Filter.matchName(name, e.isDir) {
+					continue
+				}
+				if opts.Filter.needsMeta() {
+					p := display + name
+					if e.isDir {
+						p += "/"
+					}
+					if !opts.Filter.matchMeta(c.meta.get(p)) {
+						continue
+					}
+				}
+				if needInfo {
+					info, err := e.stat()
+					if err != nil || !opts.Filter.matchInfo(c.atRest.plainInfo(info)) {
+						continue
+					}
+				}
+				entries = append(entries, e)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return dir, err
+			}
 		}
-		files = append(files, info)
 	}
 
-	for _, file := range files {
-		var f File
-		f.ModTime = file.ModTime().Format("2006-01-02 15:04")
-		if file.IsDir() {
-			f.Name = file.Name() + "/"
-			f.Size = "-"
-		} else {
-			f.Name = file.Name()
-			f.Size = formatBytes(file.Size())
+	sortEntries(entries, opts.Sort, opts.Order)
+	start, end := dir.paginate(opts, len(entries))
+	for i := start; i < end; i++ {
+		info, err := entries[i].stat()
+		if err != nil {
+			// Removed since it was read, skip it
+			continue
 		}
+		f := newFile(display, c.atRest.plainInfo(info))
+		f.setMeta(c.meta.get(display + f.Name))
 		dir.Files = append(dir.Files, f)
 	}
 	return dir, nil
 }
 
+func newFile(display string, file fs.FileInfo) File {
+	var f File
+	f.ModTime = file.ModTime().Format("2006-01-02 15:04")
+	f.RawModTime = file.ModTime()
+	f.IsDir = file.IsDir()
+	f.Mode = file.Mode().String()
+	f.Owner = fileOwner(file)
+	if file.IsDir() {
+		f.Name = file.Name() + "/"
+		f.Size = "-"
+	} else {
+		f.Name = file.Name()
+		f.Size = formatBytes(file.Size())
+		f.RawSize = file.Size()
+	}
+	f.Link = (&url.URL{Path: display + f.Name}).String()
+	f.Kind = fileKind(f.Name, f.IsDir)
+	switch {
+	case f.Kind == KindVideo || f.Kind == KindAudio:
+		f.Preview = f.Link + "?play=1"
+	case !f.IsDir && previewable(f.Name):
+		f.Preview = f.Link + "?view=1"
+	}
+	if f.Kind == KindImage && hasThumbnail(f.Name) {
+		f.Thumb = "/thumb" + f.Link
+	}
+	return f
+}
+
 func (c *controller) healthz(w http.ResponseWriter, req *http.Request) {
 	if h := atomic.LoadInt64(&c.healthy); h == 0 {
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -190,24 +1108,36 @@ func (c *controller) healthz(w http.ResponseWriter, req *http.Request) {
 func (c *controller) logging(hdlr http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		defer func(start time.Time) {
-			requestID := w.Header().Get("X-Request-Id")
-			if requestID == "" {
-				requestID = "unknown"
-			}
-			c.logger.Println(requestID, req.Method, req.URL.Path, req.RemoteAddr, req.UserAgent(), time.Since(start))
+			c.log(req).Println(req.Method, req.URL.Path, req.RemoteAddr, req.UserAgent(), time.Since(start))
 		}(time.Now())
 		hdlr.ServeHTTP(w, req)
 	})
 }
 
+// tracing assigns each request an ID, keeping the one of the client if
+// usable, and continues the W3C trace of the client or starts a new one.
+// Both are available to the handlers through the request context and
+// returned in the X-Request-Id and traceparent headers.
 func (c *controller) tracing(hdlr http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		requestID := req.Header.Get("X-Request-Id")
-		if requestID == "" {
+		if !validRequestID(requestID) {
 			requestID = c.nextRequestID()
 		}
+		tc, ok := parseTraceparent(req.Header.Get("Traceparent"))
+		if ok {
+			tc = tc.child()
+		} else {
+			tc = traceContext{traceID: randomHex(16), spanID: randomHex(8), flags: "00"}
+		}
 		w.Header().Set("X-Request-Id", requestID)
-		hdlr.ServeHTTP(w, req)
+		w.Header().Set("Traceparent", tc.traceparent())
+		ctx := context.WithValue(req.Context(), requestIDKey, requestID)
+		ctx = context.WithValue(ctx, traceKey, tc)
+		req = req.WithContext(ctx)
+		ew := &errorPageWriter{countingWriter: &countingWriter{ResponseWriter: w}, format: errorFormat(req)}
+		hdlr.ServeHTTP(ew, req)
+		ew.finish(req)
 	})
 }
 
@@ -219,19 +1149,60 @@ func (c *controller) shutdown(ctx context.Context, server *http.Server) context.
 	go func() {
 		defer done()
 
-		<-quit
+		select {
+		case <-quit:
+		case <-c.serviceStop:
+		}
 		signal.Stop(quit)
 		close(quit)
 
 		atomic.StoreInt64(&c.healthy, 0)
 		server.ErrorLog.Printf("Server is shutting down...\n")
 
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		// Uploads in flight may run past the shutdown timeout, up to the
+		// drain timeout, new ones are refused.
+		c.uploads.drain()
+		start := time.Now()
+		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
+		go func() {
+			select {
+			case <-time.After(c.shutdownTimeout):
+			case <-ctx.Done():
+				return
+			}
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			for c.uploads.inFlight() > 0 && time.Since(start) < c.uploadDrainTimeout {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if c.uploads.inFlight() == 0 {
+				// Give the responses to the drained uploads time to go out.
+				select {
+				case <-time.After(c.shutdownTimeout):
+				case <-ctx.Done():
+				}
+			}
+			cancel()
+		}()
 
 		server.SetKeepAlivesEnabled(false)
+		// The server doesn't track the connections handed over to
+		// WebSockets.
+		c.sockets.closeAll()
 		if err := server.Shutdown(ctx); err != nil {
-			server.ErrorLog.Fatalf("Could not gracefully shutdown the server: %s\n", err)
+			server.ErrorLog.Printf("Could not gracefully shutdown the server, closing the remaining connections: %s\n", err)
+			server.Close()
+			if n := c.uploads.inFlight(); n > 0 {
+				server.ErrorLog.Printf("Cutting off %d uploads\n", n)
+			}
+			if !c.uploads.wait(uploadCleanupTimeout) {
+				server.ErrorLog.Printf("Uploads didn't end in time, partial files may be left behind\n")
+			}
 		}
 	}()
 
@@ -249,59 +1220,637 @@ func (mws middlewares) apply(hdlr http.Handler) http.Handler {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		signCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "get" {
+		getCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "encrypt" {
+		encryptCommand(os.Args[2:])
+		return
+	}
+
 	var (
 		rootDir       string
 		bindAddr      string
 		listenPort    int
 		maxUploadSize int
+		maxRequest    int64
+		maxFiles      int
+		searchDepth   int
+		searchTimeout time.Duration
+		dataDir       string
+		contentIndex  bool
+		indexInterval time.Duration
+		indexMaxSize  int64
+		scrub         bool
+		scrubEvery    time.Duration
+		quarantine    string
+		hideDotfiles  bool
+		exclude       string
+		serveIndex    bool
+		noListing     bool
+		symlinks      string
+		previewSize   int64
+		thumbnails    bool
+		thumbSize     int
+		thumbWorkers  int
+		ffmpeg        string
+		hlsJobs       int
+		stripExif     string
+		editEnabled   bool
+		editMaxSize   int64
+		deleteEnabled bool
+		h2c           bool
+		mimeTypes     string
+		mimeFile      string
+		charset       string
+		compress      bool
+		compressMin   int
+		cacheRules    cacheRules
+		policies      uploadPolicies
+		unions        unionDirs
+		hooks         webhooks
+		chats         chatNotifiers
+		audit         bool
+		journaled     bool
+		encryptKey    string
+		encryptKeyCmd string
+		adminToken    string
+		signingKey    string
+		dropBox       bool
+		usersFile     string
+		authMode      string
+		cacheSize     int64
+		cacheMaxFile  int64
+		archiveCache  int64
+		copyBufSize   int
+		watchInterval time.Duration
+		exposePort    bool
+		dlnaEnabled   bool
+		dlnaName      string
+		recentEvery   time.Duration
+		replicaTarget string
+		snapshotPaths string
+		snapshotDir   string
+		snapshotEvery time.Duration
+		snapshotKeep  int
+		workers       int
+		shutdownWait  time.Duration
+		uploadDrain   time.Duration
+		staleUploads  time.Duration
+		spoolDir      string
+		spoolMemory   int64
+		spoolMax      int64
+		quotas        quotaLimits
+		originURL     string
+		originTTL     time.Duration
+		externalURL   string
+		showQR        bool
+		indexTmpl     string
+		logPath       string
+		pidFile       string
+		asService     string
+		torrents      bool
+		trackers      string
+		stats         bool
+		useDB         bool
+		transferCap   int64
 	)
 	flag.StringVar(&rootDir, "root-dir", "/tmp/gosfs", "root directory")
+	flag.StringVar(&externalURL, "external-url", "", "URL clients reach the server at, e.g. \"https://example.com/files\" behind a reverse proxy stripping /files, used by share links, QR codes and playlists (default the address of each request)")
 	flag.StringVar(&bindAddr, "bind-addr", DefaultBindAddr, "IP address to bind")
 	flag.IntVar(&listenPort, "port", DefaultPort, "port number to listen on")
+	flag.StringVar(&logPath, "log-file", "", "file to append the log to instead of stdout, reopened on SIGUSR1 after rotation")
+	flag.StringVar(&pidFile, "pid-file", "", "file to write the process ID to, refusing to start while another process of it runs")
+	flag.StringVar(&asService, "service", "", "name of the Windows service this process is started as by the service control manager")
+	flag.BoolVar(&showQR, "qr", false, "print a QR code of the server's URL on startup, for opening it on a phone")
 	flag.IntVar(&maxUploadSize, "max-size", DefaultMaxUploadSize, "max size of uploaded file (byte)")
+	flag.Var(&quotas, "quota", "repeatable quota of each API token or IP address \"requests|downloads|uploads=max/window\", e.g. \"downloads=500/1h\"")
+	flag.Var(&unions, "union-dir", "repeatable directory merged into the root directory \"dir [write=/prefix]\", shadowed by it and earlier ones, which takes the new files below the prefix, e.g. \"/mnt/disk2 write=/photos\"")
+	flag.Var(&policies, "upload-policy", "repeatable upload policy of a directory \"/dir: max=size types=list collision=replace|rename|reject\", e.g. \"/photos: max=50M types=image/*\"")
+	flag.Int64Var(&maxRequest, "max-request-size", DefaultMaxRequestSize, "max total size of an upload request (byte)")
+	flag.IntVar(&maxFiles, "max-files", DefaultMaxUploadFiles, "max number of files per upload request")
+	flag.StringVar(&spoolDir, "spool-dir", "", "directory uploads are written to until they are complete, on the filesystem of the root directory but outside of it (default next to the uploaded files)")
+	flag.Int64Var(&spoolMemory, "spool-memory", DefaultSpoolMemory, "size up to which uploads are buffered in memory before they are written to the spool (byte)")
+	flag.Int64Var(&spoolMax, "spool-max", 0, "max disk space used by uploads in progress (byte), 0 for no limit")
+	flag.DurationVar(&staleUploads, "stale-upload-age", DefaultStaleUploadAge, "age after which the temporary files of interrupted uploads are removed, 0 to keep them")
+	flag.IntVar(&searchDepth, "search-depth", DefaultSearchDepth, "max directory depth walked by search")
+	flag.DurationVar(&searchTimeout, "search-timeout", DefaultSearchTimeout, "max duration of a single search")
+	flag.BoolVar(&hideDotfiles, "hide-dotfiles", true, "hide files and directories starting with a dot")
+	flag.StringVar(&exclude, "exclude", DefaultExclude, "comma separated name patterns to hide from clients")
+	flag.StringVar(&indexTmpl, "index-template", "", "file with a custom html/template of the listing page, see funcs.go for its functions (default the built-in page)")
+	flag.BoolVar(&serveIndex, "serve-index", false, "serve index.html of a directory instead of its listing")
+	flag.BoolVar(&noListing, "no-listing", false, "disable directory listings, directories without index.html return 404")
+	flag.StringVar(&symlinks, "follow-symlinks", SymlinksWithinRoot, "symlink policy: never, within-root or always")
+	flag.Int64Var(&previewSize, "preview-max-size", DefaultPreviewMaxSize, "max bytes of a file shown in inline previews")
+	flag.BoolVar(&thumbnails, "thumbnails", true, "generate thumbnails for images")
+	flag.IntVar(&thumbSize, "thumb-size", DefaultThumbSize, "max width and height of thumbnails (pixel)")
+	flag.IntVar(&thumbWorkers, "thumb-workers", runtime.NumCPU(), "max number of thumbnails generated at a time, out of -workers")
+	flag.StringVar(&ffmpeg, "ffmpeg", "", "path to ffmpeg, enables HLS transcoding of videos")
+	flag.IntVar(&hlsJobs, "hls-jobs", DefaultHLSJobs, "max number of concurrent HLS transcodes")
+	flag.StringVar(&stripExif, "strip-exif", "", "comma separated path prefixes whose images are served without EXIF/GPS metadata, \"/\" for all")
+	flag.BoolVar(&editEnabled, "enable-edit", false, "allow editing small text files from the browser")
+	flag.Int64Var(&editMaxSize, "edit-max-size", DefaultEditMaxSize, "max size of editable files (byte)")
+	flag.BoolVar(&deleteEnabled, "enable-delete", false, "allow deleting files and empty directories with DELETE requests, and moving them with MOVE requests")
+	flag.BoolVar(&h2c, "h2c", false, "also serve HTTP/2 over cleartext to clients with prior knowledge, e.g. gRPC clients behind a load balancer")
+	flag.StringVar(&mimeTypes, "mime-types", "", "comma separated ext=type overrides, e.g. \".log=text/plain\"")
+	flag.StringVar(&mimeFile, "mime-file", "", "mime.types style file with extra type mappings")
+	flag.StringVar(&charset, "charset", DefaultCharset, "charset added to text files without one, empty to disable")
+	flag.BoolVar(&compress, "compress", true, "compress text responses with gzip or deflate")
+	flag.IntVar(&compressMin, "compress-min-size", DefaultCompressMinSize, "min size of responses to compress (byte)")
+	flag.Var(&cacheRules, "cache-control", "repeatable Cache-Control rule \"pattern: value\", e.g. \"/assets/**: public, max-age=86400\" or \"default: no-cache\"")
+	flag.Var(&hooks, "webhook", "repeatable webhook \"url [secret=...] [events=upload,delete,move,share]\" notified of file events")
+	flag.Var(&chats, "notify-chat", "repeatable chat told about uploads below a directory \"slack webhook-url | matrix homeserver-url room=... token=... | telegram chat=... token=... [dir=/prefix]\"")
+	flag.Int64Var(&cacheSize, "file-cache-size", DefaultFileCacheSize, "memory used to cache small files (byte), 0 to disable")
+	flag.Int64Var(&cacheMaxFile, "file-cache-max-file", DefaultFileCacheMaxFile, "max size of files kept in the memory cache (byte)")
+	flag.StringVar(&originURL, "origin", "", "URL of a remote HTTP server backing the share, whose files are fetched on demand and cached in the root directory")
+	flag.DurationVar(&originTTL, "origin-ttl", DefaultOriginTTL, "age after which files cached from the origin are revalidated")
+	flag.Int64Var(&archiveCache, "archive-cache", 0, "disk space in the data directory for keeping downloaded directory archives (?archive=zip), which makes repeated downloads resumable (byte), 0 to disable")
+	flag.BoolVar(&torrents, "torrent", false, "serve .torrent files of files and directories (?torrent=1) with the server as web seed")
+	flag.StringVar(&trackers, "torrent-trackers", "", "comma separated tracker announce URLs added to torrents")
+	flag.IntVar(&copyBufSize, "copy-buffer-size", DefaultCopyBufferSize, "buffer size for copies which can't use sendfile (byte)")
+	flag.DurationVar(&watchInterval, "watch-interval", DefaultWatchInterval, "interval of polling viewed directories for live updates, 0 to disable")
+	flag.BoolVar(&audit, "audit", true, "record write operations to the audit log in the data directory")
+	flag.BoolVar(&journaled, "journal", false, "journal uploads, edits and deletions in the data directory before applying them, to complete them after a crash")
+	flag.StringVar(&encryptKey, "encrypt-key-file", "", "file of a 32 byte key, raw, hex or base64 encoded, to encrypt the contents of uploaded files on disk with, see \"gosfs encrypt\" for existing files")
+	flag.StringVar(&encryptKeyCmd, "encrypt-key-command", "", "command printing the key of -encrypt-key-file, e.g. a KMS or Vault client")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token for the admin API, which is disabled without it")
+	flag.StringVar(&signingKey, "signing-key", "", "key for verifying signed URLs, see \"gosfs sign\"")
+	flag.BoolVar(&dropBox, "drop-box", false, "only allow uploads, existing files can't be listed or downloaded")
+	flag.StringVar(&usersFile, "users", "", "file of \"name:password\" lines enabling basic authentication, passwords may be given as {SHA256}<hex>")
+	flag.Int64Var(&transferCap, "transfer-cap", 0, "monthly transfer limit of each authenticated user (byte), 0 for none")
+	flag.StringVar(&authMode, "auth", AuthWrite, "requests which need authentication when -users is set: write (anonymous read) or all")
+	flag.BoolVar(&exposePort, "expose", false, "map the port on the router via NAT-PMP or UPnP, making the server reachable from the internet; requires -users and -auth all")
+	flag.BoolVar(&dlnaEnabled, "dlna", false, "announce the media files as a DLNA/UPnP media server to TVs and consoles on the LAN; not with -auth all")
+	flag.StringVar(&dlnaName, "dlna-name", "", "name of the DLNA media server, defaults to \"gosfs on <hostname>\"")
+	flag.BoolVar(&stats, "stats", true, "record download statistics in the data directory, shown at /stats")
+	flag.BoolVar(&useDB, "db", false, "keep server state in a single database file in the data directory instead of JSON files")
+	flag.DurationVar(&recentEvery, "recent-interval", DefaultRecentInterval, "interval between rescans of the tree for the recently changed files view, 0 to disable")
+	flag.StringVar(&replicaTarget, "replicate", "", "mirror the root directory to a secondary directory or s3://bucket/prefix (credentials from the AWS_* environment variables), deleting what isn't in the root")
+	flag.StringVar(&snapshotPaths, "snapshot", "", "comma separated directories of the share to archive periodically, e.g. \"/projects,/docs\"")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "directory of the snapshot archives (default \"snapshots\" in the data directory)")
+	flag.DurationVar(&snapshotEvery, "snapshot-interval", DefaultSnapshotInterval, "interval between snapshots")
+	flag.IntVar(&snapshotKeep, "snapshot-keep", DefaultSnapshotKeep, "number of snapshots to keep")
+	flag.IntVar(&workers, "workers", defaultWorkers(), "number of background jobs, such as thumbnails, indexing and replication, run at a time")
+	flag.DurationVar(&shutdownWait, "shutdown-timeout", DefaultShutdownTimeout, "how long running requests may take to finish on shutdown")
+	flag.DurationVar(&uploadDrain, "upload-drain-timeout", DefaultUploadDrainTimeout, "how long running uploads may take to finish on shutdown, new ones are refused meanwhile")
+	flag.StringVar(&dataDir, "data-dir", "/tmp/gosfs-data", "directory for server state such as indexes and caches")
+	flag.BoolVar(&contentIndex, "content-index", false, "index text files in the background for full-text search")
+	flag.DurationVar(&indexInterval, "index-interval", DefaultIndexInterval, "interval between content index rescans")
+	flag.Int64Var(&indexMaxSize, "index-max-size", DefaultIndexMaxSize, "max size of files to index for content search (byte)")
+	flag.BoolVar(&scrub, "scrub", false, "verify the files of the share against the checksums taken on upload or by an earlier scrub, on start and then periodically, to detect bit rot")
+	flag.DurationVar(&scrubEvery, "scrub-interval", DefaultScrubInterval, "interval between scrubs, 0 to scrub on start only")
+	flag.StringVar(&quarantine, "scrub-quarantine", "", "directory outside of the share to move corrupt files to, instead of only reporting them")
 
 	flag.Parse()
 
 	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
+	var logFile *logFile
+	if logPath != "" {
+		var err error
+		if logFile, err = openLogFile(logPath); err != nil {
+			log.Fatal("Unable to open log file:", err)
+		}
+		logger.SetOutput(logFile)
+	}
 	logger.Printf("Server is starting...")
+	var serviceStop <-chan struct{}
+	if asService != "" {
+		var err error
+		if serviceStop, err = startService(asService); err != nil {
+			logger.Fatalln("Error starting service:", err)
+		}
+		defer serviceStopped()
+	}
+	if pidFile != "" {
+		if err := writePIDFile(pidFile); err != nil {
+			logger.Fatalln("Error writing PID file:", err)
+		}
+		defer os.Remove(pidFile)
+	}
 
 	if err := os.MkdirAll(rootDir, os.ModePerm); err != nil {
 		log.Fatal("Unable to create root directory:", err)
 	}
 
+	if err := validSymlinkPolicy(symlinks); err != nil {
+		log.Fatal(err)
+	}
+	if authMode != AuthWrite && authMode != AuthAll {
+		log.Fatalf("Invalid auth mode %q, expected %s or %s", authMode, AuthWrite, AuthAll)
+	}
+	if exposePort && (usersFile == "" || authMode != AuthAll) {
+		log.Fatal("Refusing to -expose without authentication, set -users and -auth all")
+	}
+	if dlnaEnabled && usersFile != "" && authMode == AuthAll {
+		log.Fatal("Refusing to -dlna with -auth all, DLNA clients can't authenticate")
+	}
+	if err := loadMimeTypes(mimeFile, mimeTypes); err != nil {
+		log.Fatal("Unable to load mime types:", err)
+	}
+	realRoot, err := filepath.EvalSymlinks(rootDir)
+	if err != nil {
+		log.Fatal("Unable to resolve root directory:", err)
+	}
+	if err := checkUnionDirs(unions, realRoot); err != nil {
+		log.Fatal("Invalid union directory: ", err)
+	}
+
+	if encryptKey != "" || encryptKeyCmd != "" {
+		// These keep what they derive from the files in the data directory,
+		// or write plain ones.
+		if originURL != "" || ffmpeg != "" || archiveCache > 0 || contentIndex || torrents {
+			log.Fatal("Refusing to encrypt files at rest with -origin, -ffmpeg, -archive-cache, -content-index or -torrent")
+		}
+		thumbnails = false
+	}
+
+	hide, err := newHideRules(hideDotfiles, exclude)
+	if err != nil {
+		log.Fatal("Invalid exclude pattern:", err)
+	}
+
 	c := &controller{
-		logger:        logger,
-		rootDir:       rootDir,
-		maxUploadSize: maxUploadSize,
-		nextRequestID: func() string { return strconv.FormatInt(time.Now().UnixNano(), 36) },
+		logger:             logger,
+		serviceStop:        serviceStop,
+		rootDir:            rootDir,
+		copier:             newCopier(copyBufSize),
+		digests:            newDigestCache(),
+		uploads:            newUploadTracker(),
+		searchDepth:        searchDepth,
+		searchTimeout:      searchTimeout,
+		hide:               hide,
+		serveIndex:         serveIndex,
+		noListing:          noListing,
+		realRoot:           realRoot,
+		unions:             unions,
+		followSymlinks:     symlinks,
+		previewMaxSize:     previewSize,
+		editMaxSize:        editMaxSize,
+		deleteEnabled:      deleteEnabled,
+		charset:            charset,
+		compressMinSize:    compressMin,
+		cacheRules:         cacheRules,
+		uploadPolicies:     policies,
+		webhooks:           hooks,
+		chats:              chats,
+		adminToken:         adminToken,
+		signingKey:         signingKey,
+		authMode:           authMode,
+		nextRequestID:      newRequestID,
+		workers:            newWorkerPool(workers),
+		active:             newActiveTransfers(),
+		sockets:            newWebSockets(),
+		maxRequestSize:     maxRequest,
+		maxUploadFiles:     maxFiles,
+		shutdownTimeout:    shutdownWait,
+		uploadDrainTimeout: uploadDrain,
+	}
+	if thumbnails {
+		c.thumbs = newThumbnailer(filepath.Join(dataDir, "thumbs"), thumbSize, thumbWorkers, c.workers)
+	}
+	if ffmpeg != "" {
+		c.transcoder = newTranscoder(ffmpeg, filepath.Join(dataDir, "hls"), hlsJobs)
+	}
+	for _, prefix := range strings.Split(stripExif, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			c.stripExif = append(c.stripExif, path.Clean("/"+prefix))
+		}
+	}
+	c.indexTemplate = indexContent
+	if indexTmpl != "" {
+		b, err := os.ReadFile(indexTmpl)
+		if err != nil {
+			logger.Fatalln("Error reading index template:", err)
+		}
+		if _, err := template.New("index").Funcs(c.templateFuncs(nil)).Parse(string(b)); err != nil {
+			logger.Fatalln("Error parsing index template:", err)
+		}
+		c.indexTemplate = string(b)
+	}
+	if c.urls, err = newURLBuilder(externalURL); err != nil {
+		logger.Fatalln("Error setting up links:", err)
+	}
+	if cacheSize > 0 {
+		c.fileCache = newFileCache(cacheSize, cacheMaxFile)
+	}
+	if originURL != "" {
+		if c.origin, err = newOrigin(c.workers.ctx, originURL, rootDir, filepath.Join(dataDir, "origin"), originTTL); err != nil {
+			logger.Fatalln("Error setting up origin:", err)
+		}
+	}
+	if archiveCache > 0 {
+		if c.archives, err = newArchiveCache(filepath.Join(dataDir, "archives"), archiveCache); err != nil {
+			logger.Fatalln("Error setting up archive cache:", err)
+		}
+	}
+	if torrents {
+		var announce []string
+		for _, t := range strings.Split(trackers, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				announce = append(announce, t)
+			}
+		}
+		if c.torrents, err = newTorrentMaker(filepath.Join(dataDir, "torrents"), announce, c.workers); err != nil {
+			logger.Fatalln("Error setting up torrents:", err)
+		}
+	}
+	if audit {
+		if c.auditLog, err = openAuditLog(dataDir); err != nil {
+			logger.Fatalln("Error opening audit log:", err)
+		}
+	}
+	if journaled {
+		if c.journal, err = openJournal(dataDir, logger); err != nil {
+			logger.Fatalln("Error opening journal:", err)
+		}
+	}
+	if encryptKey != "" || encryptKeyCmd != "" {
+		if c.atRest, err = loadAtRestKey(encryptKey, encryptKeyCmd); err != nil {
+			logger.Fatalln("Error loading encryption key:", err)
+		}
+	}
+	var store docStore = fileStore{dir: dataDir}
+	if useDB {
+		if store, err = openDB(dataDir, logger); err != nil {
+			logger.Fatalln("Error opening database:", err)
+		}
+	}
+	if len(quotas) > 0 {
+		if c.quotas, err = loadQuotas(store, quotas); err != nil {
+			logger.Fatalln("Error loading quotas:", err)
+		}
+	}
+	if usersFile != "" {
+		if c.users, err = loadUsers(usersFile); err != nil {
+			logger.Fatalln("Error loading users:", err)
+		}
+		if c.transfers, err = loadTransfers(store); err != nil {
+			logger.Fatalln("Error loading transfers:", err)
+		}
+		if c.tokens, err = loadTokens(store); err != nil {
+			logger.Fatalln("Error loading API tokens:", err)
+		}
+	}
+	flagSettings := Settings{
+		MaxUploadSize: int64(maxUploadSize),
+		TransferCap:   transferCap,
+		DropBox:       dropBox,
+		EditEnabled:   editEnabled,
+	}
+	var changed bool
+	if c.settings, changed, err = loadSettings(store, flagSettings); err != nil {
+		logger.Fatalln("Error loading settings:", err)
+	}
+	if changed {
+		logger.Printf("Settings changed through the admin API override the flags: %+v\n", c.settings.get())
+	}
+	if c.shareStore, err = loadShares(store); err != nil {
+		logger.Fatalln("Error loading shares:", err)
+	}
+	if c.meta, err = loadMetadata(store); err != nil {
+		logger.Fatalln("Error loading metadata:", err)
+	}
+	if scrub {
+		roots := []string{rootDir}
+		for _, u := range unions {
+			roots = append(roots, u.dir)
+		}
+		if c.scrubber, err = newScrubber(store, scrubEvery, quarantine, roots); err != nil {
+			logger.Fatalln("Error setting up scrub:", err)
+		}
+	}
+	if c.favoriteStore, err = loadFavorites(store); err != nil {
+		logger.Fatalln("Error loading favorites:", err)
+	}
+	if replicaTarget != "" {
+		target, err := parseReplicaTarget(replicaTarget, rootDir)
+		if err != nil {
+			logger.Fatalln("Error setting up replication:", err)
+		}
+		c.replicator = newReplicator(logger, rootDir, target, c.workers)
+	}
+	if snapshotPaths != "" {
+		if snapshotDir == "" {
+			snapshotDir = filepath.Join(dataDir, "snapshots")
+		}
+		if c.snapshotter, err = newSnapshotter(logger, rootDir, snapshotPaths, snapshotDir, snapshotEvery, snapshotKeep, c.workers); err != nil {
+			logger.Fatalln("Error setting up snapshots:", err)
+		}
+	}
+	if c.spool, err = newSpool(spoolDir, rootDir, spoolMemory, spoolMax); err != nil {
+		logger.Fatalln("Error setting up upload spool:", err)
+	}
+	if c.spool.dir != "" {
+		// Files of multipart forms parsed with ParseMultipartForm spill over
+		// to os.TempDir.
+		os.Setenv("TMPDIR", c.spool.dir)
+	}
+	if staleUploads > 0 {
+		roots := []string{rootDir}
+		for _, u := range unions {
+			roots = append(roots, u.dir)
+		}
+		if c.spool.dir != "" {
+			roots = append(roots, c.spool.dir)
+		}
+		c.janitor = newJanitor(logger, roots, staleUploads, c.workers)
+	}
+	if recentEvery > 0 {
+		c.recentIndex = newRecentIndex(rootDir, recentEvery, c.isHidden, c.workers)
+	}
+	if stats {
+		if c.stats, err = loadStats(store); err != nil {
+			logger.Fatalln("Error loading download statistics:", err)
+		}
+	}
+	if watchInterval > 0 {
+		c.watcher = newWatcher(watchInterval, c.snapshot)
+	}
+	if dlnaEnabled {
+		c.dlna = newDLNA(dlnaName, rootDir, listenPort)
+	}
+	router := newRouter()
+	router.handle("/", "GET, HEAD", c.index)
+	router.handle("/", "POST", c.formAction)
+	router.handle("/", "PUT", c.put)
+	router.handle("/", "DELETE", c.remove)
+	router.handle("/", "MOVE", c.move)
+	router.handle("/upload", "POST", c.upload)
+	router.handle("/upload/progress", "GET, HEAD", c.uploadProgress)
+	router.handle("/api/v1/upload/check", "POST", c.preflight)
+	router.handle("/healthz", "GET, HEAD", c.healthz)
+	router.handle("/thumb/", "GET, HEAD", c.thumbnail)
+	router.handle("/icons/", "GET, HEAD", c.icon)
+	router.handle("/hls/", "GET, HEAD", c.hls)
+	router.handle("/events", "GET", c.events)
+	router.handle("/api/v1/watch", "GET", c.watch)
+	router.handle("/search", "GET, HEAD", c.search)
+	router.handle("/api/v1/search", "GET, HEAD", c.search)
+	router.handle("/api/v1/search/content", "GET, HEAD", c.contentSearch)
+	router.handle("/api/v1/admin/audit", "GET, HEAD", c.adminOnly(c.auditQuery))
+	router.handle("/api/v1/shares", "GET, HEAD, POST", c.shares)
+	router.handle("/api/v1/shares/", "DELETE", c.adminOnly(c.deleteShare))
+	router.handle("/s/", "GET, HEAD, POST", c.shared)
+	router.handle("/api/v1/sign", "POST", c.adminOnly(c.sign))
+	router.handle("/qr", "GET, HEAD", c.qr)
+	router.handle("/stats", "GET, HEAD", c.statistics)
+	router.handle("/api/v1/stats", "GET, HEAD", c.statistics)
+	router.handle("/api/v1/meta", "GET, HEAD, PUT, DELETE", c.metadata)
+	router.handle("/favorites", "GET, HEAD, PUT, DELETE", c.favorites)
+	router.handle("/api/v1/favorites", "GET, HEAD, PUT, DELETE", c.favorites)
+	router.handle("/recent", "GET, HEAD", c.recent)
+	router.handle("/api/v1/recent", "GET, HEAD", c.recent)
+	router.handle("/api/v1/admin/transfers", "GET, HEAD", c.adminOnly(c.transferQuery))
+	router.handle("/api/v1/admin/quotas", "GET, HEAD", c.adminOnly(c.quotaQuery))
+	router.handle("/api/v1/admin/transfers/active", "GET, HEAD", c.adminOnly(c.adminActive))
+	router.handle("/api/v1/admin/transfers/active/", "DELETE", c.adminOnly(c.adminActive))
+	router.handle("/metrics", "GET, HEAD", c.adminOnly(c.metrics))
+	router.handle("/admin", "GET, HEAD", c.adminPage)
+	router.handle("/api/v1/admin/users", "GET, HEAD", c.adminOnly(c.adminUsers))
+	router.handle("/api/v1/admin/users/", "PUT, DELETE", c.adminOnly(c.adminUsers))
+	router.handle("/api/v1/admin/tokens", "GET, HEAD, POST", c.adminOnly(c.adminTokens))
+	router.handle("/api/v1/admin/tokens/", "DELETE", c.adminOnly(c.adminTokens))
+	router.handle("/api/v1/admin/settings", "GET, HEAD, PATCH", c.adminOnly(c.adminSettings))
+	router.handle("/api/v1/admin/snapshots", "GET, HEAD, POST", c.adminOnly(c.adminSnapshots))
+	router.handle("/api/v1/admin/jobs", "GET, HEAD", c.adminOnly(c.adminJobs))
+	if c.dlna != nil {
+		router.handle("/dlna/", "GET, HEAD", c.dlnaDescription)
+		router.handle("/dlna/control/", "POST", c.dlnaControl)
+		router.handle("/dlna/event/", "SUBSCRIBE, UNSUBSCRIBE", c.dlnaSubscribe)
 	}
-	router := http.NewServeMux()
-	router.HandleFunc("/", c.index)
-	router.HandleFunc("/upload", c.upload)
-	router.HandleFunc("/healthz", c.healthz)
 
-	listenAddr := fmt.Sprintf("%s:%d", bindAddr, listenPort)
+	mws := middlewares{c.logging, c.tracing}
+	if signingKey != "" {
+		mws = append(middlewares{c.verifySignature}, mws...)
+	}
+	if c.users != nil {
+		// Inside the signature check, which lets signed requests through
+		mws = append(middlewares{c.authenticate}, mws...)
+		// Inside authentication for the user, outside compression to
+		// account the bytes actually transferred
+		mws = append(middlewares{c.accountTransfers}, mws...)
+	}
+	if c.quotas != nil {
+		// Inside the logging to log refused requests
+		mws = append(middlewares{c.enforceQuotas}, mws...)
+	}
+	if len(cacheRules) > 0 {
+		mws = append(middlewares{c.cacheControl}, mws...)
+	}
+	if compress {
+		mws = append(middlewares{c.compress}, mws...)
+	}
+
+	listenAddr := net.JoinHostPort(bindAddr, strconv.Itoa(listenPort))
 	srv := &http.Server{
 		Addr:         listenAddr,
 		ErrorLog:     logger,
-		Handler:      (middlewares{c.tracing, c.logging}).apply(router),
+		Handler:      mws.apply(router),
 		ReadTimeout:  DefaultReadTimeout,
 		WriteTimeout: DefaultWriteTimeout,
 	}
+	if h2c {
+		// Without TLS there's no ALPN, so HTTP/2 is only spoken to clients
+		// starting with its preface; the rest keep using HTTP/1.
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
 
 	ctx := c.shutdown(context.Background(), srv)
+	if contentIndex {
+		c.indexer = newIndexer(logger, rootDir, dataDir, indexInterval, indexMaxSize, c.isHidden, c.workers)
+		go c.indexer.run(ctx)
+	}
+	if c.recentIndex != nil {
+		go c.recentIndex.run(ctx)
+	}
+	if c.replicator != nil {
+		go c.replicator.run(ctx)
+	}
+	if c.snapshotter != nil {
+		go c.snapshotter.run(ctx)
+	}
+	if c.janitor != nil {
+		go c.janitor.run(ctx)
+	}
+	if c.scrubber != nil {
+		go c.runScrub(ctx)
+	}
+	if c.stats != nil {
+		go c.stats.run(ctx, logger)
+	}
+	if c.transfers != nil {
+		go c.transfers.run(ctx, logger)
+	}
+	if c.quotas != nil {
+		go c.quotas.run(ctx, logger)
+	}
+	go c.expireShares(ctx, filepath.Join(dataDir, "expired-shares"))
+	if logFile != nil {
+		go watchReopen(ctx, logFile, logger)
+	}
+	var exposed <-chan struct{}
+	if exposePort {
+		if exposed, err = expose(ctx, logger, listenPort); err != nil {
+			logger.Fatalln("Error exposing port:", err)
+		}
+	}
+	var announced <-chan struct{}
+	if c.dlna != nil {
+		if announced, err = c.dlna.start(ctx, logger); err != nil {
+			logger.Fatalln("Error announcing DLNA media server:", err)
+		}
+	}
 	atomic.StoreInt64(&c.healthy, time.Now().UnixNano())
 
 	// Initializing the server in a goroutine so that
 	// it won't block the graceful shutdown handling below
 	go func() {
+		ln, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			logger.Fatalf("Listen: %s\n", err)
+		}
 		logger.Printf("Server is ready to handle requests at %q\n", listenAddr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		printBanner(logger.Writer(), c.urls.serverURLs(bindAddr, listenPort), showQR)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("Listen: %s\n", err)
 		}
 	}()
 
 	// Listen for the interrupt signal.
 	<-ctx.Done()
+	if exposed != nil {
+		<-exposed
+	}
+	if announced != nil {
+		<-announced
+	}
+	if !c.workers.shutdown(jobsShutdownTimeout) {
+		logger.Println("Background jobs didn't finish in time")
+	}
+	if c.stats != nil {
+		if err := c.stats.save(); err != nil {
+			logger.Println("Error saving download statistics:", err)
+		}
+	}
+	if c.transfers != nil {
+		if err := c.transfers.save(); err != nil {
+			logger.Println("Error saving transfers:", err)
+		}
+	}
+	if c.quotas != nil {
+		if err := c.quotas.save(); err != nil {
+			logger.Println("Error saving quotas:", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		logger.Println("Error closing database:", err)
+	}
 	logger.Println("Server exiting")
 }
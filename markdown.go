@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const maxReadmeSize = 256 << 10 // 256KiB
+
+// readme renders the README.md or README.txt of the directory at root, if
+// there is a visible one.
+func (c *controller) readme(r *http.Request, root, display string) template.HTML {
+	for _, name := range []string{"README.md", "README.txt"} {
+		p := filepath.Join(root, name)
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() || info.Size() > maxReadmeSize ||
+			c.isHidden(display+name, false) || !c.allowed(p) {
+			continue
+		}
+		b, err := c.atRest.readFile(p)
+		if err != nil {
+			c.log(r).Println("Error reading readme:", err)
+			return ""
+		}
+		if strings.HasSuffix(name, ".md") {
+			return renderMarkdown(string(b))
+		}
+		return template.HTML("<pre>" + html.EscapeString(string(b)) + "</pre>")
+	}
+	return ""
+}
+
+// renderMarkdown converts a practical subset of markdown to HTML: ATX
+// headings, paragraphs, fenced code blocks, lists, block quotes, rules and
+// inline code, emphasis and links. All text is escaped and only links with
+// safe schemes are emitted, so the result can be embedded as is.
+func renderMarkdown(src string) template.HTML {
+	var (
+		b     strings.Builder
+		para  []string
+		list  string // "ul" or "ol" while inside a list
+		quote []string
+	)
+	flushPara := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + renderInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	flushQuote := func() {
+		if len(quote) > 0 {
+			b.WriteString("<blockquote>" + string(renderMarkdown(strings.Join(quote, "\n"))) + "</blockquote>\n")
+			quote = nil
+		}
+	}
+	flush := func() {
+		flushPara()
+		closeList()
+		flushQuote()
+	}
+
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, ">") {
+			flushPara()
+			closeList()
+			quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(trimmed, ">"), " "))
+			continue
+		}
+		flushQuote()
+
+		switch {
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flush()
+			fence := trimmed[:3]
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case trimmed == "":
+			flush()
+		case isRule(trimmed):
+			flush()
+			b.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, "#"):
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if level > 6 || (len(trimmed) > level && trimmed[level] != ' ') {
+				para = append(para, trimmed)
+				continue
+			}
+			flush()
+			text := strings.TrimSpace(strings.TrimRight(trimmed[level:], "#"))
+			tag := "h" + string(rune('0'+level))
+			b.WriteString("<" + tag + ">" + renderInline(text) + "</" + tag + ">\n")
+		default:
+			if kind, item := listItem(trimmed); kind != "" {
+				flushPara()
+				if list != kind {
+					closeList()
+					b.WriteString("<" + kind + ">\n")
+					list = kind
+				}
+				b.WriteString("<li>" + renderInline(item) + "</li>\n")
+				continue
+			}
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	flush()
+	return template.HTML(b.String())
+}
+
+func isRule(s string) bool {
+	s = strings.ReplaceAll(s, " ", "")
+	if len(s) < 3 {
+		return false
+	}
+	for _, c := range []string{"-", "*", "_"} {
+		if strings.Trim(s, c) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+var orderedItem = regexp.MustCompile(`^\d+[.)]\s+`)
+
+// listItem returns the list kind and the item text of a list line.
+func listItem(s string) (string, string) {
+	for _, p := range []string{"- ", "* ", "+ "} {
+		if strings.HasPrefix(s, p) {
+			return "ul", s[len(p):]
+		}
+	}
+	if m := orderedItem.FindString(s); m != "" {
+		return "ol", s[len(m):]
+	}
+	return "", ""
+}
+
+var (
+	inlineCode = regexp.MustCompile("`([^`]+)`")
+	inlineLink = regexp.MustCompile(`!?\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	inlineBold = regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`)
+	inlineEm   = regexp.MustCompile(`(^|[^\w*])[*_]([^*_]+)[*_]`)
+)
+
+// renderInline escapes s and applies inline formatting. Code spans are
+// replaced by placeholders first so their content is left untouched.
+func renderInline(s string) string {
+	var codes []string
+	s = inlineCode.ReplaceAllStringFunc(s, func(m string) string {
+		codes = append(codes, "<code>"+html.EscapeString(m[1:len(m)-1])+"</code>")
+		return fmt.Sprintf("\x00%d\x00", len(codes)-1)
+	})
+	s = html.EscapeString(s)
+	s = inlineLink.ReplaceAllStringFunc(s, func(m string) string {
+		sub := inlineLink.FindStringSubmatch(m)
+		text, href := sub[1], html.UnescapeString(sub[2])
+		if !safeURL(href) {
+			return text
+		}
+		if text == "" {
+			text = html.EscapeString(href)
+		}
+		return `<a href="` + html.EscapeString(href) + `">` + text + "</a>"
+	})
+	s = inlineBold.ReplaceAllString(s, "<strong>$2</strong>")
+	s = inlineEm.ReplaceAllString(s, "$1<em>$2</em>")
+	for i, c := range codes {
+		s = strings.Replace(s, fmt.Sprintf("\x00%d\x00", i), c, 1)
+	}
+	return s
+}
+
+// safeURL only allows relative links and well known schemes.
+func safeURL(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
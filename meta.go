@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	maxTags      = 64
+	maxMetaKeys  = 64
+	maxMetaValue = 1024
+)
+
+// Metadata are the tags and key-value pairs attached to a file or
+// directory.
+type Metadata struct {
+	Tags   []string          `json:"tags"`
+	Values map[string]string `json:"values"`
+	// Encryption is the metadata of a file encrypted by the client, e.g.
+	// its original name, IV and key fingerprint, which gosfs passes through
+	// without interpreting it. Files which have it are encrypted.
+	Encryption string `json:"encryption,omitempty"`
+}
+
+func (m Metadata) empty() bool {
+	return len(m.Tags) == 0 && len(m.Values) == 0 && m.Encryption == ""
+}
+
+// normalize sorts and deduplicates the tags, which are case-insensitive,
+// and checks the limits.
+func (m *Metadata) normalize() error {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, t := range m.Tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if strings.ContainsAny(t, ",=") {
+			return fmt.Errorf("invalid tag %q, tags can't contain , or =", t)
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	if len(tags) > maxTags || len(m.Values) > maxMetaKeys {
+		return fmt.Errorf("at most %d tags and %d values are allowed", maxTags, maxMetaKeys)
+	}
+	for k, v := range m.Values {
+		if k == "" || strings.ContainsAny(k, ",=") || len(v) > maxMetaValue {
+			return fmt.Errorf("invalid value %q, keys can't be empty or contain , or = and values are limited to %d bytes", k, maxMetaValue)
+		}
+	}
+	if err := checkEncryption(m.Encryption); err != nil {
+		return err
+	}
+	m.Tags = tags
+	if m.Values == nil {
+		m.Values = map[string]string{}
+	}
+	return nil
+}
+
+// metaStore keeps the metadata of files by share-relative path, next to
+// the files rather than in extended attributes, which aren't available on
+// every file system.
+type metaStore struct {
+	store docStore
+
+	mu    sync.RWMutex
+	files map[string]Metadata
+}
+
+func loadMetadata(store docStore) (*metaStore, error) {
+	s := &metaStore{store: store, files: map[string]Metadata{}}
+	if _, err := store.load(metadataDoc, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *metaStore) get(p string) Metadata {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.files[p]
+}
+
+// set replaces the metadata of p, empty metadata remove it.
+func (s *metaStore) set(p string, m Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.empty() {
+		delete(s.files, p)
+	} else {
+		s.files[p] = m
+	}
+	return s.store.save(metadataDoc, s.files)
+}
+
+// move moves the metadata of from to to, and for directories that of the
+// files in them, replacing the metadata of the file replaced.
+func (s *metaStore) move(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fromDir, toDir := strings.TrimSuffix(from, "/"), strings.TrimSuffix(to, "/")
+	_, moved := s.files[toDir]
+	delete(s.files, toDir)
+	for p, m := range s.files {
+		switch {
+		case p == fromDir:
+			delete(s.files, p)
+			s.files[toDir] = m
+		case strings.HasPrefix(p, fromDir+"/"):
+			delete(s.files, p)
+			s.files[toDir+strings.TrimPrefix(p, fromDir)] = m
+		default:
+			continue
+		}
+		moved = true
+	}
+	if !moved {
+		return nil
+	}
+	return s.store.save(metadataDoc, s.files)
+}
+
+// matchMeta reports whether m carries all tags and values of the filter.
+func (f listFilter) matchMeta(m Metadata) bool {
+	for _, want := range f.Tags {
+		found := false
+		for _, t := range m.Tags {
+			if t == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range f.Meta {
+		if got, ok := m.Values[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// metadata returns (GET), replaces (PUT) or removes (DELETE) the metadata
+// of the file or directory given by the path parameter.
+func (c *controller) metadata(w http.ResponseWriter, r *http.Request) {
+	if !c.readable(r) {
+		http.NotFound(w, r)
+		return
+	}
+	rel, ok := c.entryParam(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodDelete:
+		var m Metadata
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(&m); err != nil {
+				http.Error(w, "invalid metadata: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := m.normalize(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := c.meta.set(rel, m); err != nil {
+			c.internalError(w, r, "Error saving metadata:", err)
+			return
+		}
+		c.audit(w, r, ActionTag, rel)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m := c.meta.get(rel)
+	m.normalize()
+	w.Header().Set("Cache-Control", "no-cache")
+	c.writeJSON(w, r, m)
+}
+
+// entryParam returns the share path of the existing file or directory
+// given by the path parameter, directories with a trailing slash. It
+// answers 404 for anything the client can't see.
+func (c *controller) entryParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	rel := path.Clean("/" + r.URL.Query().Get("path"))
+	p := c.fsPath(rel)
+	info, err := os.Stat(p)
+	if err != nil || c.isHidden(rel, info.IsDir()) || !c.allowed(p) {
+		http.Error(w, "no such file or directory", http.StatusNotFound)
+		return "", false
+	}
+	if info.IsDir() && rel != "/" {
+		rel += "/"
+	}
+	return rel, true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// sample is a value of a metric, with the values of its labels.
+type sample struct {
+	labels []string
+	value  int64
+}
+
+// writeMetric writes a metric family in the Prometheus text format.
+func writeMetric(w io.Writer, name, typ, help string, labels []string, samples []sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		pairs := make([]string, len(labels))
+		for i, l := range labels {
+			pairs[i] = l + `="` + labelEscaper.Replace(s.labels[i]) + `"`
+		}
+		if len(pairs) == 0 {
+			fmt.Fprintf(w, "%s %d\n", name, s.value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, strings.Join(pairs, ","), s.value)
+		}
+	}
+}
+
+// metrics exposes the server's counters to Prometheus.
+func (c *controller) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if c.transfers != nil {
+		var total, month []sample
+		thisMonth := time.Now().UTC().Format(monthFormat)
+		for _, t := range c.transfers.list("", "") {
+			// Transfers are ordered by user, so the totals of a user are
+			// summed up in the last two samples.
+			if n := len(total); n == 0 || total[n-1].labels[0] != t.User {
+				total = append(total,
+					sample{labels: []string{t.User, "upload"}},
+					sample{labels: []string{t.User, "download"}})
+			}
+			total[len(total)-2].value += t.Uploaded
+			total[len(total)-1].value += t.Downloaded
+			if t.Month == thisMonth {
+				month = append(month, sample{labels: []string{t.User}, value: t.Uploaded + t.Downloaded})
+			}
+		}
+		writeMetric(w, "gosfs_user_transfer_bytes_total", "counter", "Bytes transferred by authenticated users.",
+			[]string{"user", "direction"}, total)
+		writeMetric(w, "gosfs_user_transfer_month_bytes", "gauge", "Bytes transferred by authenticated users this month.",
+			[]string{"user"}, month)
+		if limit := c.settings.get().TransferCap; limit > 0 {
+			writeMetric(w, "gosfs_user_transfer_cap_bytes", "gauge", "Monthly transfer cap of each user.",
+				nil, []sample{{value: limit}})
+		}
+	}
+	active, _ := c.workers.jobs()
+	states := map[string]int64{JobQueued: 0, JobRunning: 0}
+	for _, job := range active {
+		states[job.State]++
+	}
+	writeMetric(w, "gosfs_jobs", "gauge", "Background jobs queued or running.",
+		[]string{"state"}, []sample{{[]string{JobQueued}, states[JobQueued]}, {[]string{JobRunning}, states[JobRunning]}})
+	writeMetric(w, "gosfs_jobs_total", "counter", "Background jobs finished, by kind and final state.",
+		[]string{"kind", "state"}, c.workers.totalSamples())
+	kinds := map[string]int64{}
+	for _, t := range c.active.list() {
+		kinds[t.Kind]++
+	}
+	writeMetric(w, "gosfs_active_transfers", "gauge", "Uploads and downloads in progress.",
+		[]string{"kind"}, []sample{{[]string{TransferDownload}, kinds[TransferDownload]}, {[]string{TransferUpload}, kinds[TransferUpload]}})
+	if c.replicator != nil {
+		writeMetric(w, "gosfs_replication_queued", "gauge", "Writes waiting to be replicated.",
+			nil, []sample{{value: int64(len(c.replicator.queue))}})
+		writeMetric(w, "gosfs_replication_failures_total", "counter", "Writes which couldn't be replicated.",
+			nil, []sample{{value: atomic.LoadInt64(&c.replicator.failures)}})
+	}
+	if c.quotas != nil {
+		writeMetric(w, "gosfs_quota_rejected_total", "counter", "Requests refused with 429 because a client used up a quota.",
+			[]string{"kind"}, c.quotas.rejectedSamples())
+	}
+	if c.spool.max > 0 {
+		writeMetric(w, "gosfs_upload_spool_bytes", "gauge", "Disk space used by uploads in progress, out of -spool-max.",
+			nil, []sample{{value: c.spool.usage()}})
+	}
+	if c.janitor != nil {
+		writeMetric(w, "gosfs_stale_uploads_removed_total", "counter", "Temporary files of interrupted uploads removed.",
+			nil, []sample{{value: atomic.LoadInt64(&c.janitor.removed)}})
+		writeMetric(w, "gosfs_stale_uploads_reclaimed_bytes_total", "counter", "Disk space reclaimed from interrupted uploads.",
+			nil, []sample{{value: atomic.LoadInt64(&c.janitor.reclaimed)}})
+	}
+	if c.scrubber != nil {
+		writeMetric(w, "gosfs_scrub_verified_files_total", "counter", "Files a scrub found matching their checksums.",
+			nil, []sample{{value: atomic.LoadInt64(&c.scrubber.verified)}})
+		writeMetric(w, "gosfs_scrub_corrupt_files_total", "counter", "Files a scrub found corrupt or unreadable.",
+			nil, []sample{{value: atomic.LoadInt64(&c.scrubber.corrupt)}})
+		writeMetric(w, "gosfs_scrub_quarantined_files_total", "counter", "Corrupt files moved to -scrub-quarantine.",
+			nil, []sample{{value: atomic.LoadInt64(&c.scrubber.quarantined)}})
+	}
+}
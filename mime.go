@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"strings"
+)
+
+const DefaultCharset = "utf-8"
+
+// extraMimeTypes fill gaps in Go's built-in table for common formats. They
+// are only used when neither the system nor the operator defined a type.
+var extraMimeTypes = map[string]string{
+	".md":   "text/markdown",
+	".log":  "text/plain",
+	".conf": "text/plain",
+	".ini":  "text/plain",
+	".yaml": "text/yaml",
+	".yml":  "text/yaml",
+	".toml": "text/plain",
+	".csv":  "text/csv",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".m3u":  "audio/x-mpegurl",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".tar":  "application/x-tar",
+	".7z":   "application/x-7z-compressed",
+	".epub": "application/epub+zip",
+	".iso":  "application/x-iso9660-image",
+}
+
+// loadMimeTypes registers the extra types, then the operator's overrides
+// from a mime.types style file ("type ext1 ext2 ...") and from a comma
+// separated list of ext=type pairs, the latter taking precedence.
+func loadMimeTypes(file, spec string) error {
+	for ext, typ := range extraMimeTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, typ)
+		}
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			for _, ext := range fields[1:] {
+				if err = addMimeType(ext, fields[0]); err != nil {
+					return err
+				}
+			}
+		}
+		if err = sc.Err(); err != nil {
+			return err
+		}
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid mime type mapping %q, expected ext=type", pair)
+		}
+		if err := addMimeType(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addMimeType(ext, typ string) error {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if err := mime.AddExtensionType(strings.ToLower(ext), typ); err != nil {
+		return fmt.Errorf("invalid mime type %q for %s: %w", typ, ext, err)
+	}
+	return nil
+}
+
+// contentType returns the Content-Type for name, adding the default charset
+// to text types which don't specify one. It returns an empty string for
+// unknown extensions, leaving the decision to content sniffing.
+func (c *controller) contentType(name string) string {
+	typ := mime.TypeByExtension(path.Ext(name))
+	if typ == "" || c.charset == "" {
+		return typ
+	}
+	mediaType, params, err := mime.ParseMediaType(typ)
+	if err != nil || !strings.HasPrefix(mediaType, "text/") || params["charset"] != "" {
+		return typ
+	}
+	params["charset"] = c.charset
+	return mime.FormatMediaType(mediaType, params)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOriginTTL = 10 * time.Minute
+	// originHeaderTimeout bounds the wait for the origin's response, not the
+	// download of large files.
+	originHeaderTimeout = 30 * time.Second
+)
+
+var errOriginNotFound = errors.New("not found at the origin")
+
+// originEntry holds the validators of a file fetched from the origin.
+type originEntry struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checked      time.Time `json:"checked"`
+}
+
+type originCall struct {
+	done chan struct{}
+	err  error
+}
+
+// origin backs the share with a remote HTTP server, making gosfs a caching
+// mirror of it. Files missing from rootDir are fetched from the origin and
+// stored there, files fetched earlier are revalidated with conditional
+// requests once they are older than ttl. Files which didn't come from the
+// origin are left alone. Concurrent requests for a file share one fetch.
+type origin struct {
+	base   *url.URL
+	root   string
+	dir    string // validators, by hashed share path
+	ttl    time.Duration
+	client *http.Client
+	ctx    context.Context // of the fetches, which outlive their requests
+
+	mu       sync.Mutex
+	inflight map[string]*originCall
+}
+
+func newOrigin(ctx context.Context, rawURL, root, dir string, ttl time.Duration) (*origin, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid origin url %q", rawURL)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = originHeaderTimeout
+	return &origin{
+		base:     base,
+		root:     root,
+		dir:      dir,
+		ttl:      ttl,
+		client:   &http.Client{Transport: transport},
+		ctx:      ctx,
+		inflight: map[string]*originCall{},
+	}, nil
+}
+
+func (o *origin) entryPath(p string) string {
+	sum := sha1.Sum([]byte(p))
+	return filepath.Join(o.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (o *origin) load(p string) (originEntry, bool) {
+	var e originEntry
+	b, err := os.ReadFile(o.entryPath(p))
+	if err != nil || json.Unmarshal(b, &e) != nil {
+		return e, false
+	}
+	return e, true
+}
+
+func (o *origin) save(p string, e originEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(o.entryPath(p), b, 0o644)
+}
+
+// sync makes sure that the file at the share path p, stored at file, is
+// the origin's current one, as far as the ttl goes. It returns
+// errOriginNotFound if the origin doesn't have it.
+func (o *origin) sync(tc traceContext, p, file string) error {
+	_, err := os.Stat(file)
+	entry, fetched := o.load(p)
+	switch {
+	case err == nil && !fetched:
+		// A local file
+		return nil
+	case err == nil && time.Since(entry.Checked) < o.ttl:
+		return nil
+	}
+
+	o.mu.Lock()
+	call, ok := o.inflight[p]
+	if !ok {
+		call = &originCall{done: make(chan struct{})}
+		o.inflight[p] = call
+	}
+	o.mu.Unlock()
+	if !ok {
+		go func() {
+			call.err = o.fetch(tc, p, file)
+			o.mu.Lock()
+			delete(o.inflight, p)
+			o.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	<-call.done
+	return call.err
+}
+
+// fetch downloads the file from the origin, unless the copy at file is
+// still valid.
+func (o *origin) fetch(tc traceContext, p, file string) error {
+	u := *o.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = ""
+	req, err := http.NewRequestWithContext(o.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Traceparent", tc.child().traceparent())
+	entry, fetched := o.load(p)
+	if _, err := os.Stat(file); err == nil && fetched {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		entry.Checked = time.Now()
+		return o.save(p, entry)
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		if fetched {
+			// Gone from the origin, so from the mirror as well.
+			os.Remove(file)
+			os.Remove(o.entryPath(p))
+		}
+		return errOriginNotFound
+	default:
+		return fmt.Errorf("origin responded %s for %s", resp.Status, p)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".origin-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.ReadFrom(resp.Body)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("fetching %s from the origin: %w", p, err)
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(tmp.Name(), t, t)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	return o.save(p, originEntry{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Checked:      time.Now(),
+	})
+}
+
+// fromOrigin syncs the file requested by r with the origin, responding
+// with an error if it can't be served. A stale copy is served while the
+// origin is unreachable.
+func (c *controller) fromOrigin(w http.ResponseWriter, r *http.Request, file string) bool {
+	err := c.origin.sync(trace(r), r.URL.Path, file)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errOriginNotFound):
+		http.NotFound(w, r)
+		return false
+	}
+	if _, serr := os.Stat(file); serr == nil {
+		c.log(r).Println("Serving cached copy, the origin failed:", err)
+		return true
+	}
+	c.log(r).Println("Error fetching from origin:", err)
+	http.Error(w, "the origin server is unavailable", http.StatusBadGateway)
+	return false
+}
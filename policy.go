@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+// Collision policies for uploads of files which exist already.
+const (
+	CollisionReplace = "replace"
+	CollisionRename  = "rename"
+	CollisionReject  = "reject"
+)
+
+// uploadPolicy overrides the upload settings for the files uploaded into
+// dir and the directories below it.
+type uploadPolicy struct {
+	dir     string // share path, with a trailing slash
+	maxSize int64  // 0 for the max-size setting
+	// types are MIME types, type/* wildcards, extensions such as .iso or
+	// kinds such as image, see fileKind; none allow any file.
+	types     []string
+	collision string // empty for the default, replace
+	// fields are required form fields, see UploadField.
+	fields []string
+}
+
+// uploadPolicies is a repeatable flag of "dir: key=value ..." policies. The
+// policy of the deepest directory containing an upload applies.
+type uploadPolicies []uploadPolicy
+
+func (policies *uploadPolicies) String() string {
+	var s []string
+	for _, p := range *policies {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, "; ")
+}
+
+func (p uploadPolicy) String() string {
+	s := p.dir + ":"
+	if p.maxSize > 0 {
+		s += fmt.Sprintf(" max=%d", p.maxSize)
+	}
+	if len(p.types) > 0 {
+		s += " types=" + strings.Join(p.types, ",")
+	}
+	if p.collision != "" {
+		s += " collision=" + p.collision
+	}
+	if len(p.fields) > 0 {
+		s += " fields=" + strings.Join(p.fields, ",")
+	}
+	return s
+}
+
+func (policies *uploadPolicies) Set(v string) error {
+	invalid := fmt.Errorf("invalid upload policy %q, expected \"/dir: max=50M types=image/*,.iso collision=replace|rename|reject fields=ticket,name\"", v)
+	i := strings.Index(v, ":")
+	if i < 0 {
+		return invalid
+	}
+	dir, fields := strings.TrimSpace(v[:i]), strings.Fields(v[i+1:])
+	if !strings.HasPrefix(dir, "/") || len(fields) == 0 {
+		return invalid
+	}
+	p := uploadPolicy{dir: strings.TrimSuffix(path.Clean(dir), "/") + "/"}
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return invalid
+		}
+		switch kv[0] {
+		case "max":
+			n, err := parseSize(kv[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid max size in upload policy %q", v)
+			}
+			p.maxSize = n
+		case "types":
+			for _, t := range strings.Split(strings.ToLower(kv[1]), ",") {
+				if !strings.HasPrefix(t, ".") && !strings.Contains(t, "/") && !containsString(kinds, t) {
+					return fmt.Errorf("invalid type %q in upload policy %q, expected a MIME type, an extension or a kind", t, v)
+				}
+				p.types = append(p.types, t)
+			}
+		case "collision":
+			if kv[1] != CollisionReplace && kv[1] != CollisionRename && kv[1] != CollisionReject {
+				return fmt.Errorf("invalid collision policy in upload policy %q, expected %s, %s or %s",
+					v, CollisionReplace, CollisionRename, CollisionReject)
+			}
+			p.collision = kv[1]
+		case "fields":
+			for _, name := range strings.Split(strings.ToLower(kv[1]), ",") {
+				if err := checkFieldName(name); err != nil {
+					return fmt.Errorf("%v in upload policy %q", err, v)
+				}
+				p.fields = append(p.fields, name)
+			}
+		default:
+			return invalid
+		}
+	}
+	*policies = append(*policies, p)
+	return nil
+}
+
+// lookup returns the policy for a file at the share path p, the zero
+// policy if none applies.
+func (policies uploadPolicies) lookup(p string) uploadPolicy {
+	var found uploadPolicy
+	for _, policy := range policies {
+		if strings.HasPrefix(p, policy.dir) && len(policy.dir) > len(found.dir) {
+			found = policy
+		}
+	}
+	return found
+}
+
+// allows reports whether files with the given name may be uploaded, which
+// is decided by their extension.
+func (p uploadPolicy) allows(name string) bool {
+	if len(p.types) == 0 {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(name))
+	typ, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	for _, t := range p.types {
+		switch {
+		case strings.HasPrefix(t, "."):
+			if ext == t {
+				return true
+			}
+		case !strings.Contains(t, "/"):
+			if fileKind(name, false) == t {
+				return true
+			}
+		case strings.HasSuffix(t, "/*"):
+			if typ != "" && strings.HasPrefix(typ, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		case typ == t:
+			return true
+		}
+	}
+	return false
+}
+
+func (p uploadPolicy) typeError(name string) string {
+	return fmt.Sprintf("type of %s not allowed in %s, expected %s", path.Base(name), p.dir, strings.Join(p.types, ", "))
+}
+
+// uploadPolicy returns the policy for uploading the file at the share path
+// p, completed with the settings. With keep, existing files are never
+// replaced, whatever the policy says.
+func (c *controller) uploadPolicy(p string, keep bool) uploadPolicy {
+	policy := c.uploadPolicies.lookup(p)
+	if policy.maxSize == 0 {
+		policy.maxSize = c.settings.get().MaxUploadSize
+	}
+	switch {
+	case keep:
+		policy.collision = CollisionRename
+	case policy.collision == "":
+		policy.collision = CollisionReplace
+	}
+	return policy
+}
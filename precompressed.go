@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sidecars are the precompressed variants looked for next to a file, in
+// order of preference.
+var sidecars = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != coding && name != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// servePrecompressed serves foo.br or foo.gz in place of foo when such a
+// sidecar exists and the client accepts its encoding. It reports whether a
+// response was written.
+func (c *controller) servePrecompressed(w http.ResponseWriter, r *http.Request, p string) bool {
+	found := false
+	for _, sc := range sidecars {
+		sp := p + sc.ext
+		info, err := os.Stat(sp)
+		if err != nil || !info.Mode().IsRegular() || !c.allowed(sp) {
+			continue
+		}
+		found = true
+		if !acceptsEncoding(r, sc.encoding) {
+			continue
+		}
+		f, err := os.Open(sp)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		h := w.Header()
+		addVary(h, "Accept-Encoding")
+		if h.Get("Content-Type") == "" {
+			// The type of the original, not of the compressed sidecar.
+			h.Set("Content-Type", sniffType(p))
+		}
+		h.Set("Content-Encoding", sc.encoding)
+		http.ServeContent(w, r, filepath.Base(p), info.ModTime(), f)
+		return true
+	}
+	if found {
+		// Caches must keep the variants apart even when serving the original.
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	return false
+}
+
+// sniffType detects the content type of the file at p from its first bytes.
+func sniffType(p string) string {
+	f, err := os.Open(p)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := f.Read(buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// addVary adds field to the Vary header unless it is listed already.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
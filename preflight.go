@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Verdicts of upload pre-flight checks.
+const (
+	VerdictOK          = "ok"
+	VerdictOverwrite   = "overwrite"    // an existing file would be replaced
+	VerdictRename      = "rename"       // the file would get a unique name
+	VerdictConflict    = "conflict"     // an existing file would be kept
+	VerdictTooLarge    = "too_large"    // a limit would cut the upload off
+	VerdictTypeBlocked = "type_blocked" // the upload policy refuses the type
+	VerdictForbidden   = "forbidden"    // hidden or not accessible
+)
+
+// maxPreflightRequest bounds the body of pre-flight checks.
+const maxPreflightRequest = 1 << 20
+
+type preflightRequest struct {
+	Dir   string          `json:"dir"`
+	Files []preflightFile `json:"files"`
+}
+
+type preflightFile struct {
+	Name string `json:"name"` // relative to the directory, folders included
+	Size int64  `json:"size"`
+}
+
+type preflightResult struct {
+	Name    string `json:"name"`
+	Verdict string `json:"verdict"`
+	Error   string `json:"error,omitempty"`
+	Limit   string `json:"limit,omitempty"`
+	Max     int64  `json:"max,omitempty"`
+}
+
+type preflightResponse struct {
+	// OK is whether all files would be stored, possibly replacing others.
+	OK    bool              `json:"ok"`
+	Files []preflightResult `json:"files"`
+}
+
+// preflight checks uploads declared by their names and sizes before they
+// are sent, so that clients can warn about files which would be replaced
+// or refused, instead of finding out gigabytes later. Files are checked in
+// order against the same limits and policies as an upload of all of them
+// in one request.
+func (c *controller) preflight(w http.ResponseWriter, r *http.Request) {
+	var req preflightRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPreflightRequest)).Decode(&req); err != nil {
+		http.Error(w, "invalid pre-flight request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	display := path.Clean("/" + req.Dir)
+	dir := c.fsPath(display)
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() || c.isHidden(display, true) || !c.allowed(dir) {
+		http.Error(w, "no such directory", http.StatusNotFound)
+		return
+	}
+
+	// In drop box mode, whether files exist is none of the uploader's business.
+	keep := c.settings.get().DropBox
+	resp := preflightResponse{OK: true, Files: make([]preflightResult, 0, len(req.Files))}
+	var total int64
+	for i, f := range req.Files {
+		res := c.preflightFile(dir, f, keep)
+		total += f.Size
+		if res.accepted() {
+			switch {
+			case i >= c.maxUploadFiles:
+				res = preflightLimit(f.Name, uploadLimitError{LimitFiles, int64(c.maxUploadFiles)})
+			case total > c.maxRequestSize:
+				res = preflightLimit(f.Name, uploadLimitError{LimitRequestSize, c.maxRequestSize})
+			}
+		}
+		resp.OK = resp.OK && res.accepted()
+		resp.Files = append(resp.Files, res)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	c.writeJSON(w, r, resp)
+}
+
+// preflightFile checks a file on its own, against the upload policy of its
+// directory and the file it would replace.
+func (c *controller) preflightFile(dir string, f preflightFile, keep bool) preflightResult {
+	res := preflightResult{Name: f.Name, Verdict: VerdictOK}
+	name := strings.Trim(path.Clean("/"+f.Name), "/")
+	if strings.Contains(f.Name, "\\") || name == "" || f.Size < 0 {
+		res.Verdict, res.Error = VerdictForbidden, "invalid upload path"
+		return res
+	}
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if len(c.unions) > 0 {
+		if display, err := c.relPath(dir, true); err == nil {
+			target = c.fsPath(display + name)
+		}
+	}
+	rel, err := c.relPath(target, false)
+	if err != nil || c.isHidden(rel, false) || !c.allowed(target) {
+		res.Verdict, res.Error = VerdictForbidden, "target is not accessible"
+		return res
+	}
+	policy := c.uploadPolicy(rel, keep)
+	switch {
+	case !policy.allows(name):
+		res.Verdict, res.Error = VerdictTypeBlocked, policy.typeError(name)
+		return res
+	case f.Size > policy.maxSize:
+		return preflightLimit(f.Name, uploadLimitError{LimitFileSize, policy.maxSize})
+	case keep:
+		return res
+	}
+	info, err := os.Stat(target)
+	switch {
+	case err != nil:
+	case info.IsDir():
+		res.Verdict, res.Error = VerdictConflict, "a directory exists at "+rel
+	case policy.collision == CollisionReject:
+		res.Verdict, res.Error = VerdictConflict, "file exists: "+rel
+	case policy.collision == CollisionRename:
+		res.Verdict = VerdictRename
+	default:
+		res.Verdict = VerdictOverwrite
+	}
+	return res
+}
+
+// accepted reports whether the file would be stored.
+func (res preflightResult) accepted() bool {
+	return res.Verdict == VerdictOK || res.Verdict == VerdictOverwrite || res.Verdict == VerdictRename
+}
+
+func preflightLimit(name string, err uploadLimitError) preflightResult {
+	return preflightResult{Name: name, Verdict: VerdictTooLarge, Error: err.Error(), Limit: err.limit, Max: err.max}
+}
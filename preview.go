@@ -0,0 +1,79 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const DefaultPreviewMaxSize = 1 << 20 // 1MiB
+
+//go:embed preview.html
+var previewContent string
+
+var previewTemplate = template.Must(template.New("preview").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(previewContent))
+
+type Preview struct {
+	Name      string
+	Link      string
+	Parent    string
+	Size      string
+	Shown     string
+	Truncated bool
+	Edit      string
+	Lines     []template.HTML
+}
+
+// preview renders a text file inline with line numbers and highlighting.
+// Files which don't look like text are served as is.
+func (c *controller) preview(w http.ResponseWriter, r *http.Request, p string, info fs.FileInfo) {
+	f, err := c.atRest.open(p)
+	if err != nil {
+		c.internalError(w, r, "Error opening file for preview:", err)
+		return
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, c.previewMaxSize))
+	if err != nil {
+		c.internalError(w, r, "Error reading file for preview:", err)
+		return
+	}
+	if len(b) > 0 && !isText(b) {
+		c.serveFile(w, r, p)
+		return
+	}
+	src := string(b)
+	truncated := info.Size() > int64(len(b))
+	if truncated {
+		// Drop a partial multi-byte character at the cut.
+		src = strings.ToValidUTF8(src, "")
+	}
+
+	pv := Preview{
+		Name:      info.Name(),
+		Link:      (&url.URL{Path: r.URL.Path}).String(),
+		Parent:    (&url.URL{Path: path.Dir(r.URL.Path)}).String(),
+		Size:      formatBytes(info.Size()),
+		Shown:     formatBytes(int64(len(b))),
+		Truncated: truncated,
+	}
+	if pv.Parent != "/" {
+		pv.Parent += "/"
+	}
+	if c.settings.get().EditEnabled && info.Size() <= c.editMaxSize {
+		pv.Edit = pv.Link + "?edit=1"
+	}
+	for _, line := range highlight(info.Name(), src) {
+		pv.Lines = append(pv.Lines, template.HTML(line))
+	}
+	if err = previewTemplate.Execute(w, pv); err != nil {
+		c.internalError(w, r, "Error rendering preview page:", err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	UploadReceiving = "receiving"
+	UploadDone      = "done"
+	UploadFailed    = "failed"
+
+	// uploadRetention is how long finished uploads can still be queried.
+	uploadRetention = 5 * time.Minute
+	progressPeriod  = 500 * time.Millisecond
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// UploadProgress is the state of an upload as seen by the server.
+type UploadProgress struct {
+	ID       string `json:"id"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"` // -1 when unknown
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+
+	finished time.Time
+}
+
+// uploadTracker keeps the progress of running and recently finished uploads.
+type uploadTracker struct {
+	mu      sync.Mutex
+	uploads map[string]*UploadProgress
+
+	// inflight counts the uploads being received or stored, which the
+	// shutdown lets finish. No uploads are begun once draining.
+	inflight sync.WaitGroup
+	active   int
+	draining bool
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{uploads: map[string]*UploadProgress{}}
+}
+
+func (t *uploadTracker) start(id string, total int64) *UploadProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Finished uploads are dropped lazily, there are few of them.
+	for k, p := range t.uploads {
+		if !p.finished.IsZero() && time.Since(p.finished) > uploadRetention {
+			delete(t.uploads, k)
+		}
+	}
+	p := &UploadProgress{ID: id, Total: total, State: UploadReceiving}
+	t.uploads[id] = p
+	return p
+}
+
+// begin registers an upload, unless the server is draining.
+func (t *uploadTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.active++
+	t.inflight.Add(1)
+	return true
+}
+
+func (t *uploadTracker) end() {
+	t.mu.Lock()
+	t.active--
+	t.mu.Unlock()
+	t.inflight.Done()
+}
+
+// drain refuses new uploads.
+func (t *uploadTracker) drain() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+}
+
+func (t *uploadTracker) inFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// wait waits up to timeout for the uploads in flight to end, reporting
+// whether they did.
+func (t *uploadTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *uploadTracker) get(id string) (UploadProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.uploads[id]
+	if !ok {
+		return UploadProgress{}, false
+	}
+	return *p, true
+}
+
+func (t *uploadTracker) update(p *UploadProgress, fn func(p *UploadProgress)) {
+	if p == nil {
+		return
+	}
+	t.mu.Lock()
+	fn(p)
+	t.mu.Unlock()
+}
+
+// finish records the outcome of an upload from its response status.
+func (t *uploadTracker) finish(p *UploadProgress, status int) {
+	t.update(p, func(p *UploadProgress) {
+		p.finished = time.Now()
+		if status >= 400 {
+			p.State = UploadFailed
+			if p.Error == "" {
+				p.Error = http.StatusText(status)
+			}
+		} else {
+			p.State = UploadDone
+		}
+	})
+}
+
+// progressReader counts the bytes read from a request body.
+type progressReader struct {
+	io.ReadCloser
+	tracker  *uploadTracker
+	progress *UploadProgress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(b)
+	pr.tracker.update(pr.progress, func(p *UploadProgress) {
+		p.Received += int64(n)
+	})
+	return n, err
+}
+
+// statusRecorder remembers the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection under sr.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile working for the files served through sr.
+func (sr *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := sr.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{sr.ResponseWriter}, src)
+	}
+	sr.written += n
+	return n, err
+}
+
+// uploadID returns the client chosen upload ID of r, or a new one.
+func uploadID(r *http.Request) (string, error) {
+	id := r.URL.Query().Get("upload_id")
+	if id == "" {
+		id = r.Header.Get("X-Upload-Id")
+	}
+	if id != "" {
+		if !uploadIDPattern.MatchString(id) {
+			return "", fmt.Errorf("invalid upload id %q", id)
+		}
+		return id, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// uploadProgress reports the progress of the upload given by the id
+// parameter, once as JSON or continuously as Server-Sent Events until the
+// upload has finished.
+func (c *controller) uploadProgress(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	p, ok := c.uploads.get(id)
+	if !ok {
+		http.Error(w, "unknown upload", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Cache-Control", "no-store")
+		c.writeJSON(w, r, p)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(progressPeriod)
+	defer ticker.Stop()
+	timeout := time.NewTimer(eventStreamDuration)
+	defer timeout.Stop()
+	for {
+		b, err := json.Marshal(p)
+		if err != nil {
+			c.log(r).Println("Error encoding upload progress:", err)
+			return
+		}
+		fmt.Fprintf(w, "event: progress\ndata: %s\n\n", b)
+		flusher.Flush()
+		if p.State == UploadDone || p.State == UploadFailed {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		p, _ = c.uploads.get(id)
+	}
+}
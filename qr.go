@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The QR encoder below supports byte mode with error correction level M
+// in versions 1 to 10, which fits links of up to 213 bytes.
+
+// qrBlocks describes the error correction blocks of a version: the EC
+// codewords per block, then count and data codewords of both block groups.
+var qrBlocks = [...][5]int{
+	1:  {10, 1, 16, 0, 0},
+	2:  {16, 1, 28, 0, 0},
+	3:  {26, 1, 44, 0, 0},
+	4:  {18, 2, 32, 0, 0},
+	5:  {24, 2, 43, 0, 0},
+	6:  {16, 4, 27, 0, 0},
+	7:  {18, 4, 31, 0, 0},
+	8:  {22, 2, 38, 2, 39},
+	9:  {22, 3, 36, 2, 37},
+	10: {26, 4, 43, 1, 44},
+}
+
+var qrAlignment = [...][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+var errQRTooLong = errors.New("text is too long for a QR code")
+
+// qrCode is a square matrix of modules, true being dark.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// encodeQR encodes text in the smallest version it fits in.
+func encodeQR(text []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v < len(qrBlocks); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	// Build the bit stream: byte mode, length, data, terminator and padding.
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	put(0b0100, 4)
+	if version >= 10 {
+		put(len(text), 16)
+	} else {
+		put(len(text), 8)
+	}
+	for _, b := range text {
+		put(int(b), 8)
+	}
+	capacity := 8 * qrDataCodewords(version)
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		put(pad, 8)
+	}
+	data := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			data[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	q := newQRCode(version)
+	q.place(qrInterleave(version, data))
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // undo
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+func qrDataCodewords(version int) int {
+	b := qrBlocks[version]
+	return b[1]*b[2] + b[3]*b[4]
+}
+
+// qrInterleave splits data into blocks, appends the error correction
+// codewords of each and interleaves them.
+func qrInterleave(version int, data []byte) []byte {
+	b := qrBlocks[version]
+	ecLen := b[0]
+	gen := rsGenerator(ecLen)
+	var blocks, ecs [][]byte
+	for g := 0; g < 2; g++ {
+		for i := 0; i < b[1+2*g]; i++ {
+			n := b[2+2*g]
+			blocks = append(blocks, data[:n])
+			ecs = append(ecs, rsRemainder(data[:n], gen))
+			data = data[n:]
+		}
+	}
+	var out []byte
+	for i := 0; ; i++ {
+		done := true
+		for _, blk := range blocks {
+			if i < len(blk) {
+				out = append(out, blk[i])
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(256) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z >> 7
+		z = z<<1 ^ hi*0x1d
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// rsGenerator returns the coefficients of the Reed-Solomon generator
+// polynomial of the given degree, highest first without the leading 1.
+func rsGenerator(degree int) []byte {
+	gen := make([]byte, degree)
+	gen[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range gen {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < len(gen) {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return gen
+}
+
+func rsRemainder(data, gen []byte) []byte {
+	rem := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[len(rem)-1] = 0
+		for i := range rem {
+			rem[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	return rem
+}
+
+func newQRCode(version int) *qrCode {
+	size := 4*version + 17
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(size-4, 3)
+	q.drawFinder(3, size-4)
+	align := qrAlignment[version]
+	for i, x := range align {
+		for j, y := range align {
+			// Skip the three corners taken by finder patterns.
+			if (i == 0 && j == 0) || (i == 0 && j == len(align)-1) || (i == len(align)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, qrDist(dx, dy) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format areas, they are drawn with the mask.
+	q.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			q.set(a, b, bit)
+			q.set(b, a, bit)
+		}
+	}
+	return q
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// qrDist is the distance of a module from the center of a pattern.
+func qrDist(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
+
+// set draws a function module at column x and row y.
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= q.size || y >= q.size {
+				continue
+			}
+			d := qrDist(dx, dy)
+			q.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+func (q *qrCode) drawFormat(mask int) {
+	// Level M has the format bits 00.
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// place fills the data modules in the zigzag order of the standard.
+func (q *qrCode) place(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to scan, lower is better.
+func (q *qrCode) penalty() int {
+	n := q.size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	p, dark := 0, 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 0
+			for x := 0; x < n; x++ {
+				if x > 0 && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					p += 3
+				} else if run > 5 {
+					p++
+				}
+				// Finder-like patterns with four light modules on one side.
+				if x+7 <= n {
+					match := true
+					for k, f := range finder {
+						if at(x+k, y, transpose) != f {
+							match = false
+							break
+						}
+					}
+					if match && (qrLight(at, x-4, x, y, n, transpose) || qrLight(at, x+7, x+11, y, n, transpose)) {
+						p += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					p += 3
+				}
+			}
+		}
+	}
+	p += abs(dark*20-n*n*10) / (n * n) * 10
+	return p
+}
+
+// qrLight reports whether the modules from x0 to x1 of row y are light,
+// counting the outside of the symbol as light.
+func qrLight(at func(x, y int, transpose bool) bool, x0, x1, y, n int, transpose bool) bool {
+	for x := x0; x < x1; x++ {
+		if x >= 0 && x < n && at(x, y, transpose) {
+			return false
+		}
+	}
+	return true
+}
+
+// image renders the code with the given module size and a quiet zone of
+// four modules.
+func (q *qrCode) image(scale int) image.Image {
+	const quiet = 4
+	size := (q.size + 2*quiet) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+quiet)*scale+dx, (y+quiet)*scale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+	return img
+}
+
+// qr serves a PNG QR code of the target parameter, a path or a URL of this
+// server, so that links can be opened on a phone by scanning them.
+func (c *controller) qr(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	u, err := url.Parse(target)
+	if err != nil || target == "" {
+		http.Error(w, "invalid target", http.StatusBadRequest)
+		return
+	}
+	if u.Host == "" {
+		u, _ = url.Parse(c.urls.link(r, u.RequestURI()))
+	} else if !c.urls.ours(r, u) {
+		http.Error(w, "only links to this server are encoded", http.StatusBadRequest)
+		return
+	}
+	code, err := encodeQR([]byte(u.String()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestURITooLong)
+		return
+	}
+	scale := 8
+	if s, err := strconv.Atoi(r.URL.Query().Get("scale")); err == nil && s > 0 && s <= 32 {
+		scale = s
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code.image(scale)); err != nil {
+		c.internalError(w, r, "Error encoding QR code:", err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// text renders the code for terminals with half blocks, two rows of
+// modules per line and a quiet zone of two modules. Light modules are
+// drawn, so that the code reads on the usual dark background.
+func (q *qrCode) text() string {
+	const quiet = 2
+	light := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x < 0 || y < 0 || x >= q.size || y >= q.size || !q.modules[y][x]
+	}
+	var b strings.Builder
+	n := q.size + 2*quiet
+	for y := 0; y < n; y += 2 {
+		for x := 0; x < n; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
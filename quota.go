@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of requests quotas limit.
+const (
+	QuotaRequests  = "requests"
+	QuotaDownloads = "downloads" // GETs of files, shared ones included, and archives
+	QuotaUploads   = "uploads"   // requests changing files or state
+)
+
+const quotasSaveInterval = time.Minute
+
+// quotaLimit allows max requests of a kind per window to each client.
+type quotaLimit struct {
+	kind   string
+	max    int64
+	window time.Duration
+}
+
+// quotaLimits is a repeatable flag of "kind=max/window" quotas, e.g.
+// "downloads=500/1h".
+type quotaLimits []quotaLimit
+
+func (limits *quotaLimits) String() string {
+	var s []string
+	for _, l := range *limits {
+		s = append(s, fmt.Sprintf("%s=%d/%s", l.kind, l.max, l.window))
+	}
+	return strings.Join(s, ",")
+}
+
+func (limits *quotaLimits) Set(v string) error {
+	invalid := fmt.Errorf("invalid quota %q, expected \"requests|downloads|uploads=max/window\", e.g. \"downloads=500/1h\"", v)
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 {
+		return invalid
+	}
+	l := quotaLimit{kind: kv[0]}
+	if l.kind != QuotaRequests && l.kind != QuotaDownloads && l.kind != QuotaUploads {
+		return invalid
+	}
+	i := strings.Index(kv[1], "/")
+	if i < 0 {
+		return invalid
+	}
+	var err error
+	if l.max, err = strconv.ParseInt(kv[1][:i], 10, 64); err != nil || l.max <= 0 {
+		return invalid
+	}
+	if l.window, err = time.ParseDuration(kv[1][i+1:]); err != nil || l.window < time.Second {
+		return invalid
+	}
+	for _, other := range *limits {
+		if other.kind == l.kind {
+			return fmt.Errorf("duplicate %s quota", l.kind)
+		}
+	}
+	*limits = append(*limits, l)
+	return nil
+}
+
+// QuotaUsage is the use of a quota by a client, an API token or an IP
+// address, in the current window.
+type QuotaUsage struct {
+	Client   string    `json:"client"` // "token:<id>" or "ip:<address>"
+	Kind     string    `json:"kind"`
+	Start    time.Time `json:"start"`
+	Count    int64     `json:"count"`
+	Rejected int64     `json:"rejected"`
+}
+
+// quotaStore counts the requests of clients in fixed windows and persists
+// the counts periodically, so that restarts don't reset the quotas.
+type quotaStore struct {
+	store  docStore
+	limits quotaLimits
+
+	mu       sync.Mutex
+	usage    map[[2]string]*QuotaUsage // by client and kind
+	rejected map[string]int64          // since the start, by kind
+	dirty    bool
+}
+
+func loadQuotas(store docStore, limits quotaLimits) (*quotaStore, error) {
+	s := &quotaStore{store: store, limits: limits, usage: map[[2]string]*QuotaUsage{}, rejected: map[string]int64{}}
+	var usage []*QuotaUsage
+	if _, err := store.load(quotasDoc, &usage); err != nil {
+		return nil, err
+	}
+	for _, u := range usage {
+		s.usage[[2]string{u.Client, u.Kind}] = u
+	}
+	return s, nil
+}
+
+// quotaStatus is the state of a client's quota after a request.
+type quotaStatus struct {
+	limit     quotaLimit
+	remaining int64
+	reset     time.Time
+}
+
+// take counts a request of client against the quotas of the given kinds,
+// unless one of them is used up. It returns the status of the most limiting
+// quota, the zero status if none applies, and whether the request is
+// allowed.
+func (s *quotaStore) take(client string, kinds []string) (quotaStatus, bool) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var usages []*QuotaUsage
+	var tightest quotaStatus
+	found := false
+	for _, l := range s.limits {
+		if !containsString(kinds, l.kind) {
+			continue
+		}
+		start := now.Truncate(l.window)
+		u := s.usage[[2]string{client, l.kind}]
+		if u == nil || !u.Start.Equal(start) {
+			u = &QuotaUsage{Client: client, Kind: l.kind, Start: start}
+			s.usage[[2]string{client, l.kind}] = u
+		}
+		st := quotaStatus{limit: l, remaining: l.max - u.Count, reset: start.Add(l.window)}
+		if st.remaining <= 0 {
+			u.Rejected++
+			s.rejected[l.kind]++
+			s.dirty = true
+			st.remaining = 0
+			return st, false
+		}
+		if !found || st.remaining < tightest.remaining {
+			tightest, found = st, true
+		}
+		usages = append(usages, u)
+	}
+	for _, u := range usages {
+		u.Count++
+	}
+	if found {
+		tightest.remaining--
+		s.dirty = true
+	}
+	return tightest, true
+}
+
+// rejectedSamples returns the numbers of refused requests as metric
+// samples, by kind.
+func (s *quotaStore) rejectedSamples() []sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var samples []sample
+	for _, l := range s.limits {
+		samples = append(samples, sample{labels: []string{l.kind}, value: s.rejected[l.kind]})
+	}
+	return samples
+}
+
+// list returns the usage of the current windows, of client if not empty,
+// ordered by client and kind.
+func (s *quotaStore) list(client string) []QuotaUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := []QuotaUsage{}
+	for _, u := range s.usage {
+		if (client == "" || u.Client == client) && s.current(u) {
+			usage = append(usage, *u)
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Client != usage[j].Client {
+			return usage[i].Client < usage[j].Client
+		}
+		return usage[i].Kind < usage[j].Kind
+	})
+	return usage
+}
+
+// current reports whether the window of u is still running. It must be
+// called with s.mu held.
+func (s *quotaStore) current(u *QuotaUsage) bool {
+	for _, l := range s.limits {
+		if l.kind == u.Kind {
+			return time.Now().Before(u.Start.Add(l.window))
+		}
+	}
+	return false
+}
+
+// save persists the usage of the current windows, dropping the rest.
+func (s *quotaStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	usage := []*QuotaUsage{}
+	for key, u := range s.usage {
+		if !s.current(u) {
+			delete(s.usage, key)
+			continue
+		}
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Start.Before(usage[j].Start) })
+	if err := s.store.save(quotasDoc, usage); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// run saves the usage periodically until ctx is done.
+func (s *quotaStore) run(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(quotasSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				logger.Println("Error saving quotas:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaClient identifies the client of r for quotas: scripts by their API
+// token, everyone else by IP address.
+func (c *controller) quotaClient(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if c.tokens != nil && strings.HasPrefix(auth, "Bearer "+tokenPrefix) {
+		if t, ok := c.tokens.lookup(strings.TrimPrefix(auth, "Bearer ")); ok {
+			return "token:" + t.ID
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// quotaKinds returns the kinds of quotas r counts against.
+func (c *controller) quotaKinds(r *http.Request) []string {
+	kinds := []string{QuotaRequests}
+	switch {
+	case mutating(r):
+		kinds = append(kinds, QuotaUploads)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/s/"):
+		if c.sharedFile(r) {
+			kinds = append(kinds, QuotaDownloads)
+		}
+	case r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/"):
+		if r.URL.Query().Get("archive") != "" {
+			kinds = append(kinds, QuotaDownloads)
+			break
+		}
+		p := c.fsPath(r.URL.Path)
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			kinds = append(kinds, QuotaDownloads)
+		}
+	}
+	return kinds
+}
+
+// enforceQuotas refuses the requests of clients which used up a quota
+// with 429, and tells everyone how much of their quota is left.
+func (c *controller) enforceQuotas(hdlr http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if c.isAdmin(req) {
+			hdlr.ServeHTTP(w, req)
+			return
+		}
+		st, ok := c.quotas.take(c.quotaClient(req), c.quotaKinds(req))
+		if st.limit.kind != "" {
+			reset := int(time.Until(st.reset)/time.Second) + 1
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(st.limit.max, 10))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(st.remaining, 10))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(reset))
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(reset))
+				writeError(w, req, http.StatusTooManyRequests, APIError{
+					Code:    "quota_exceeded",
+					Message: fmt.Sprintf("%s quota of %d per %s exceeded", st.limit.kind, st.limit.max, st.limit.window),
+					Details: map[string]interface{}{"kind": st.limit.kind, "max": st.limit.max, "window": st.limit.window.String()},
+				})
+				return
+			}
+		}
+		hdlr.ServeHTTP(w, req)
+	})
+}
+
+// quotaQuery returns the usage of the quotas in their current windows,
+// filtered by the client parameter.
+func (c *controller) quotaQuery(w http.ResponseWriter, r *http.Request) {
+	if c.quotas == nil {
+		http.NotFound(w, r)
+		return
+	}
+	type limit struct {
+		Kind   string `json:"kind"`
+		Max    int64  `json:"max"`
+		Window string `json:"window"`
+	}
+	limits := []limit{}
+	for _, l := range c.quotas.limits {
+		limits = append(limits, limit{l.kind, l.max, l.window.String()})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	c.writeJSON(w, r, struct {
+		Limits []limit      `json:"limits"`
+		Usage  []QuotaUsage `json:"usage"`
+	}{limits, c.quotas.list(r.URL.Query().Get("client"))})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRecentInterval = 5 * time.Minute
+	DefaultRecentLimit    = 50
+	recentMaxLimit        = 1000
+)
+
+// Kinds of recent changes.
+const (
+	ChangeAdded    = "added"
+	ChangeModified = "modified"
+)
+
+// recentEntry is what the recent index keeps of a file.
+type recentEntry struct {
+	size    int64
+	modTime time.Time
+	// change is the last kind of change seen, at changed.
+	change  string
+	changed time.Time
+}
+
+// RecentFile is a file with its latest change.
+type RecentFile struct {
+	File
+	Change  string    `json:"change"`
+	Changed time.Time `json:"changed"`
+}
+
+// recentIndex keeps the size and modification time of every file, which
+// is enough to tell added from modified files between rescans. Files
+// found by the first scan after a start count as added when they were
+// last modified.
+type recentIndex struct {
+	root     string
+	interval time.Duration
+	hidden   func(rel string, isDir bool) bool
+	pool     *workerPool
+
+	mu      sync.RWMutex
+	files   map[string]recentEntry // by share path
+	scanned bool
+}
+
+func newRecentIndex(root string, interval time.Duration, hidden func(string, bool) bool, pool *workerPool) *recentIndex {
+	return &recentIndex{root: root, interval: interval, hidden: hidden, pool: pool, files: map[string]recentEntry{}}
+}
+
+// scan walks root once, recording the files added or modified since the
+// previous scan and dropping the deleted ones.
+func (ri *recentIndex) scan(ctx context.Context) error {
+	now := time.Now().UTC()
+	files := map[string]recentEntry{}
+	err := filepath.WalkDir(ri.root, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || p == ri.root {
+			return nil
+		}
+		rel, err := filepath.Rel(ri.root, p)
+		if err != nil {
+			return nil
+		}
+		rel = "/" + filepath.ToSlash(rel)
+		if ri.hidden(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[rel] = recentEntry{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		// An interrupted walk hasn't seen everything.
+		return err
+	}
+
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	for p, e := range files {
+		old, ok := ri.files[p]
+		switch {
+		case !ri.scanned:
+			e.change, e.changed = ChangeAdded, e.modTime
+		case !ok:
+			e.change, e.changed = ChangeAdded, now
+		case !old.modTime.Equal(e.modTime) || old.size != e.size:
+			e.change, e.changed = ChangeModified, e.modTime
+		default:
+			e.change, e.changed = old.change, old.changed
+		}
+		files[p] = e
+	}
+	ri.files = files
+	ri.scanned = true
+	return nil
+}
+
+// run keeps the index up to date until ctx is done.
+func (ri *recentIndex) run(ctx context.Context) {
+	ticker := time.NewTicker(ri.interval)
+	defer ticker.Stop()
+	for {
+		ri.pool.run(ctx, "recent", ri.root, ri.scan)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type recentChange struct {
+	path    string
+	change  string
+	changed time.Time
+}
+
+// list returns the latest changes below prefix, newest first.
+func (ri *recentIndex) list(prefix string, limit int) []recentChange {
+	ri.mu.RLock()
+	changes := []recentChange{}
+	for p, e := range ri.files {
+		if strings.HasPrefix(p, prefix) {
+			changes = append(changes, recentChange{p, e.change, e.changed})
+		}
+	}
+	ri.mu.RUnlock()
+	sort.Slice(changes, func(i, j int) bool {
+		if !changes[i].changed.Equal(changes[j].changed) {
+			return changes[i].changed.After(changes[j].changed)
+		}
+		return changes[i].path < changes[j].path
+	})
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes
+}
+
+// recent lists the files added or modified most recently below the path
+// parameter, at most limit of them.
+func (c *controller) recent(w http.ResponseWriter, r *http.Request) {
+	if c.recentIndex == nil || c.noListing || !c.readable(r) {
+		http.Error(w, "the recent changes view is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	scope := path.Clean("/" + q.Get("path"))
+	if scope != "/" {
+		scope += "/"
+	}
+	if c.isHidden(scope, true) {
+		http.NotFound(w, r)
+		return
+	}
+	limit := DefaultRecentLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > recentMaxLimit {
+			http.Error(w, "invalid limit, expected 1 to "+strconv.Itoa(recentMaxLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	starred := c.favoriteStore.starred(c.user(r))
+	files := []RecentFile{}
+	for _, ch := range c.recentIndex.list(scope, limit) {
+		// The index lags behind, skip what is gone or hidden by now.
+		p := c.fsPath(ch.path)
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() || c.isHidden(ch.path, false) || !c.allowed(p) {
+			continue
+		}
+		parent := path.Dir(ch.path)
+		if parent != "/" {
+			parent += "/"
+		}
+		f := newFile(parent, c.atRest.plainInfo(info))
+		f.Name = strings.TrimPrefix(ch.path, "/")
+		f.setMeta(c.meta.get(ch.path))
+		f.Starred = starred[ch.path]
+		files = append(files, RecentFile{File: f, Change: ch.change, Changed: ch.changed})
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r) {
+		c.writeJSON(w, r, struct {
+			Path  string       `json:"path"`
+			Files []RecentFile `json:"files"`
+		}{scope, files})
+		return
+	}
+	dir := Dir{
+		DisplayPath: scope,
+		Breadcrumbs: breadcrumbs(scope),
+		View:        "Recently changed files",
+		Files:       make([]File, 0, len(files)),
+		Page:        1,
+		Pages:       1,
+		Total:       len(files),
+	}
+	for _, f := range files {
+		f.ModTime = f.Changed.Local().Format("2006-01-02 15:04") + " " + f.Change
+		dir.Files = append(dir.Files, f.File)
+	}
+	c.renderIndex(w, r, dir)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicaQueueSize = 1024
+	replicaAttempts  = 5
+	replicaBackoff   = time.Second
+)
+
+// replicaFile is what a target reports of a replicated file.
+type replicaFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// replicaTarget is where the replicator mirrors the root directory to.
+// Paths are share-relative and slash-separated, without leading slash.
+type replicaTarget interface {
+	put(rel string, r io.ReadSeeker, info fs.FileInfo) error
+	remove(rel string) error
+	list(ctx context.Context) (map[string]replicaFile, error)
+	// current reports whether the replica of a file is up to date.
+	current(info fs.FileInfo, f replicaFile) bool
+	String() string
+}
+
+// parseReplicaTarget returns the target of the -replicate flag: an
+// s3://bucket/prefix URL or a local directory, which must be outside the
+// root directory.
+func parseReplicaTarget(target, root string) (replicaTarget, error) {
+	if strings.HasPrefix(target, "s3://") {
+		return newS3Target(target)
+	}
+	dir, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if within(dir, absRoot) || within(absRoot, dir) {
+		return nil, fmt.Errorf("replica %s and root directory %s must not contain each other", dir, absRoot)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return dirTarget{dir: dir}, nil
+}
+
+// dirTarget mirrors to a local directory, e.g. a mounted backup disk.
+type dirTarget struct {
+	dir string
+}
+
+func (t dirTarget) String() string { return t.dir }
+
+func (t dirTarget) put(rel string, r io.ReadSeeker, info fs.FileInfo) error {
+	p := filepath.Join(t.dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, r); err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (t dirTarget) remove(rel string) error {
+	err := os.Remove(filepath.Join(t.dir, filepath.FromSlash(rel)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (t dirTarget) list(ctx context.Context) (map[string]replicaFile, error) {
+	files := map[string]replicaFile{}
+	err := filepath.WalkDir(t.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(t.dir, p)
+		files[filepath.ToSlash(rel)] = replicaFile{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+func (t dirTarget) current(info fs.FileInfo, f replicaFile) bool {
+	return info.Size() == f.size && info.ModTime().Equal(f.modTime)
+}
+
+// replicaOp asks for the replica of a file to be brought up to date.
+type replicaOp struct {
+	rel string
+}
+
+// replicator mirrors the committed writes to a secondary target in the
+// background, so that it can take over as a warm standby. Writes queued
+// but not replicated when the server stops, or dropped because the queue
+// was full, are caught up by the reconciliation pass which compares the
+// whole tree on start and after overflows.
+type replicator struct {
+	logger *log.Logger
+	root   string
+	target replicaTarget
+	pool   *workerPool
+	queue  chan replicaOp
+
+	overflow int32 // set when ops were dropped
+	failures int64
+}
+
+func newReplicator(logger *log.Logger, root string, target replicaTarget, pool *workerPool) *replicator {
+	return &replicator{logger: logger, root: root, target: target, pool: pool, queue: make(chan replicaOp, replicaQueueSize)}
+}
+
+// replicate queues the file at the share path rel, which was written or
+// removed, for replication.
+func (rp *replicator) replicate(rel string) {
+	select {
+	case rp.queue <- replicaOp{rel: strings.TrimPrefix(rel, "/")}:
+	default:
+		atomic.StoreInt32(&rp.overflow, 1)
+	}
+}
+
+// run reconciles the target and then replicates the queued writes until
+// ctx is done.
+func (rp *replicator) run(ctx context.Context) {
+	rp.reconcileLogged(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op := <-rp.queue:
+			rp.pool.run(ctx, "replicate", op.rel, func(ctx context.Context) error {
+				return rp.apply(ctx, op)
+			})
+		}
+		if len(rp.queue) == 0 && atomic.CompareAndSwapInt32(&rp.overflow, 1, 0) {
+			rp.reconcileLogged(ctx)
+		}
+	}
+}
+
+// apply replicates the current state of a file, retrying failures with
+// exponential backoff.
+func (rp *replicator) apply(ctx context.Context, op replicaOp) error {
+	backoff := replicaBackoff
+	for attempt := 1; ; attempt++ {
+		err := rp.sync(op.rel)
+		if err == nil {
+			return nil
+		}
+		if attempt == replicaAttempts {
+			atomic.AddInt64(&rp.failures, 1)
+			rp.logger.Printf("Error replicating %s to %s, giving up until the next reconciliation: %v\n", op.rel, rp.target, err)
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// sync copies the file to the target, or removes its replica if it is
+// gone.
+func (rp *replicator) sync(rel string) error {
+	f, err := os.Open(filepath.Join(rp.root, filepath.FromSlash(rel)))
+	if os.IsNotExist(err) {
+		return rp.target.remove(rel)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	return rp.target.put(rel, f, info)
+}
+
+func (rp *replicator) reconcileLogged(ctx context.Context) {
+	rp.pool.run(ctx, "reconcile", rp.target.String(), func(ctx context.Context) error {
+		start := time.Now()
+		copied, removed, err := rp.reconcile(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				rp.logger.Printf("Error reconciling replica %s: %v\n", rp.target, err)
+			}
+			return err
+		}
+		rp.logger.Printf("Replica %s reconciled: %d files copied, %d removed in %s\n", rp.target, copied, removed, time.Since(start))
+		return nil
+	})
+}
+
+// reconcile makes the target a mirror of the root directory.
+func (rp *replicator) reconcile(ctx context.Context) (copied, removed int, err error) {
+	replicas, err := rp.target.list(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = filepath.WalkDir(rp.root, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && p == rp.root {
+			// Never mistake an unreadable root for an empty one.
+			return err
+		}
+		if err != nil || !d.Type().IsRegular() {
+			// Unreadable entries are left alone rather than removed.
+			if err != nil {
+				rel, _ := filepath.Rel(rp.root, p)
+				rel = filepath.ToSlash(rel)
+				for r := range replicas {
+					if r == rel || strings.HasPrefix(r, rel+"/") {
+						delete(replicas, r)
+					}
+				}
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(rp.root, p)
+		rel = filepath.ToSlash(rel)
+		replica, ok := replicas[rel]
+		delete(replicas, rel)
+		if info, err := d.Info(); err == nil && ok && rp.target.current(info, replica) {
+			return nil
+		}
+		if err := rp.sync(rel); err != nil {
+			return fmt.Errorf("copying %s: %w", rel, err)
+		}
+		copied++
+		return nil
+	})
+	if err != nil {
+		return copied, removed, err
+	}
+	for rel := range replicas {
+		if err := rp.target.remove(rel); err != nil {
+			return copied, removed, fmt.Errorf("removing %s: %w", rel, err)
+		}
+		removed++
+	}
+	return copied, removed, nil
+}
+
+// replicate queues a write to the share path rel for replication, if
+// enabled.
+func (c *controller) replicate(rel string) {
+	if c.replicator != nil {
+		c.replicator.replicate(rel)
+	}
+}
+
+// within reports whether p is dir or inside it.
+func within(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
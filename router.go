@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// router dispatches requests by path, as a ServeMux does, and by method.
+// Requests with methods a route doesn't handle get a 405 and OPTIONS
+// requests, e.g. CORS preflights, are answered from the routes without
+// reaching the handlers. Both carry the Allow header of the route.
+type router struct {
+	mux    *http.ServeMux
+	routes map[string]*route // by pattern
+}
+
+type route struct {
+	methods  []string // in registration order, for the Allow header
+	handlers map[string]http.HandlerFunc
+}
+
+func (rt *route) allow() string {
+	return strings.Join(rt.methods, ", ") + ", OPTIONS"
+}
+
+func (rt *route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := rt.handlers[r.Method]; ok {
+		h(w, r)
+		return
+	}
+	w.Header().Set("Allow", rt.allow())
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func newRouter() *router {
+	return &router{mux: http.NewServeMux(), routes: map[string]*route{}}
+}
+
+// handle registers h for the comma separated methods of pattern. A pattern
+// may be registered several times, with different methods.
+func (rt *router) handle(pattern, methods string, h http.HandlerFunc) {
+	r, ok := rt.routes[pattern]
+	if !ok {
+		r = &route{handlers: map[string]http.HandlerFunc{}}
+		rt.routes[pattern] = r
+		rt.mux.Handle(pattern, r)
+	}
+	for _, m := range strings.Split(methods, ",") {
+		m = strings.TrimSpace(m)
+		if _, dup := r.handlers[m]; dup {
+			panic("router: multiple handlers for " + m + " " + pattern)
+		}
+		r.methods = append(r.methods, m)
+		r.handlers[m] = h
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
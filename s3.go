@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Timeout       = 5 * time.Minute
+	s3DefaultRegion = "us-east-1"
+	// emptySHA256 is the hash of the empty payload of GET and DELETE.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Target mirrors to an S3 bucket, or any service speaking its API.
+// Credentials and region come from the usual AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION environment
+// variables, AWS_ENDPOINT_URL selects another service, e.g. MinIO, which
+// is then addressed path-style.
+type s3Target struct {
+	client    *http.Client
+	endpoint  *url.URL
+	pathStyle bool
+	bucket    string
+	prefix    string
+	region    string
+	keyID     string
+	secret    string
+	token     string
+}
+
+func newS3Target(target string) (*s3Target, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid replica %q, expected s3://bucket/prefix", target)
+	}
+	t := &s3Target{
+		client: &http.Client{Timeout: s3Timeout},
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		region: os.Getenv("AWS_REGION"),
+		keyID:  os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if t.prefix != "" {
+		t.prefix += "/"
+	}
+	if t.region == "" {
+		t.region = s3DefaultRegion
+	}
+	if t.keyID == "" || t.secret == "" {
+		return nil, fmt.Errorf("replicating to %s needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", target)
+	}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		if t.endpoint, err = url.Parse(endpoint); err != nil || t.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL %q", endpoint)
+		}
+		t.pathStyle = true
+	} else {
+		t.endpoint = &url.URL{Scheme: "https", Host: "s3." + t.region + ".amazonaws.com"}
+	}
+	return t, nil
+}
+
+func (t *s3Target) String() string { return "s3://" + t.bucket + "/" + t.prefix }
+
+// s3Escape percent-encodes s as S3 expects in canonical requests: all but
+// the unreserved characters, and slashes unless escapeSlash is false.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// newRequest returns a request for the object key, the bucket if empty.
+func (t *s3Target) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	host, p := t.endpoint.Host, "/"+key
+	if t.pathStyle {
+		p = strings.TrimSuffix("/"+t.bucket+p, "/")
+	} else {
+		host = t.bucket + "." + host
+	}
+	rawURL := t.endpoint.Scheme + "://" + host + s3Escape(p, false)
+	if len(query) > 0 {
+		rawURL += "?" + canonicalQuery(query)
+	}
+	return http.NewRequestWithContext(ctx, method, rawURL, body)
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds an AWS Signature Version 4 to req, covering the host and all
+// headers set so far.
+func (t *s3Target) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if t.token != "" {
+		req.Header.Set("X-Amz-Security-Token", t.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + t.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+t.secret), day)
+	key = hmacSHA256(key, t.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.keyID, scope, signedHeaders, signature))
+}
+
+// do signs and sends req, turning error responses into errors.
+func (t *s3Target) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	t.sign(req, payloadHash, time.Now())
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+func (t *s3Target) put(rel string, r io.ReadSeeker, info fs.FileInfo) error {
+	// The payload is signed, which takes a pass over the file first.
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := t.newRequest(context.Background(), http.MethodPut, t.prefix+rel, nil, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if typ := mime.TypeByExtension(path.Ext(rel)); typ != "" {
+		req.Header.Set("Content-Type", typ)
+	}
+	resp, err := t.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (t *s3Target) remove(rel string) error {
+	req, err := t.newRequest(context.Background(), http.MethodDelete, t.prefix+rel, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req, emptySHA256)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listBucketResult is the response of ListObjectsV2.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (t *s3Target) list(ctx context.Context) (map[string]replicaFile, error) {
+	files := map[string]replicaFile{}
+	query := url.Values{"list-type": {"2"}, "prefix": {t.prefix}}
+	for {
+		req, err := t.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.do(req, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var res listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", t, err)
+		}
+		for _, obj := range res.Contents {
+			rel := strings.TrimPrefix(obj.Key, t.prefix)
+			// Skip the markers some tools create for folders.
+			if rel != "" && !strings.HasSuffix(rel, "/") {
+				files[rel] = replicaFile{size: obj.Size, modTime: obj.LastModified}
+			}
+		}
+		if !res.IsTruncated {
+			return files, nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// current compares the sizes and whether the object was stored after the
+// file was last modified, as objects keep no modification times.
+func (t *s3Target) current(info fs.FileInfo, f replicaFile) bool {
+	return info.Size() == f.size && !f.modTime.Before(info.ModTime())
+}
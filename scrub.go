@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultScrubInterval = 7 * 24 * time.Hour
+	// ScrubQuarantine is the action of corrupt file events of files moved
+	// to the quarantine directory.
+	ScrubQuarantine = "quarantine"
+	// scrubSaveEvery is the number of checksums recorded by a scrub after
+	// which they are saved, so that an interrupted scrub keeps most of them.
+	scrubSaveEvery = 1000
+)
+
+// fileChecksum is the SHA-256 digest of the contents of a file, along with
+// its size and modification time when it was taken. Files which changed
+// since were written to and get a new checksum, the others must still
+// match it.
+type fileChecksum struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// current reports whether c was taken of the file as it is described by
+// info.
+func (c fileChecksum) current(info fs.FileInfo) bool {
+	return c.Size == info.Size() && c.ModTime.Equal(info.ModTime())
+}
+
+// checksumStore keeps the checksums of files by share-relative path.
+type checksumStore struct {
+	store docStore
+
+	mu    sync.RWMutex
+	files map[string]fileChecksum
+}
+
+func loadChecksums(store docStore) (*checksumStore, error) {
+	s := &checksumStore{store: store, files: map[string]fileChecksum{}}
+	if _, err := store.load(checksumsDoc, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *checksumStore) get(p string) (fileChecksum, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sum, ok := s.files[p]
+	return sum, ok
+}
+
+// set records the checksum of p, saved with the next save.
+func (s *checksumStore) set(p string, sum fileChecksum) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[p] = sum
+}
+
+func (s *checksumStore) remove(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, p)
+}
+
+// prune drops the checksums of the files which weren't seen.
+func (s *checksumStore) prune(seen map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.files {
+		if !seen[p] {
+			delete(s.files, p)
+		}
+	}
+}
+
+func (s *checksumStore) save() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.save(checksumsDoc, s.files)
+}
+
+// scrubber verifies the files of the share against their checksums, see
+// -scrub, to notice bit rot and failing disks before the last good copy
+// is gone. Files get a checksum when they are uploaded, or else when a
+// scrub reads them first. Files encrypted at rest are authenticated on
+// top of that. Corrupt and unreadable files are logged, counted, posted
+// to the webhooks and, with a quarantine directory, moved out of the
+// share.
+type scrubber struct {
+	sums       *checksumStore
+	interval   time.Duration
+	quarantine string
+
+	verified    int64 // files, accessed atomically
+	corrupt     int64 // files, accessed atomically
+	quarantined int64 // files, accessed atomically
+}
+
+// newScrubber loads the checksums from store. The quarantine directory, if
+// any, must be outside of the share, whose directories are roots.
+func newScrubber(store docStore, interval time.Duration, quarantine string, roots []string) (*scrubber, error) {
+	if quarantine != "" {
+		dir, err := filepath.Abs(quarantine)
+		if err != nil {
+			return nil, err
+		}
+		for _, root := range roots {
+			absRoot, err := filepath.Abs(root)
+			if err != nil {
+				return nil, err
+			}
+			if within(dir, absRoot) || within(absRoot, dir) {
+				return nil, fmt.Errorf("quarantine directory %s and share directory %s must not contain each other", dir, absRoot)
+			}
+		}
+		quarantine = dir
+	}
+	sums, err := loadChecksums(store)
+	if err != nil {
+		return nil, err
+	}
+	return &scrubber{sums: sums, interval: interval, quarantine: quarantine}, nil
+}
+
+// runScrub scrubs the share on start and then every interval, if any,
+// until ctx is done.
+func (c *controller) runScrub(ctx context.Context) {
+	var tick <-chan time.Time
+	if c.scrubber.interval > 0 {
+		ticker := time.NewTicker(c.scrubber.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		c.workers.run(ctx, "scrub", c.rootDir, c.scrub)
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		}
+	}
+}
+
+// scrub reads every file of the share once, verifying the ones with a
+// current checksum and recording the checksums of the others.
+func (c *controller) scrub(ctx context.Context) error {
+	s := c.scrubber
+	start := time.Now()
+	seen := map[string]bool{}
+	var files, corrupt, recorded int
+	for _, l := range c.layers() {
+		err := filepath.WalkDir(l.dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Unreadable directories are skipped, not the whole scrub.
+				c.logger.Println("Error scrubbing directory:", err)
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || isUploadTemp(d.Name()) {
+				return nil
+			}
+			rel, err := c.relPath(p, false)
+			if err != nil || c.fsPath(rel) != p {
+				// Shadowed by the file of an earlier layer.
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			info = c.atRest.plainInfo(info)
+			seen[rel] = true
+			files++
+			stored, ok := s.sums.get(rel)
+			sum, err := c.checksum(ctx, p)
+			if (err != nil || ok && stored.SHA256 != sum) && c.changedSince(p, info) {
+				// Written to or removed while it was read, which isn't rot.
+				return nil
+			}
+			switch {
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case err != nil:
+				corrupt++
+				c.reportCorrupt(rel, p, info, fmt.Errorf("unreadable: %w", err))
+			case ok && stored.current(info) && stored.SHA256 != sum:
+				corrupt++
+				c.reportCorrupt(rel, p, info, errors.New("checksum mismatch"))
+			case ok && stored.current(info):
+				atomic.AddInt64(&s.verified, 1)
+			default:
+				s.sums.set(rel, fileChecksum{SHA256: sum, Size: info.Size(), ModTime: info.ModTime()})
+				if recorded++; recorded%scrubSaveEvery == 0 {
+					if err := s.sums.save(); err != nil {
+						c.logger.Println("Error saving checksums:", err)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	if ctx.Err() == nil {
+		// An interrupted scrub hasn't seen everything, so don't prune.
+		s.sums.prune(seen)
+	}
+	if err := s.sums.save(); err != nil {
+		c.logger.Println("Error saving checksums:", err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	c.logger.Printf("Scrubbed %d files in %s: %d corrupt or unreadable, %d new checksums\n",
+		files, time.Since(start).Round(time.Second), corrupt, recorded)
+	return nil
+}
+
+// checksum returns the hex encoded SHA-256 digest of the contents of the
+// file p.
+func (c *controller) checksum(ctx context.Context, p string) (string, error) {
+	f, err := c.atRest.open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, &contextReader{ctx: ctx, r: f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// changedSince reports whether the file p was changed or removed since it
+// was described by info.
+func (c *controller) changedSince(p string, info fs.FileInfo) bool {
+	now, err := os.Stat(p)
+	if err != nil {
+		return true
+	}
+	now = c.atRest.plainInfo(now)
+	return now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime())
+}
+
+// reportCorrupt reports the corrupt file p at the share path rel, and
+// quarantines it if asked to.
+func (c *controller) reportCorrupt(rel, p string, info fs.FileInfo, problem error) {
+	s := c.scrubber
+	atomic.AddInt64(&s.corrupt, 1)
+	c.logger.Printf("Corrupt file %s: %v\n", rel, problem)
+	ev := WebhookEvent{Event: EventCorrupt, Path: rel, Size: info.Size(), Error: problem.Error()}
+	if s.quarantine != "" {
+		if err := s.quarantineFile(rel, p); err != nil {
+			c.logger.Printf("Error quarantining %s: %v\n", rel, err)
+		} else {
+			atomic.AddInt64(&s.quarantined, 1)
+			c.logger.Printf("Quarantined %s\n", rel)
+			ev.Action = ScrubQuarantine
+		}
+	}
+	c.emit(ev)
+}
+
+// quarantineFile moves the file p to the same share path rel below the
+// quarantine directory, where it is no longer served but can be inspected
+// or salvaged.
+func (s *scrubber) quarantineFile(rel, p string) error {
+	dst := filepath.Join(s.quarantine, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		// Keep the file quarantined earlier.
+		dst += "." + time.Now().UTC().Format("20060102T150405")
+	}
+	if err := os.Rename(p, dst); err != nil {
+		return err
+	}
+	s.sums.remove(rel)
+	return nil
+}
+
+// recordChecksum records the checksum of the file uploaded to target,
+// whose contents hashed to sum.
+func (c *controller) recordChecksum(target string, sum []byte) {
+	rel, err := c.relPath(target, false)
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return
+	}
+	info = c.atRest.plainInfo(info)
+	c.scrubber.sums.set(rel, fileChecksum{SHA256: hex.EncodeToString(sum), Size: info.Size(), ModTime: info.ModTime()})
+	if err := c.scrubber.sums.save(); err != nil {
+		c.logger.Println("Error saving checksums:", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errSearchDone stops the directory walk once enough results were found.
+var errSearchDone = errors.New("search done")
+
+type SearchResult struct {
+	Query     string `json:"query"`
+	Path      string `json:"path"`
+	Results   []File `json:"results"`
+	Truncated bool   `json:"truncated"`
+}
+
+// matcher returns a case-insensitive name matcher for q. Queries containing
+// glob meta characters are matched as patterns, anything else as substring.
+func matcher(q string) func(name string) bool {
+	q = strings.ToLower(q)
+	if strings.ContainsAny(q, "*?[") {
+		return func(name string) bool {
+			ok, _ := path.Match(q, strings.ToLower(name))
+			return ok
+		}
+	}
+	return func(name string) bool {
+		return strings.Contains(strings.ToLower(name), q)
+	}
+}
+
+// searchFiles walks root looking for entries whose name matches q and
+// which carry the tags and values of filter. The walk is bounded by the
+// configured depth, timeout and DefaultSearchLimit results.
+func (c *controller) searchFiles(ctx context.Context, root, q string, filter listFilter) (SearchResult, error) {
+	display, err := c.relPath(root, true)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	res := SearchResult{Query: q, Path: display, Results: []File{}}
+	match := matcher(q)
+
+	ctx, cancel := context.WithTimeout(ctx, c.searchTimeout)
+	defer cancel()
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			res.Truncated = true
+			return errSearchDone
+		}
+		if err != nil || p == root {
+			// Skip unreadable entries rather than failing the whole search.
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		if d.Type()&fs.ModeSymlink != 0 && !c.allowed(p) {
+			return nil
+		}
+		share, err := c.relPath(p, d.IsDir())
+		if err != nil || c.isHidden(share, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		depth := strings.Count(filepath.ToSlash(rel), "/") + 1
+		if match(d.Name()) && (!filter.needsMeta() || filter.matchMeta(c.meta.get(share))) {
+			info, err := d.Info()
+			if err == nil {
+				parent, _ := c.relPath(filepath.Dir(p), true)
+				f := newFile(parent, c.atRest.plainInfo(info))
+				f.setMeta(c.meta.get(share))
+				f.Name = strings.TrimPrefix(parent, "/") + f.Name
+				res.Results = append(res.Results, f)
+			}
+			if len(res.Results) >= DefaultSearchLimit {
+				res.Truncated = true
+				return errSearchDone
+			}
+		}
+		if d.IsDir() && depth >= c.searchDepth {
+			res.Truncated = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err == errSearchDone {
+		err = nil
+	}
+	return res, err
+}
+
+func (c *controller) search(w http.ResponseWriter, r *http.Request) {
+	// Searching would reveal the names listings are meant to keep private
+	if c.noListing || !c.readable(r) {
+		http.NotFound(w, r)
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	filter, err := parseListFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Tags alone make a query, listing everything carrying them
+	if q == "" && !filter.needsMeta() {
+		http.Error(w, "missing search query", http.StatusBadRequest)
+		return
+	}
+	scope := r.URL.Query().Get("path")
+	if scope == "" {
+		scope = "/"
+	}
+	root := c.fsPath(scope)
+	// The walk only checks the links it meets, not those leading to root.
+	if c.isHidden(scope, true) || !c.allowed(root) {
+		http.NotFound(w, r)
+		return
+	}
+	res, err := c.searchFiles(r.Context(), root, q, filter)
+	if err != nil {
+		c.internalError(w, r, "Error searching files:", err)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r) {
+		c.writeJSON(w, r, res)
+		return
+	}
+	sortFiles(res.Results, SortByName, OrderAsc)
+	c.renderIndex(w, r, Dir{
+		DisplayPath: res.Path,
+		Breadcrumbs: breadcrumbs(res.Path),
+		Parent:      res.Path,
+		Query:       q,
+		Files:       res.Results,
+		Page:        1,
+		Pages:       1,
+		Total:       len(res.Results),
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const DefaultCopyBufferSize = 256 << 10 // 256KiB
+
+// copier copies with pooled buffers of a configurable size. The buffers are
+// only used as a fallback: io.CopyBuffer prefers io.ReaderFrom and
+// io.WriterTo, which lets the kernel move file data with sendfile or
+// copy_file_range.
+type copier struct {
+	pool sync.Pool
+}
+
+func newCopier(size int) *copier {
+	return &copier{pool: sync.Pool{New: func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}}}
+}
+
+func (cp *copier) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := cp.pool.Get().(*[]byte)
+	defer cp.pool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// copyContext copies like copy, but stops as soon as ctx is done, e.g.
+// because the client of the request went away. The reads from src are
+// wrapped, so src can't use io.WriterTo.
+func (cp *copier) copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return cp.copy(dst, &contextReader{ctx: ctx, r: src})
+}
+
+// contextReader fails reads with the error of ctx once it is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(b []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(b)
+}
+
+// writerOnly hides the io.ReaderFrom of a writer so copying through it
+// doesn't recurse into ReadFrom.
+type writerOnly struct {
+	io.Writer
+}
+
+// ReadFrom keeps the zero-copy path of http.ServeContent working through
+// the compression middleware: once it is clear that the response won't be
+// compressed, src is handed to the underlying writer, which uses sendfile
+// for files.
+func (cw *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided && len(cw.buf) == 0 && !cw.wouldCompress() {
+		if err := cw.decide(false); err != nil {
+			return 0, err
+		}
+	}
+	if cw.decided && cw.enc == nil {
+		if rf, ok := cw.ResponseWriter.(io.ReaderFrom); ok {
+			return rf.ReadFrom(src)
+		}
+	}
+	return cw.copier.copy(writerOnly{cw}, src)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// Settings are the options which can be changed at runtime through the
+// admin API. Their initial values come from the flags, changed values are
+// persisted and take precedence over the flags.
+type Settings struct {
+	MaxUploadSize int64 `json:"max_upload_size"`
+	TransferCap   int64 `json:"transfer_cap"`
+	DropBox       bool  `json:"drop_box"`
+	EditEnabled   bool  `json:"enable_edit"`
+}
+
+func (s Settings) validate() error {
+	if s.MaxUploadSize <= 0 {
+		return errors.New("max_upload_size must be positive")
+	}
+	if s.TransferCap < 0 {
+		return errors.New("transfer_cap must not be negative")
+	}
+	return nil
+}
+
+type settingsStore struct {
+	store docStore
+
+	mu       sync.RWMutex
+	settings Settings
+}
+
+// loadSettings returns the settings given by the flags, overridden by those
+// saved through the admin API.
+func loadSettings(store docStore, flags Settings) (*settingsStore, bool, error) {
+	s := &settingsStore{store: store, settings: flags}
+	ok, err := store.load(settingsDoc, &s.settings)
+	if err != nil || !ok {
+		return s, false, err
+	}
+	return s, true, s.settings.validate()
+}
+
+func (s *settingsStore) get() Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings
+}
+
+// set saves and applies validated settings.
+func (s *settingsStore) set(settings Settings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.store.save(settingsDoc, settings); err != nil {
+		return err
+	}
+	s.settings = settings
+	return nil
+}
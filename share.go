@@ -0,0 +1,542 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shareTokenChars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	shareTokenLen   = 10
+	DefaultShareTTL = 24 * time.Hour
+	// shareResumeTTL is how long after its last request a counted download
+	// of a share can be resumed by the same client without counting again.
+	shareResumeTTL = 10 * time.Minute
+)
+
+// What happens to the contents of a share once it expires, besides the
+// link stopping to work.
+const (
+	ExpiryKeep    = ""
+	ExpiryArchive = "archive" // moved out of the share into a tar.gz in the data directory
+	ExpiryDelete  = "delete"
+)
+
+// Share grants access to a file or directory through its own token path,
+// /s/<token>, until it expires or, if MaxDownloads is set, until that many
+// files have been downloaded through it. Then its contents can be archived
+// or deleted, e.g. of a drop folder which only exists for a week.
+type Share struct {
+	Token        string    `json:"token"`
+	Path         string    `json:"path"` // share-relative, directories end with /
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	// DropBox shares of directories only accept uploads.
+	DropBox  bool   `json:"drop_box,omitempty"`
+	OnExpiry string `json:"on_expiry,omitempty"`
+	// StripExif shares images without their EXIF/GPS metadata.
+	StripExif bool `json:"strip_exif,omitempty"`
+}
+
+func (sh *Share) expired() bool {
+	return time.Now().After(sh.Expires) || (sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads)
+}
+
+// shareStore keeps the shares in memory and persists them, so that they
+// survive restarts.
+type shareStore struct {
+	store docStore
+
+	mu     sync.Mutex
+	shares map[string]*Share
+	// resumes holds when the downloads counted by claim were last
+	// requested, by token and client.
+	resumes map[string]time.Time
+}
+
+func loadShares(store docStore) (*shareStore, error) {
+	s := &shareStore{store: store, shares: map[string]*Share{}, resumes: map[string]time.Time{}}
+	var shares []*Share
+	if _, err := store.load(sharesDoc, &shares); err != nil {
+		return nil, err
+	}
+	for _, sh := range shares {
+		s.shares[sh.Token] = sh
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held. Expired shares are kept until
+// expire handles them.
+func (s *shareStore) save() error {
+	shares := []*Share{}
+	for _, sh := range s.shares {
+		shares = append(shares, sh)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+	return s.store.save(sharesDoc, shares)
+}
+
+func (s *shareStore) add(sh *Share) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		token, err := randomToken(shareTokenLen)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.shares[token]; !ok {
+			sh.Token = token
+			break
+		}
+	}
+	s.shares[sh.Token] = sh
+	return s.save()
+}
+
+// get returns a copy of the unexpired share with the given token. Shares
+// out of downloads are still returned to the clients resuming theirs.
+func (s *shareStore) get(token, client string, ranged bool) (Share, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[token]
+	if !ok || time.Now().After(sh.Expires) || sh.expired() && !(ranged && s.resuming(token+" "+client)) {
+		return Share{}, false
+	}
+	return *sh, true
+}
+
+// resuming reports whether the client of key can resume its download
+// without counting it again. It must be called with s.mu held.
+func (s *shareStore) resuming(key string) bool {
+	last, ok := s.resumes[key]
+	return ok && time.Since(last) < shareResumeTTL
+}
+
+func (s *shareStore) remove(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.shares[token]; !ok {
+		return false, nil
+	}
+	delete(s.shares, token)
+	return true, s.save()
+}
+
+// claim counts a download of the share by client, failing if the share is
+// gone or has no downloads left. Downloads which don't complete are handed
+// back with release. Counting happens under the lock before serving, so
+// that parallel requests can't exceed the limit. Ranges the client asks
+// for within shareResumeTTL of its counted download resume it and aren't
+// counted again, claim reports whether it counted.
+func (s *shareStore) claim(token, client string, ranged bool) (counted, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[token]
+	if !ok || time.Now().After(sh.Expires) {
+		return false, false, nil
+	}
+	key := token + " " + client
+	if ranged && s.resuming(key) {
+		s.resumes[key] = time.Now()
+		return false, true, nil
+	}
+	if sh.expired() {
+		return false, false, nil
+	}
+	s.resumes[key] = time.Now()
+	sh.Downloads++
+	if sh.MaxDownloads == 0 {
+		// Unlimited shares count in memory only, saving on every download
+		// isn't worth it.
+		return true, true, nil
+	}
+	return true, true, s.save()
+}
+
+func (s *shareStore) release(token, client string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.resumes, token+" "+client)
+	sh, ok := s.shares[token]
+	if !ok || sh.Downloads == 0 {
+		return nil
+	}
+	sh.Downloads--
+	if sh.MaxDownloads == 0 {
+		return nil
+	}
+	return s.save()
+}
+
+// expire returns the expired shares. They stay disabled until end removes
+// them, once their expiry action succeeded.
+func (s *shareStore) expire() []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resumed := map[string]bool{}
+	for key := range s.resumes {
+		if !s.resuming(key) {
+			delete(s.resumes, key)
+		} else {
+			resumed[key[:strings.IndexByte(key, ' ')]] = true
+		}
+	}
+	var expired []Share
+	for token, sh := range s.shares {
+		// Shares out of downloads wait for the downloads to be resumed.
+		if time.Now().After(sh.Expires) || sh.expired() && !resumed[token] {
+			expired = append(expired, *sh)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Expires.Before(expired[j].Expires) })
+	return expired
+}
+
+// end removes the expired share with the given token.
+func (s *shareStore) end(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.shares, token)
+	return s.save()
+}
+
+func (s *shareStore) list() []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shares := []Share{}
+	for _, sh := range s.shares {
+		if !sh.expired() {
+			shares = append(shares, *sh)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+	return shares
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(shareTokenChars)))
+	for i := range b {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = shareTokenChars[v.Int64()]
+	}
+	return string(b), nil
+}
+
+type shareRequest struct {
+	Path         string    `json:"path"`
+	Expires      time.Time `json:"expires"`
+	TTL          string    `json:"ttl"`
+	MaxDownloads int       `json:"max_downloads"`
+	DropBox      bool      `json:"drop_box"`
+	OnExpiry     string    `json:"on_expiry"`
+	StripExif    bool      `json:"strip_exif"`
+}
+
+type shareResponse struct {
+	Share
+	URL string `json:"url"`
+}
+
+// shares creates (POST) and lists (GET, admin only) share links.
+func (c *controller) shares(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		c.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-store")
+			c.writeJSON(w, r, c.shareStore.list())
+		})(w, r)
+	case http.MethodPost:
+		c.createShare(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *controller) createShare(w http.ResponseWriter, r *http.Request) {
+	var req shareRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid share request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	expires := req.Expires
+	if expires.IsZero() {
+		ttl := DefaultShareTTL
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				http.Error(w, fmt.Sprintf("invalid ttl %q", req.TTL), http.StatusBadRequest)
+				return
+			}
+		}
+		expires = time.Now().Add(ttl)
+	}
+	if !expires.After(time.Now()) {
+		http.Error(w, "expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+	if req.MaxDownloads < 0 {
+		http.Error(w, "max_downloads must not be negative", http.StatusBadRequest)
+		return
+	}
+	switch req.OnExpiry {
+	case ExpiryKeep, ExpiryArchive, ExpiryDelete:
+	default:
+		http.Error(w, fmt.Sprintf("invalid on_expiry %q, must be archive or delete", req.OnExpiry), http.StatusBadRequest)
+		return
+	}
+
+	rel := path.Clean("/" + req.Path)
+	p := c.fsPath(rel)
+	info, err := os.Stat(p)
+	if err != nil || c.isHidden(rel, info.IsDir()) || !c.allowed(p) {
+		http.Error(w, "no such file or directory", http.StatusNotFound)
+		return
+	}
+	if req.OnExpiry != ExpiryKeep && (rel == "/" || !c.deleteEnabled || !c.isAdmin(r)) {
+		// Removing the contents is deleting them, not just revoking access.
+		http.Error(w, "on_expiry needs -enable-delete and the admin token, and can't apply to the root directory", http.StatusForbidden)
+		return
+	}
+	if req.DropBox && !info.IsDir() {
+		http.Error(w, "only directories can be drop boxes", http.StatusBadRequest)
+		return
+	}
+	// Sharing existing files would defeat the drop box mode
+	if !req.DropBox && !c.readable(r) {
+		http.Error(w, "only drop box shares are allowed", http.StatusForbidden)
+		return
+	}
+	if info.IsDir() && rel != "/" {
+		rel += "/"
+	}
+	sh := &Share{
+		Path:         rel,
+		Created:      time.Now().UTC(),
+		Expires:      expires.UTC(),
+		MaxDownloads: req.MaxDownloads,
+		DropBox:      req.DropBox,
+		OnExpiry:     req.OnExpiry,
+		StripExif:    req.StripExif,
+	}
+	if err = c.shareStore.add(sh); err != nil {
+		c.internalError(w, r, "Error saving share:", err)
+		return
+	}
+	c.audit(w, r, ActionShare, rel)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(shareResponse{Share: *sh, URL: c.urls.url(r, "/s/"+sh.Token)})
+}
+
+// deleteShare revokes the share given by the token in the path.
+func (c *controller) deleteShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/api/v1/shares/")
+	ok, err := c.shareStore.remove(token)
+	if err != nil {
+		c.internalError(w, r, "Error saving shares:", err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shared serves /s/<token>[/sub/path], the file or directory of a share.
+func (c *controller) shared(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/s/")
+	token, sub := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		token, sub = rest[:i], rest[i+1:]
+	}
+	sh, ok := c.shareStore.get(token, clientIP(r), r.Header.Get("Range") != "")
+	if !ok {
+		http.Error(w, "this link doesn't exist or has expired", http.StatusGone)
+		return
+	}
+	isDirShare := strings.HasSuffix(sh.Path, "/")
+	if !isDirShare && sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+	base := "/s/" + token + "/"
+	if isDirShare && !strings.HasPrefix(r.URL.Path, base) {
+		http.Redirect(w, r, base, http.StatusMovedPermanently)
+		return
+	}
+	if sh.DropBox {
+		c.sharedDropBox(w, r, sh, sub)
+		return
+	}
+	rel := sh.Path
+	if isDirShare {
+		// Never leave the shared directory
+		if rel = path.Clean(sh.Path + sub); !strings.HasPrefix(rel+"/", sh.Path) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	p := c.fsPath(rel)
+	info, err := os.Stat(p)
+	if err != nil || c.isHidden(rel, info.IsDir()) || !c.allowed(p) {
+		http.NotFound(w, r)
+		return
+	}
+	c.notify(r, WebhookEvent{Event: EventShare, Path: rel})
+	if !info.IsDir() {
+		c.serveShared(w, r, sh, p)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	c.sharedListing(w, r, sh, p, strings.TrimPrefix(r.URL.Path, base))
+}
+
+// sharedFile reports whether r asks for a file of a share, rather than
+// for the listing of a directory share or a drop box.
+func (c *controller) sharedFile(r *http.Request) bool {
+	token, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	sh, ok := c.shareStore.get(token, clientIP(r), r.Header.Get("Range") != "")
+	if !ok || sh.DropBox {
+		return false
+	}
+	info, err := os.Stat(c.fsPath(sh.Path + sub))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// serveShared serves the file p of the share sh, counting the download.
+func (c *controller) serveShared(w http.ResponseWriter, r *http.Request, sh Share, p string) {
+	token := sh.Token
+	rel, _ := c.relPath(p, false)
+	serve := c.serveFile
+	if c.stripsExif(r, rel, sh.StripExif) {
+		serve = c.serveStripped
+	}
+	if typ := c.contentType(p); typ != "" {
+		w.Header().Set("Content-Type", typ)
+	}
+	if r.Method == http.MethodHead {
+		serve(w, r, p)
+		return
+	}
+	counted, ok, err := c.shareStore.claim(token, clientIP(r), r.Header.Get("Range") != "")
+	if err != nil {
+		c.log(r).Println("Error saving shares:", err)
+	}
+	if !ok {
+		http.Error(w, "this link doesn't exist or has expired", http.StatusGone)
+		return
+	}
+	tw, done := c.trackDownload(w, r, rel)
+	defer done()
+	rec := &statusRecorder{ResponseWriter: tw}
+	serve(rec, r, p)
+	if rel != "" {
+		c.countDownload(r, rec, rel)
+	}
+	// Only downloads which were delivered completely count
+	if counted && (rec.status >= 300 || r.Context().Err() != nil) {
+		if err := c.shareStore.release(token, clientIP(r)); err != nil {
+			c.log(r).Println("Error saving shares:", err)
+		}
+	}
+}
+
+// sharedDropBox accepts uploads into the directory of a drop box share,
+// without revealing its content.
+func (c *controller) sharedDropBox(w http.ResponseWriter, r *http.Request, sh Share, sub string) {
+	if sub != "" {
+		http.Error(w, "downloads are disabled", http.StatusForbidden)
+		return
+	}
+	p := c.fsPath(sh.Path)
+	if info, err := os.Stat(p); err != nil || !info.IsDir() || !c.allowed(p) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		c.renderIndex(w, r, Dir{
+			DisplayPath:  path.Base(strings.TrimSuffix(sh.Path, "/")) + "/",
+			Shared:       true,
+			DropBox:      true,
+			UploadFields: c.uploadFields(sh.Path),
+		})
+	case http.MethodPost:
+		if !c.beginUpload(w) {
+			return
+		}
+		defer c.uploads.end()
+		done := c.trackUpload(w, r, sh.Path)
+		defer done()
+		if c.storeFiles(w, r, p, true) {
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sharedListing lists a directory of a share, linking only to paths below
+// the share.
+func (c *controller) sharedListing(w http.ResponseWriter, r *http.Request, sh Share, p, sub string) {
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir, err := c.listDir(p, opts)
+	if err != nil {
+		c.internalError(w, r, "Error listing files in directory", err)
+		return
+	}
+	base := "/s/" + sh.Token + "/"
+	for i, f := range dir.Files {
+		f.Link = (&url.URL{Path: base + sub + f.Name}).String()
+		f.Preview, f.Thumb = "", ""
+		dir.Files[i] = f
+	}
+	dir.Shared = true
+	dir.DisplayPath = "/" + sub
+	if sh.Path != "/" {
+		dir.DisplayPath = path.Base(strings.TrimSuffix(sh.Path, "/")) + dir.DisplayPath
+	}
+	dir.Breadcrumbs = nil
+	dir.Parent = ""
+	if sub != "" {
+		dir.Parent = (&url.URL{Path: path.Dir(strings.TrimSuffix(base+sub, "/")) + "/"}).String()
+	}
+	dir.Columns = sortColumns(opts)
+	if wantsJSON(r) {
+		c.writeJSON(w, r, dir)
+		return
+	}
+	c.renderIndex(w, r, dir)
+}
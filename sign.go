@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultSignTTL = time.Hour
+
+type contextKey int
+
+const (
+	signedKey contextKey = iota
+	userKey
+	requestIDKey
+	traceKey
+	progressKey
+)
+
+// signature computes the signature of a URL granting method (any method
+// if empty) on the path p until expires.
+func signature(key, method, p string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, p, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signPath returns p with the query parameters of a signed URL.
+func signPath(key, method, p string, expires time.Time) string {
+	p = path.Clean("/" + p)
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if method != "" {
+		q.Set("method", strings.ToUpper(method))
+	}
+	q.Set("sig", signature(key, strings.ToUpper(method), p, expires.Unix()))
+	return (&url.URL{Path: p, RawQuery: q.Encode()}).String()
+}
+
+// verifySignature checks the signature of requests carrying one. Valid
+// signed requests are marked in their context, so that access checks can
+// let them through, invalid or expired ones are refused.
+func (c *controller) verifySignature(hdlr http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		sig := q.Get("sig")
+		if sig == "" {
+			hdlr.ServeHTTP(w, req)
+			return
+		}
+		expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		method := q.Get("method")
+		want := signature(c.signingKey, method, path.Clean("/"+req.URL.Path), expires)
+		if err != nil || !hmac.Equal([]byte(sig), []byte(want)) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+		if time.Now().Unix() > expires {
+			http.Error(w, "signed URL has expired", http.StatusForbidden)
+			return
+		}
+		if method != "" && method != req.Method && !(method == http.MethodGet && req.Method == http.MethodHead) {
+			http.Error(w, "signed URL doesn't allow "+req.Method, http.StatusForbidden)
+			return
+		}
+		hdlr.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), signedKey, true)))
+	})
+}
+
+// isSigned reports whether r carries a valid signature.
+func isSigned(r *http.Request) bool {
+	ok, _ := r.Context().Value(signedKey).(bool)
+	return ok
+}
+
+type signRequest struct {
+	Path   string `json:"path"`
+	Method string `json:"method"`
+	TTL    string `json:"ttl"`
+}
+
+// sign mints signed URLs through the admin API.
+func (c *controller) sign(w http.ResponseWriter, r *http.Request) {
+	if c.signingKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req signRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid sign request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := DefaultSignTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q", req.TTL), http.StatusBadRequest)
+			return
+		}
+	}
+	expires := time.Now().Add(ttl)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{c.urls.url(r, "") + signPath(c.signingKey, req.Method, req.Path, expires), expires.UTC()})
+}
+
+// signCommand implements "gosfs sign", which prints signed URLs without
+// talking to the server.
+func signCommand(args []string) {
+	set := flag.NewFlagSet("sign", flag.ExitOnError)
+	key := set.String("signing-key", os.Getenv("GOSFS_SIGNING_KEY"), "key shared with the server (default $GOSFS_SIGNING_KEY)")
+	method := set.String("method", "", "only allow this method (default any)")
+	ttl := set.Duration("ttl", DefaultSignTTL, "validity of the URL")
+	base := set.String("base-url", "", "server URL to prefix, e.g. http://files.lan:2690")
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: %s sign [flags] path...\n", os.Args[0])
+		set.PrintDefaults()
+	}
+	set.Parse(args)
+	if *key == "" || set.NArg() == 0 {
+		set.Usage()
+		os.Exit(2)
+	}
+	expires := time.Now().Add(*ttl)
+	for _, p := range set.Args() {
+		fmt.Println(strings.TrimSuffix(*base, "/") + signPath(*key, *method, p, expires))
+	}
+}
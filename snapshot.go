@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSnapshotInterval = 24 * time.Hour
+	DefaultSnapshotKeep     = 7
+	snapshotPrefix          = "gosfs-"
+	snapshotSuffix          = ".tar.gz"
+	snapshotTimeFormat      = "20060102-150405"
+)
+
+// Snapshot is a backup archive in the snapshot directory.
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// snapshotter periodically archives directories of the share into tar.gz
+// snapshots, keeping the newest ones. Snapshots are named after their
+// creation time, which is how they are ordered and scheduled across
+// restarts.
+type snapshotter struct {
+	logger   *log.Logger
+	root     string
+	paths    []string // share paths to archive
+	dir      string
+	interval time.Duration
+	keep     int
+	pool     *workerPool
+	trigger  chan struct{}
+
+	mu      sync.Mutex
+	running bool
+	lastErr string
+}
+
+// newSnapshotter checks that the snapshot directory isn't inside one of
+// the archived directories, which would archive the snapshots themselves.
+func newSnapshotter(logger *log.Logger, root, paths, dir string, interval time.Duration, keep int, pool *workerPool) (*snapshotter, error) {
+	if keep < 1 {
+		return nil, fmt.Errorf("at least one snapshot must be kept")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshotter{logger: logger, root: root, dir: dir, interval: interval, keep: keep, pool: pool, trigger: make(chan struct{}, 1)}
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		p = path.Clean("/" + p)
+		abs, err := filepath.Abs(filepath.Join(root, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, err
+		}
+		if within(dir, abs) {
+			return nil, fmt.Errorf("snapshot directory %s is inside the archived %s", dir, p)
+		}
+		s.paths = append(s.paths, p)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// list returns the snapshots, oldest first.
+func (s *snapshotter) list() ([]Snapshot, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		created, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Name: name, Size: info.Size(), Created: created})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// run creates a snapshot whenever the interval since the newest one has
+// passed or one is triggered, until ctx is done.
+func (s *snapshotter) run(ctx context.Context) {
+	next := time.Now()
+	if snapshots, err := s.list(); err == nil && len(snapshots) > 0 {
+		next = snapshots[len(snapshots)-1].Created.Add(s.interval)
+	}
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		s.snapshotLogged(ctx)
+		timer.Reset(s.interval)
+	}
+}
+
+func (s *snapshotter) snapshotLogged(ctx context.Context) {
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+	start := time.Now()
+	var snap Snapshot
+	err := s.pool.run(ctx, "snapshot", strings.Join(s.paths, ","), func(ctx context.Context) (err error) {
+		snap, err = s.snapshot(ctx)
+		return err
+	})
+	s.mu.Lock()
+	s.running = false
+	s.lastErr = ""
+	if err != nil {
+		s.lastErr = err.Error()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.logger.Println("Error creating snapshot:", err)
+		return
+	}
+	s.logger.Printf("Snapshot %s created: %d bytes in %s\n", snap.Name, snap.Size, time.Since(start))
+	if err := s.pool.run(ctx, "retention", s.dir, s.prune); err != nil {
+		s.logger.Println("Error removing old snapshots:", err)
+	}
+}
+
+// snapshot archives the configured directories into a new snapshot.
+func (s *snapshotter) snapshot(ctx context.Context) (Snapshot, error) {
+	now := time.Now().UTC()
+	snap := Snapshot{Name: snapshotPrefix + now.Format(snapshotTimeFormat) + snapshotSuffix, Created: now}
+	tmp, err := os.CreateTemp(s.dir, "."+snap.Name+".*")
+	if err != nil {
+		return snap, err
+	}
+	defer os.Remove(tmp.Name())
+	gw := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gw)
+	for _, p := range s.paths {
+		if err = archiveTree(ctx, tw, s.root, p); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return snap, err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return snap, err
+	}
+	snap.Size = info.Size()
+	return snap, os.Rename(tmp.Name(), filepath.Join(s.dir, snap.Name))
+}
+
+// archiveTree adds the file or directory at the share path p to tw, with
+// names relative to the root directory.
+func archiveTree(ctx context.Context, tw *tar.Writer, root, p string) error {
+	dir := filepath.Join(root, filepath.FromSlash(p))
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if d.Type()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		} else if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, file)
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Files growing while archived are cut at the size in the header.
+		if _, err = io.CopyN(tw, &contextReader{ctx: ctx, r: f}, hdr.Size); err != nil {
+			return fmt.Errorf("archiving %s: %w", hdr.Name, err)
+		}
+		return nil
+	})
+}
+
+// prune removes the oldest snapshots beyond the number to keep.
+func (s *snapshotter) prune(context.Context) error {
+	snapshots, err := s.list()
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > s.keep {
+		if err := os.Remove(filepath.Join(s.dir, snapshots[0].Name)); err != nil {
+			return err
+		}
+		s.logger.Printf("Snapshot %s removed\n", snapshots[0].Name)
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// adminSnapshots lists the snapshots (GET) or triggers a new one in the
+// background (POST).
+func (c *controller) adminSnapshots(w http.ResponseWriter, r *http.Request) {
+	s := c.snapshotter
+	if s == nil {
+		http.Error(w, "snapshots are disabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		snapshots, err := s.list()
+		if err != nil {
+			c.internalError(w, r, "Error listing snapshots:", err)
+			return
+		}
+		s.mu.Lock()
+		running, lastErr := s.running, s.lastErr
+		s.mu.Unlock()
+		w.Header().Set("Cache-Control", "no-store")
+		c.writeJSON(w, r, struct {
+			Paths     []string   `json:"paths"`
+			Running   bool       `json:"running"`
+			LastError string     `json:"last_error,omitempty"`
+			Snapshots []Snapshot `json:"snapshots"`
+		}{s.paths, running, lastErr, snapshots})
+	case http.MethodPost:
+		select {
+		case s.trigger <- struct{}{}:
+		default:
+			// One is pending already
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const DefaultSpoolMemory = 1 << 20 // 1MiB
+
+var errSpoolFull = errors.New("upload spool is full")
+
+// spool is where uploads are written to before they are renamed into
+// place. By default that is next to their targets, which keeps the rename
+// atomic; a separate directory has to be on the same filesystem as the
+// root directory for the same reason. Uploads up to memory bytes are
+// buffered in memory before they touch the disk, and at most max bytes are
+// spooled at a time. Uploads to the union directories, which are usually
+// on other disks, are spooled next to their targets.
+type spool struct {
+	dir    string // "" to spool next to the targets
+	root   string // of the filesystem of dir
+	memory int64
+	max    int64 // 0 for no limit
+
+	mu   sync.Mutex
+	used int64
+}
+
+func newSpool(dir, root string, memory, max int64) (*spool, error) {
+	s := &spool{memory: memory, max: max}
+	if dir == "" {
+		return s, nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(root, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("spool directory %s is inside the root directory", dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// Renames only work within a filesystem, so try one.
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return nil, err
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+	moved := filepath.Join(root, filepath.Base(probe.Name()))
+	if err := os.Rename(probe.Name(), moved); err != nil {
+		return nil, fmt.Errorf("spool directory %s must be on the filesystem of the root directory: %w", dir, err)
+	}
+	os.Remove(moved)
+	s.dir, s.root = dir, root
+	return s, nil
+}
+
+// create creates the temporary file of an upload to target.
+func (s *spool) create(target string) (*os.File, error) {
+	dir := s.dir
+	if abs, err := filepath.Abs(target); err != nil || !within(abs, s.root) {
+		dir = ""
+	}
+	if dir == "" {
+		dir = filepath.Dir(target)
+	}
+	return os.CreateTemp(dir, "."+filepath.Base(target)+uploadTempInfix+"*")
+}
+
+// buffer reads up to memory bytes of src. It returns a reader of the whole
+// of src, and whether that was buffered completely.
+func (s *spool) buffer(src io.Reader) (io.Reader, bool, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(src, s.memory+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if n <= s.memory {
+		return &buf, true, nil
+	}
+	return io.MultiReader(&buf, src), false, nil
+}
+
+func (s *spool) reserve(n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max > 0 && s.used+n > s.max {
+		return false
+	}
+	s.used += n
+	return true
+}
+
+func (s *spool) release(n int64) {
+	s.mu.Lock()
+	s.used -= n
+	s.mu.Unlock()
+}
+
+func (s *spool) usage() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// spoolWriter counts the bytes written to a spooled file against the
+// limit of the spool, failing writes with errSpoolFull beyond it.
+type spoolWriter struct {
+	w     io.Writer
+	spool *spool
+	n     int64
+}
+
+func (sw *spoolWriter) Write(b []byte) (int, error) {
+	if !sw.spool.reserve(int64(len(b))) {
+		return 0, errSpoolFull
+	}
+	sw.n += int64(len(b))
+	return sw.w.Write(b)
+}
+
+// spoolFull responds with 507 to an upload which didn't fit into the
+// spool, which is temporary unlike a full disk, like uploadTooLarge does.
+func (c *controller) spoolFull(w http.ResponseWriter, r *http.Request) {
+	msg := "too many uploads in progress, try again later"
+	if p, ok := r.Context().Value(progressKey).(*UploadProgress); ok {
+		c.uploads.update(p, func(p *UploadProgress) { p.Error = msg })
+	}
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", "60")
+	writeError(w, r, http.StatusInsufficientStorage, APIError{
+		Code:    "spool_full",
+		Message: msg,
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statsSaveInterval is how often changed statistics are written to the
+	// data directory, besides on shutdown.
+	statsSaveInterval = time.Minute
+	// statsMaxClients caps the clients remembered per file, beyond it the
+	// unique client count stops growing.
+	statsMaxClients   = 10000
+	DefaultStatsLimit = 100
+)
+
+//go:embed stats.html
+var statsContent string
+
+var statsTemplate = template.Must(template.New("stats").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+}).Parse(statsContent))
+
+// FileStats are the download statistics of a file.
+type FileStats struct {
+	Path          string    `json:"path"`
+	Downloads     int64     `json:"downloads"`
+	Bytes         int64     `json:"bytes"`
+	UniqueClients int       `json:"unique_clients"`
+	LastAccess    time.Time `json:"last_access"`
+}
+
+// fileStats adds the clients seen to FileStats. Clients are kept as
+// truncated hashes of their addresses, which is enough to count them.
+type fileStats struct {
+	FileStats
+	Clients []string `json:"clients"`
+	seen    map[string]struct{}
+}
+
+// statsStore accumulates download statistics in memory and persists them
+// periodically.
+type statsStore struct {
+	store docStore
+
+	mu    sync.Mutex
+	files map[string]*fileStats
+	dirty bool
+}
+
+func loadStats(store docStore) (*statsStore, error) {
+	s := &statsStore{store: store, files: map[string]*fileStats{}}
+	var files []*fileStats
+	if _, err := store.load(statsDoc, &files); err != nil {
+		return nil, err
+	}
+	for _, fs := range files {
+		fs.seen = make(map[string]struct{}, len(fs.Clients))
+		for _, id := range fs.Clients {
+			fs.seen[id] = struct{}{}
+		}
+		s.files[fs.Path] = fs
+	}
+	return s, nil
+}
+
+// record accounts n bytes served of the share-relative path p to client.
+// Partial responses only add their bytes, so that players fetching a file
+// in ranges don't inflate the download count.
+func (s *statsStore) record(p, client string, n int64, complete bool) {
+	sum := sha256.Sum256([]byte(client))
+	id := hex.EncodeToString(sum[:8])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fs, ok := s.files[p]
+	if !ok {
+		fs = &fileStats{FileStats: FileStats{Path: p}, seen: map[string]struct{}{}}
+		s.files[p] = fs
+	}
+	if complete {
+		fs.Downloads++
+	}
+	fs.Bytes += n
+	fs.LastAccess = time.Now().UTC()
+	if _, ok := fs.seen[id]; !ok && len(fs.seen) < statsMaxClients {
+		fs.seen[id] = struct{}{}
+		fs.Clients = append(fs.Clients, id)
+		fs.UniqueClients = len(fs.seen)
+	}
+	s.dirty = true
+}
+
+// list returns the statistics of the files below prefix.
+func (s *statsStore) list(prefix string) []FileStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := []FileStats{}
+	for p, fs := range s.files {
+		if strings.HasPrefix(p, prefix) {
+			files = append(files, fs.FileStats)
+		}
+	}
+	return files
+}
+
+func (s *statsStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	files := make([]*fileStats, 0, len(s.files))
+	for _, fs := range s.files {
+		files = append(files, fs)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	if err := s.store.save(statsDoc, files); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// run saves the statistics periodically until ctx is done.
+func (s *statsStore) run(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(statsSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				logger.Println("Error saving download statistics:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// countDownload accounts the response to a download of the share-relative
+// path p once it has been written through rec.
+func (c *controller) countDownload(r *http.Request, rec *statusRecorder, p string) {
+	if c.stats == nil || r.Method != http.MethodGet {
+		return
+	}
+	if rec.status != http.StatusOK && rec.status != http.StatusPartialContent {
+		return
+	}
+	complete := rec.status == http.StatusOK && r.Context().Err() == nil
+	c.stats.record(p, clientIP(r), rec.written, complete)
+}
+
+type StatsPage struct {
+	Path      string      `json:"path"`
+	Sort      string      `json:"sort"`
+	Downloads int64       `json:"downloads"`
+	Bytes     int64       `json:"bytes"`
+	Files     []FileStats `json:"files"`
+	// Quotas is the use of the quotas by the client asking, see -quota.
+	Quotas []QuotaUsage `json:"quotas,omitempty"`
+}
+
+// statistics lists the download statistics of the files below the path
+// parameter, most downloaded first unless sort asks for bytes, clients or
+// last_access.
+func (c *controller) statistics(w http.ResponseWriter, r *http.Request) {
+	// The statistics name files, which listings may be meant to keep private
+	if c.stats == nil || c.noListing || !c.readable(r) {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	page := StatsPage{Path: q.Get("path"), Sort: q.Get("sort"), Files: []FileStats{}}
+	if page.Path == "" {
+		page.Path = "/"
+	}
+	less := map[string]func(a, b FileStats) bool{
+		"downloads":   func(a, b FileStats) bool { return a.Downloads > b.Downloads },
+		"bytes":       func(a, b FileStats) bool { return a.Bytes > b.Bytes },
+		"clients":     func(a, b FileStats) bool { return a.UniqueClients > b.UniqueClients },
+		"last_access": func(a, b FileStats) bool { return a.LastAccess.After(b.LastAccess) },
+	}
+	if page.Sort == "" {
+		page.Sort = "downloads"
+	}
+	by, ok := less[page.Sort]
+	if !ok {
+		http.Error(w, fmt.Sprintf("invalid sort %q", page.Sort), http.StatusBadRequest)
+		return
+	}
+	limit := DefaultStatsLimit
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	for _, fs := range c.stats.list(page.Path) {
+		if c.isHidden(fs.Path, false) {
+			continue
+		}
+		page.Downloads += fs.Downloads
+		page.Bytes += fs.Bytes
+		page.Files = append(page.Files, fs)
+	}
+	sort.Slice(page.Files, func(i, j int) bool { return page.Files[i].Path < page.Files[j].Path })
+	sort.SliceStable(page.Files, func(i, j int) bool { return by(page.Files[i], page.Files[j]) })
+	if len(page.Files) > limit {
+		page.Files = page.Files[:limit]
+	}
+	if c.quotas != nil {
+		page.Quotas = c.quotas.list(c.quotaClient(r))
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r) {
+		c.writeJSON(w, r, page)
+		return
+	}
+	if err := statsTemplate.Execute(w, page); err != nil {
+		c.internalError(w, r, "Error rendering stats page:", err)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Names of the documents holding the server state.
+const (
+	sharesDoc    = "shares"
+	statsDoc     = "stats"
+	transfersDoc = "transfers"
+	tokensDoc    = "tokens"
+	settingsDoc  = "settings"
+	metadataDoc  = "metadata"
+	favoritesDoc = "favorites"
+	metaDoc      = "meta"
+	quotasDoc    = "quotas"
+	checksumsDoc = "checksums"
+)
+
+const (
+	dbFileName = "gosfs.db"
+	// dbCompactMin is the size below which the database file isn't
+	// compacted, however much of it is garbage.
+	dbCompactMin = 1 << 20
+)
+
+// docStore persists the server state as named JSON documents.
+type docStore interface {
+	// load decodes the document name into v, reporting whether it exists.
+	load(name string, v interface{}) (bool, error)
+	// save replaces the document name with v atomically.
+	save(name string, v interface{}) error
+	Close() error
+}
+
+// fileStore keeps each document in its own JSON file of the data
+// directory.
+type fileStore struct {
+	dir string
+}
+
+func (fs fileStore) load(name string, v interface{}) (bool, error) {
+	file := filepath.Join(fs.dir, name+".json")
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	return true, nil
+}
+
+func (fs fileStore) save(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(fs.dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(fs.dir, name+".json.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(fs.dir, name+".json"))
+}
+
+func (fs fileStore) Close() error { return nil }
+
+// dbRecord is a version of a document in the database file.
+type dbRecord struct {
+	Doc   string          `json:"doc"`
+	Value json.RawMessage `json:"value"`
+}
+
+// db is an embedded database holding all documents in a single file. Each
+// save appends the new version of the document as a line and syncs it, so
+// that a crash loses at most the save in progress. The latest versions are
+// kept in memory, and the file is compacted to them once it is mostly made
+// of old versions.
+type db struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	docs map[string]json.RawMessage
+	size int64 // of the file
+}
+
+// openDB opens the database file, creating it if needed, and migrates it to
+// the current schema.
+func openDB(dataDir string, logger *log.Logger) (*db, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &db{path: filepath.Join(dataDir, dbFileName), docs: map[string]json.RawMessage{}}
+	f, err := os.OpenFile(d.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	d.file = f
+	if err = d.read(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = d.migrate(dataDir, logger); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// read loads the latest version of every document. A partially written
+// last line, left by a crash, is cut off.
+func (d *db) read() error {
+	r := bufio.NewReader(d.file)
+	var valid int64
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var rec dbRecord
+		if err := json.Unmarshal(line, &rec); err != nil || rec.Doc == "" {
+			return fmt.Errorf("%s:%d: corrupt record", d.path, n)
+		}
+		if string(rec.Value) == "null" {
+			delete(d.docs, rec.Doc)
+		} else {
+			d.docs[rec.Doc] = rec.Value
+		}
+		valid += int64(len(line))
+	}
+	if err := d.file.Truncate(valid); err != nil {
+		return err
+	}
+	d.size = valid
+	_, err := d.file.Seek(valid, io.SeekStart)
+	return err
+}
+
+func (d *db) load(name string, v interface{}) (bool, error) {
+	d.mu.Lock()
+	b, ok := d.docs[name]
+	d.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("parsing %s of %s: %w", name, d.path, err)
+	}
+	return true, nil
+}
+
+func (d *db) save(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(dbRecord{Doc: name, Value: b})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err = d.file.Write(line); err == nil {
+		err = d.file.Sync()
+	}
+	if err != nil {
+		// Drop what may have been written, it would corrupt the next record
+		d.file.Truncate(d.size)
+		d.file.Seek(d.size, io.SeekStart)
+		return err
+	}
+	d.size += int64(len(line))
+	d.docs[name] = b
+	if d.size > dbCompactMin && d.size > 2*d.live() {
+		return d.compact()
+	}
+	return nil
+}
+
+// live returns the size of the latest versions, must be called with d.mu
+// held.
+func (d *db) live() int64 {
+	var n int64
+	for name, b := range d.docs {
+		n += int64(len(name) + len(b) + len(`{"doc":"","value":}`) + 1)
+	}
+	return n
+}
+
+// compact rewrites the file with the latest versions only, must be called
+// with d.mu held.
+func (d *db) compact() error {
+	names := make([]string, 0, len(d.docs))
+	for name := range d.docs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		line, err := json.Marshal(dbRecord{Doc: name, Value: d.docs[name]})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), dbFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(buf.Bytes()); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = os.Rename(tmp.Name(), d.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	d.file.Close()
+	d.file = tmp
+	d.size = int64(buf.Len())
+	_, err = d.file.Seek(d.size, io.SeekStart)
+	return err
+}
+
+func (d *db) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
+
+// dbMeta records the schema version of the database.
+type dbMeta struct {
+	Version int `json:"version"`
+}
+
+// migrations bring the database from the version of their index to the
+// next. They are only ever appended to.
+var migrations = []func(d *db, dataDir string, logger *log.Logger) error{
+	importJSONFiles,
+	importChecksums,
+	importQuotas,
+}
+
+func (d *db) migrate(dataDir string, logger *log.Logger) error {
+	var meta dbMeta
+	if _, err := d.load(metaDoc, &meta); err != nil {
+		return err
+	}
+	if meta.Version > len(migrations) {
+		return fmt.Errorf("%s has schema version %d, this gosfs only knows up to %d", d.path, meta.Version, len(migrations))
+	}
+	for ; meta.Version < len(migrations); meta.Version++ {
+		logger.Printf("Migrating %s to schema version %d\n", d.path, meta.Version+1)
+		if err := migrations[meta.Version](d, dataDir, logger); err != nil {
+			return fmt.Errorf("migrating %s to version %d: %w", d.path, meta.Version+1, err)
+		}
+		if err := d.save(metaDoc, dbMeta{Version: meta.Version + 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importJSONFiles takes over the state kept in JSON files before the
+// database was enabled.
+func importJSONFiles(d *db, dataDir string, logger *log.Logger) error {
+	return importJSONDocs(d, dataDir, logger, sharesDoc, statsDoc, transfersDoc, tokensDoc, settingsDoc, metadataDoc, favoritesDoc)
+}
+
+// importChecksums takes over the checksums of -scrub, which the first
+// version left in their JSON file.
+func importChecksums(d *db, dataDir string, logger *log.Logger) error {
+	return importJSONDocs(d, dataDir, logger, checksumsDoc)
+}
+
+// importQuotas takes over the usage of -quota, which the first version
+// left in its JSON file too.
+func importQuotas(d *db, dataDir string, logger *log.Logger) error {
+	return importJSONDocs(d, dataDir, logger, quotasDoc)
+}
+
+// importJSONDocs imports the JSON files of the named documents, if any.
+// The files are renamed rather than removed.
+func importJSONDocs(d *db, dataDir string, logger *log.Logger, names ...string) error {
+	files := fileStore{dir: dataDir}
+	for _, name := range names {
+		var v json.RawMessage
+		ok, err := files.load(name, &v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = d.save(name, v); err != nil {
+			return err
+		}
+		file := filepath.Join(dataDir, name+".json")
+		if err = os.Rename(file, file+".imported"); err != nil {
+			return err
+		}
+		logger.Printf("Imported %s into the database\n", file)
+	}
+	return nil
+}
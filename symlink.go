@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies, see controller.allowed.
+const (
+	SymlinksNever      = "never"
+	SymlinksWithinRoot = "within-root"
+	SymlinksAlways     = "always"
+)
+
+func validSymlinkPolicy(policy string) error {
+	switch policy {
+	case SymlinksNever, SymlinksWithinRoot, SymlinksAlways:
+		return nil
+	}
+	return fmt.Errorf("unknown symlink policy %q, expected %s, %s or %s",
+		policy, SymlinksNever, SymlinksWithinRoot, SymlinksAlways)
+}
+
+// allowed reports whether p, a path below rootDir or a union directory,
+// may be accessed under the symlink policy, which confines links to the
+// directory they are in. Paths which don't exist yet are checked through
+// their parent directory, so that files can't be created through links.
+func (c *controller) allowed(p string) bool {
+	if c.followSymlinks == SymlinksAlways {
+		return true
+	}
+	layer := c.layerOf(p)
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		if _, lerr := os.Lstat(p); lerr == nil || !os.IsNotExist(err) {
+			// Dangling or unresolvable link, don't risk following it.
+			return false
+		}
+		parent := filepath.Dir(p)
+		if parent == p || !strings.HasPrefix(p, layer.dir) {
+			return false
+		}
+		return c.allowed(parent)
+	}
+	rel, err := filepath.Rel(layer.real, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	if c.followSymlinks == SymlinksNever {
+		// Without any link on the way the resolved path is the requested one.
+		want, err := filepath.Rel(layer.dir, p)
+		return err == nil && want == rel
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const DefaultThumbSize = 256
+
+// thumbExts are the image formats thumbnails can be generated for.
+var thumbExts = words(".jpg .jpeg .png .gif")
+
+func hasThumbnail(name string) bool {
+	return thumbExts[strings.ToLower(path.Ext(name))]
+}
+
+type thumbCall struct {
+	done chan struct{}
+	err  error
+}
+
+// thumbnailer generates thumbnails as jobs of the worker pool, at most
+// limit at a time, and caches them on disk, keyed by the source path, size
+// and modification time so that changed images get new thumbnails.
+// Concurrent requests for the same thumbnail share a single job.
+type thumbnailer struct {
+	dir   string
+	size  int
+	pool  *workerPool
+	limit chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]*thumbCall
+}
+
+func newThumbnailer(dir string, size, workers int, pool *workerPool) *thumbnailer {
+	return &thumbnailer{
+		dir:      dir,
+		size:     size,
+		pool:     pool,
+		limit:    make(chan struct{}, workers),
+		inflight: map[string]*thumbCall{},
+	}
+}
+
+// work generates the thumbnail of a call. The job isn't bound to any
+// request, the client which asked first may leave before it is done.
+func (t *thumbnailer) work(src, dst string, call *thumbCall) {
+	t.limit <- struct{}{}
+	call.err = t.pool.run(t.pool.ctx, "thumbnail", src, func(context.Context) error {
+		return t.generate(src, dst)
+	})
+	<-t.limit
+	t.mu.Lock()
+	delete(t.inflight, dst)
+	t.mu.Unlock()
+	close(call.done)
+}
+
+// get returns the path of the cached thumbnail for src, generating it first
+// if needed.
+func (t *thumbnailer) get(src string, info fs.FileInfo) (string, error) {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d", src, info.Size(), info.ModTime().UnixNano(), t.size)))
+	key := hex.EncodeToString(sum[:])
+	dst := filepath.Join(t.dir, key[:2], key+".jpg")
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+
+	t.mu.Lock()
+	call, ok := t.inflight[dst]
+	if !ok {
+		call = &thumbCall{done: make(chan struct{})}
+		t.inflight[dst] = call
+	}
+	t.mu.Unlock()
+	if !ok {
+		go t.work(src, dst, call)
+	}
+	<-call.done
+	return dst, call.err
+}
+
+func (t *thumbnailer) generate(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see partial images.
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = jpeg.Encode(tmp, resize(img, t.size), &jpeg.Options{Quality: 80})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// resize scales img down to fit into a size x size box, keeping the aspect
+// ratio. Each destination pixel averages a grid of up to 4x4 samples from
+// the area it covers, which is plenty for thumbnails.
+func resize(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		size = w
+		if h > w {
+			size = h
+		}
+	}
+	dw, dh := size, size
+	if w > h {
+		dh = h * size / w
+	} else {
+		dw = w * size / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	const samples = 4
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var r, g, bl, a, n uint32
+			for sy := 0; sy < samples; sy++ {
+				py := b.Min.Y + (y*samples+sy)*h/(dh*samples)
+				for sx := 0; sx < samples; sx++ {
+					px := b.Min.X + (x*samples+sx)*w/(dw*samples)
+					cr, cg, cb, ca := img.At(px, py).RGBA()
+					r, g, bl, a, n = r+cr, g+cg, bl+cb, a+ca, n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+func (c *controller) thumbnail(w http.ResponseWriter, r *http.Request) {
+	if c.thumbs == nil || !c.readable(r) {
+		http.NotFound(w, r)
+		return
+	}
+	rel := strings.TrimPrefix(r.URL.Path, "/thumb")
+	src := c.fsPath(rel)
+	info, err := os.Stat(src)
+	if err != nil || !info.Mode().IsRegular() || !hasThumbnail(src) ||
+		c.isHidden(rel, false) || !c.allowed(src) {
+		http.NotFound(w, r)
+		return
+	}
+	dst, err := c.thumbs.get(src, info)
+	if err != nil {
+		c.log(r).Println("Error generating thumbnail:", err)
+		http.Error(w, "unable to generate thumbnail", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, dst)
+}
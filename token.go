@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenIDLen     = 8
+	tokenSecretLen = 32
+	// tokenPrefix makes API tokens recognizable, e.g. to secret scanners.
+	tokenPrefix = "gosfs_"
+)
+
+// APIToken lets scripts authenticate as a user with a bearer token instead
+// of the user's password. Only a hash of the secret is kept.
+type APIToken struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Hash    string    `json:"hash,omitempty"` // not shown by the API
+	Created time.Time `json:"created"`
+}
+
+// tokenStore keeps the API tokens.
+type tokenStore struct {
+	store docStore
+
+	mu     sync.Mutex
+	tokens map[string]*APIToken // by hash
+}
+
+func loadTokens(store docStore) (*tokenStore, error) {
+	s := &tokenStore{store: store, tokens: map[string]*APIToken{}}
+	var tokens []*APIToken
+	if _, err := store.load(tokensDoc, &tokens); err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		s.tokens[t.Hash] = t
+	}
+	return s, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// save must be called with s.mu held.
+func (s *tokenStore) save() error {
+	tokens := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return s.store.save(tokensDoc, tokens)
+}
+
+// create issues a token for user, returning it with its secret, which
+// can't be recovered later.
+func (s *tokenStore) create(user string) (APIToken, string, error) {
+	id, err := randomToken(tokenIDLen)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	secret, err := randomToken(tokenSecretLen)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	secret = tokenPrefix + id + "_" + secret
+	t := &APIToken{ID: id, User: user, Hash: hashToken(secret), Created: time.Now().UTC()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.Hash] = t
+	shown := *t
+	shown.Hash = ""
+	return shown, secret, s.save()
+}
+
+// user returns the user the token secret was issued to.
+func (s *tokenStore) user(secret string) (string, bool) {
+	t, ok := s.lookup(secret)
+	return t.User, ok
+}
+
+// lookup returns the token with the given secret.
+func (s *tokenStore) lookup(secret string) (APIToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[hashToken(secret)]
+	if !ok {
+		return APIToken{}, false
+	}
+	return *t, true
+}
+
+func (s *tokenStore) list() []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := []APIToken{}
+	for _, t := range s.tokens {
+		shown := *t
+		shown.Hash = ""
+		tokens = append(tokens, shown)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens
+}
+
+// remove revokes the tokens with the given ID, or all tokens of the given
+// user.
+func (s *tokenStore) remove(id, user string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for hash, t := range s.tokens {
+		if (id != "" && t.ID == id) || (user != "" && t.User == user) {
+			delete(s.tokens, hash)
+			found = true
+		}
+	}
+	if !found {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// bearerUser returns the user of the API token r carries.
+func (c *controller) bearerUser(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if c.tokens == nil || !strings.HasPrefix(auth, "Bearer "+tokenPrefix) {
+		return "", false
+	}
+	return c.tokens.user(strings.TrimPrefix(auth, "Bearer "))
+}
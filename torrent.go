@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	torrentMinPiece = 256 << 10
+	torrentMaxPiece = 16 << 20
+	// torrentPieces is the number of pieces aimed at, which keeps the
+	// metainfo of huge files small.
+	torrentPieces = 2000
+)
+
+// bencoded is a value which is bencoded already.
+type bencoded []byte
+
+// bencode encodes strings, integers, lists and dictionaries as in BEP 3.
+func bencode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case bencoded:
+		buf.Write(v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, e := range v {
+			bencode(buf, e)
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// Keys are sorted as raw strings.
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			bencode(buf, k)
+			bencode(buf, v[k])
+		}
+		buf.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// torrentMaker creates the metainfo of files and directories, with the
+// server as web seed (BEP 19), and caches their info dictionaries by
+// content version, since hashing them takes a while. One torrent is made
+// at a time.
+type torrentMaker struct {
+	dir      string
+	trackers []string
+	pool     *workerPool
+
+	mu sync.Mutex
+}
+
+func newTorrentMaker(dir string, trackers []string, pool *workerPool) (*torrentMaker, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &torrentMaker{dir: dir, trackers: trackers, pool: pool}, nil
+}
+
+// pieceLength picks the piece length for a torrent of size bytes.
+func pieceLength(size int64) int64 {
+	n := int64(torrentMinPiece)
+	for n < torrentMaxPiece && size/n > torrentPieces {
+		n *= 2
+	}
+	return n
+}
+
+// info returns the bencoded info dictionary of the entries, named name,
+// hashing them unless that was done for this version already.
+func (tm *torrentMaker) info(ctx context.Context, name, version string, entries []archiveEntry, single bool) ([]byte, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	cached := filepath.Join(tm.dir, version+".info")
+	if b, err := os.ReadFile(cached); err == nil {
+		return b, nil
+	}
+	var b []byte
+	err := tm.pool.run(ctx, "torrent", name, func(ctx context.Context) error {
+		var err error
+		b, err = makeTorrentInfo(ctx, name, entries, single)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(tm.dir, ".info-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cached)
+	}
+	return b, err
+}
+
+// makeTorrentInfo hashes the entries as one stream of pieces.
+func makeTorrentInfo(ctx context.Context, name string, entries []archiveEntry, single bool) ([]byte, error) {
+	var total int64
+	for _, e := range entries {
+		total += e.info.Size()
+	}
+	piece := pieceLength(total)
+	var pieces []byte
+	h := sha1.New()
+	var filled int64
+	files := []interface{}{}
+	for _, e := range entries {
+		f, err := os.Open(e.file)
+		if err != nil {
+			return nil, err
+		}
+		src := io.LimitReader(&contextReader{ctx: ctx, r: f}, e.info.Size())
+		for {
+			n, err := io.CopyN(h, src, piece-filled)
+			filled += n
+			if filled == piece {
+				pieces = h.Sum(pieces)
+				h.Reset()
+				filled = 0
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("hashing %s: %w", e.name, err)
+			}
+		}
+		f.Close()
+		files = append(files, map[string]interface{}{
+			"length": e.info.Size(),
+			"path":   torrentPath(e.name),
+		})
+	}
+	if filled > 0 {
+		pieces = h.Sum(pieces)
+	}
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": piece,
+		"pieces":       pieces,
+	}
+	if single {
+		info["length"] = total
+	} else {
+		info["files"] = files
+	}
+	var buf bytes.Buffer
+	bencode(&buf, info)
+	return buf.Bytes(), nil
+}
+
+// torrentPath splits an entry name below the torrent's top directory into
+// its path elements.
+func torrentPath(name string) []interface{} {
+	var elems []interface{}
+	for _, s := range strings.Split(name, "/")[1:] {
+		elems = append(elems, s)
+	}
+	return elems
+}
+
+// torrent sends a .torrent of the file or directory at p, which lists the
+// server as web seed so that peers can start from it and share the load.
+func (c *controller) torrent(w http.ResponseWriter, r *http.Request, p string, file fs.FileInfo) {
+	display, err := c.relPath(p, file.IsDir())
+	if err != nil {
+		c.internalError(w, r, "Error making torrent:", err)
+		return
+	}
+	if display == "/" {
+		// Web seeds append the torrent name to their URL, which the root lacks.
+		http.Error(w, "the root directory can't be a torrent", http.StatusBadRequest)
+		return
+	}
+	var entries []archiveEntry
+	var version string
+	name := path.Base(display)
+	seed := c.urls.url(r, display)
+	if file.IsDir() {
+		if entries, version, _, err = c.archiveEntries(p, display); err != nil {
+			c.internalError(w, r, "Error listing files for torrent:", err)
+			return
+		}
+		if len(entries) == 0 {
+			http.Error(w, "no files to share", http.StatusNotFound)
+			return
+		}
+		seed = c.urls.url(r, path.Dir(strings.TrimSuffix(display, "/")))
+		if !strings.HasSuffix(seed, "/") {
+			seed += "/"
+		}
+	} else {
+		entries = []archiveEntry{{name: name, file: p, info: file}}
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d", display, file.Size(), file.ModTime().UnixNano())))
+		version = fmt.Sprintf("%x", sum[:16])
+	}
+
+	info, err := c.torrents.info(r.Context(), name, version, entries, !file.IsDir())
+	if err != nil {
+		if r.Context().Err() == nil {
+			c.internalError(w, r, "Error making torrent:", err)
+		}
+		return
+	}
+	meta := map[string]interface{}{
+		"info":          bencoded(info),
+		"url-list":      []interface{}{seed},
+		"created by":    "gosfs",
+		"creation date": file.ModTime().Unix(),
+	}
+	if len(c.torrents.trackers) > 0 {
+		meta["announce"] = c.torrents.trackers[0]
+		tier := []interface{}{}
+		for _, t := range c.torrents.trackers {
+			tier = append(tier, t)
+		}
+		meta["announce-list"] = []interface{}{tier}
+	}
+	var buf bytes.Buffer
+	bencode(&buf, meta)
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".torrent"}))
+	http.ServeContent(w, r, "", file.ModTime(), bytes.NewReader(buf.Bytes()))
+}
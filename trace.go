@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxRequestIDLength bounds the request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+// traceContext is the W3C trace context of a request: the trace it belongs
+// to and a span of it, the caller's as parsed and the server's once the
+// tracing middleware took over.
+type traceContext struct {
+	traceID string
+	spanID  string
+	flags   string
+}
+
+// traceparent returns the traceparent header value of the span.
+func (tc traceContext) traceparent() string {
+	return "00-" + tc.traceID + "-" + tc.spanID + "-" + tc.flags
+}
+
+// child returns the context of a new span below tc, for the server's span
+// of a request and for outgoing requests.
+func (tc traceContext) child() traceContext {
+	return traceContext{traceID: tc.traceID, spanID: randomHex(8), flags: tc.flags}
+}
+
+// parseTraceparent parses a version 00 traceparent header. Later versions
+// are read as far as version 00 goes, as the specification asks.
+func parseTraceparent(h string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	tc := traceContext{traceID: parts[1], spanID: parts[2], flags: parts[3]}
+	if !isLowerHex(parts[0]) || len(tc.traceID) != 32 || !isLowerHex(tc.traceID) || isZeroHex(tc.traceID) ||
+		len(tc.spanID) != 16 || !isLowerHex(tc.spanID) || isZeroHex(tc.spanID) ||
+		len(tc.flags) != 2 || !isLowerHex(tc.flags) {
+		return traceContext{}, false
+	}
+	return tc, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZeroHex(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newRequestID returns a UUIDv7, which is unique and sorts by time.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(b[:6], ms[2:])
+	b[6] = b[6]&0x0f | 0x70 // version 7
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validRequestID reports whether a client supplied request ID can be used
+// as is, in headers and log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID of r, set by the tracing middleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// trace returns the trace context of r, set by the tracing middleware.
+func trace(r *http.Request) traceContext {
+	tc, _ := r.Context().Value(traceKey).(traceContext)
+	return tc
+}
+
+// requestLogger prefixes the lines logged on behalf of a request with its
+// ID, like the access log line of the request.
+type requestLogger struct {
+	*log.Logger
+	id string
+}
+
+func (l requestLogger) Println(v ...interface{}) {
+	l.Output(2, fmt.Sprintln(append([]interface{}{l.id}, v...)...))
+}
+
+func (l requestLogger) Printf(format string, v ...interface{}) {
+	l.Output(2, l.id+" "+fmt.Sprintf(format, v...))
+}
+
+// log returns the logger for messages about r.
+func (c *controller) log(r *http.Request) requestLogger {
+	id := requestID(r)
+	if id == "" {
+		id = "unknown"
+	}
+	return requestLogger{Logger: c.logger, id: id}
+}
+
+// errorPageWriter turns the plain text error pages of http.Error into the
+// error format of the client, holding them back until complete. Plain text
+// pages get the request ID appended, so that users can quote it when
+// reporting problems.
+type errorPageWriter struct {
+	*countingWriter
+	format int
+	status int
+	held   *bytes.Buffer // the error page, unless plain text is wanted
+}
+
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if ew.status != 0 {
+		return
+	}
+	ew.status = status
+	h := ew.Header()
+	if status >= 400 && ew.format != errorText &&
+		h.Get("Content-Encoding") == "" && strings.HasPrefix(h.Get("Content-Type"), "text/plain") {
+		ew.held = new(bytes.Buffer)
+		return
+	}
+	ew.countingWriter.WriteHeader(status)
+}
+
+func (ew *errorPageWriter) Write(b []byte) (int, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.held != nil {
+		return ew.held.Write(b)
+	}
+	return ew.countingWriter.Write(b)
+}
+
+func (ew *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.held != nil {
+		return ew.held.ReadFrom(src)
+	}
+	return ew.countingWriter.ReadFrom(src)
+}
+
+func (ew *errorPageWriter) Flush() {
+	if ew.held == nil {
+		ew.countingWriter.Flush()
+	}
+}
+
+// finish completes the error page, if the response is one.
+func (ew *errorPageWriter) finish(r *http.Request) {
+	if ew.held != nil {
+		writeError(ew.countingWriter, r, ew.status, APIError{Message: strings.TrimSpace(ew.held.String())})
+		return
+	}
+	h := ew.Header()
+	if ew.status < 400 || ew.n == 0 ||
+		h.Get("Content-Encoding") != "" || !strings.HasPrefix(h.Get("Content-Type"), "text/plain") {
+		return
+	}
+	fmt.Fprintf(ew, "request id: %s\n", requestID(r))
+}
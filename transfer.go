@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	transfersSaveInterval = time.Minute
+	// monthFormat names the accounting periods.
+	monthFormat = "2006-01"
+)
+
+// Transfer is the traffic of a user in a month.
+type Transfer struct {
+	User       string `json:"user"`
+	Month      string `json:"month"`
+	Uploaded   int64  `json:"uploaded"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+// transferStore accounts the bytes authenticated users transfer per month
+// and persists them periodically.
+type transferStore struct {
+	store docStore
+
+	mu        sync.Mutex
+	transfers map[string]map[string]*Transfer // by user and month
+	dirty     bool
+}
+
+func loadTransfers(store docStore) (*transferStore, error) {
+	s := &transferStore{store: store, transfers: map[string]map[string]*Transfer{}}
+	var transfers []*Transfer
+	if _, err := store.load(transfersDoc, &transfers); err != nil {
+		return nil, err
+	}
+	for _, t := range transfers {
+		if s.transfers[t.User] == nil {
+			s.transfers[t.User] = map[string]*Transfer{}
+		}
+		s.transfers[t.User][t.Month] = t
+	}
+	return s, nil
+}
+
+func (s *transferStore) add(user string, uploaded, downloaded int64) {
+	if uploaded == 0 && downloaded == 0 {
+		return
+	}
+	month := time.Now().UTC().Format(monthFormat)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transfers[user] == nil {
+		s.transfers[user] = map[string]*Transfer{}
+	}
+	t, ok := s.transfers[user][month]
+	if !ok {
+		t = &Transfer{User: user, Month: month}
+		s.transfers[user][month] = t
+	}
+	t.Uploaded += uploaded
+	t.Downloaded += downloaded
+	s.dirty = true
+}
+
+// used returns the bytes user transferred in the current month.
+func (s *transferStore) used(user string) int64 {
+	month := time.Now().UTC().Format(monthFormat)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.transfers[user][month]; ok {
+		return t.Uploaded + t.Downloaded
+	}
+	return 0
+}
+
+// list returns the transfers of user and month, all if empty, ordered by
+// user and month.
+func (s *transferStore) list(user, month string) []Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfers := []Transfer{}
+	for u, months := range s.transfers {
+		if user != "" && u != user {
+			continue
+		}
+		for m, t := range months {
+			if month == "" || m == month {
+				transfers = append(transfers, *t)
+			}
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].User != transfers[j].User {
+			return transfers[i].User < transfers[j].User
+		}
+		return transfers[i].Month < transfers[j].Month
+	})
+	return transfers
+}
+
+func (s *transferStore) save() error {
+	transfers := s.list("", "")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if err := s.store.save(transfersDoc, transfers); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// run saves the transfers periodically until ctx is done.
+func (s *transferStore) run(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(transfersSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				logger.Println("Error saving transfers:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to a response, keeping the
+// optional interfaces of the writer it wraps which the handlers rely on.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := cw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{cw.ResponseWriter}, src)
+	}
+	cw.n += n
+	return n, err
+}
+
+func (cw *countingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T doesn't support hijacking", cw.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the connection under cw.
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// accountTransfers adds the request and response bodies of authenticated
+// users to their monthly traffic, and refuses their requests once the
+// monthly transfer cap is used up.
+func (c *controller) accountTransfers(hdlr http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user := c.user(req)
+		if user == "" {
+			hdlr.ServeHTTP(w, req)
+			return
+		}
+		if limit := c.settings.get().TransferCap; limit > 0 && c.transfers.used(user) >= limit {
+			now := time.Now().UTC()
+			next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			w.Header().Set("Retry-After", strconv.Itoa(int(next.Sub(now)/time.Second)+1))
+			http.Error(w, "monthly transfer cap exceeded", http.StatusTooManyRequests)
+			return
+		}
+		body := &countingReader{ReadCloser: req.Body}
+		req.Body = body
+		cw := &countingWriter{ResponseWriter: w}
+		defer func() { c.transfers.add(user, body.n, cw.n) }()
+		hdlr.ServeHTTP(cw, req)
+	})
+}
+
+// transferQuery returns the monthly transfers, filtered by the user and
+// month (YYYY-MM) parameters.
+func (c *controller) transferQuery(w http.ResponseWriter, r *http.Request) {
+	if c.transfers == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	if m := q.Get("month"); m != "" {
+		if _, err := time.Parse(monthFormat, m); err != nil {
+			http.Error(w, fmt.Sprintf("invalid month %q, expected YYYY-MM", m), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	c.writeJSON(w, r, struct {
+		Cap       int64      `json:"cap,omitempty"`
+		Transfers []Transfer `json:"transfers"`
+	}{c.settings.get().TransferCap, c.transfers.list(q.Get("user"), q.Get("month"))})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// unionDir is a directory merged into the tree of the root directory, see
+// -union-dir, e.g. to present files spread over several disks as one share.
+// A path resolves to the first directory holding it, the root directory
+// before the union directories in the order given, and directories list
+// the entries of all of them. New files go to the union directory with the
+// longest write prefix of their path, or else to the root directory;
+// existing files are changed where they are.
+type unionDir struct {
+	dir   string
+	real  string // dir with symlinks resolved
+	write string // share path prefix of the new files it takes, if any
+}
+
+type unionDirs []unionDir
+
+func (dirs *unionDirs) String() string {
+	var s []string
+	for _, d := range *dirs {
+		s = append(s, d.String())
+	}
+	return strings.Join(s, "; ")
+}
+
+func (d unionDir) String() string {
+	if d.write == "" {
+		return d.dir
+	}
+	return d.dir + " write=" + d.write
+}
+
+// Set parses a union directory "dir [write=/prefix]".
+func (dirs *unionDirs) Set(s string) error {
+	d := unionDir{dir: strings.TrimSpace(s)}
+	if i := strings.LastIndex(s, " write="); i >= 0 {
+		d.dir = strings.TrimSpace(s[:i])
+		d.write = path.Clean("/" + strings.TrimSpace(s[i+len(" write="):]))
+		if d.write != "/" {
+			d.write += "/"
+		}
+	}
+	if d.dir == "" {
+		return errors.New("missing union directory")
+	}
+	*dirs = append(*dirs, d)
+	return nil
+}
+
+// checkUnionDirs resolves the union directories, which must exist and must
+// neither overlap with the root directory, resolved in realRoot, nor with
+// one another.
+func checkUnionDirs(dirs unionDirs, realRoot string) error {
+	seen := []string{realRoot}
+	for i := range dirs {
+		d := &dirs[i]
+		d.dir = filepath.Clean(d.dir)
+		info, err := os.Stat(d.dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("union directory %s is not a directory", d.dir)
+		}
+		if d.real, err = filepath.EvalSymlinks(d.dir); err != nil {
+			return err
+		}
+		for _, other := range seen {
+			if within(d.real, other) || within(other, d.real) {
+				return fmt.Errorf("union directory %s overlaps with %s", d.dir, other)
+			}
+		}
+		seen = append(seen, d.real)
+	}
+	return nil
+}
+
+// layers returns the directories of the tree in the order of precedence,
+// the root directory first.
+func (c *controller) layers() []unionDir {
+	return append([]unionDir{{dir: c.rootDir, real: c.realRoot}}, c.unions...)
+}
+
+// fsPath returns the file of the share path rel, in the first layer which
+// holds it, or where it is created if none does.
+func (c *controller) fsPath(rel string) string {
+	rel = path.Clean("/" + rel)
+	if len(c.unions) == 0 {
+		return filepath.Join(c.rootDir, filepath.FromSlash(rel))
+	}
+	for _, l := range c.layers() {
+		p := filepath.Join(l.dir, filepath.FromSlash(rel))
+		if _, err := os.Lstat(p); err == nil {
+			return p
+		}
+	}
+	return filepath.Join(c.writeDir(rel), filepath.FromSlash(rel))
+}
+
+// writeDir returns the layer new files at the share path rel are created in.
+func (c *controller) writeDir(rel string) string {
+	dir, prefix := c.rootDir, ""
+	for _, u := range c.unions {
+		if u.write != "" && strings.HasPrefix(rel, u.write) && len(u.write) > len(prefix) {
+			dir, prefix = u.dir, u.write
+		}
+	}
+	return dir
+}
+
+// layerOf returns the layer holding the file p, the root directory if p
+// is in none of them.
+func (c *controller) layerOf(p string) unionDir {
+	for _, u := range c.unions {
+		if within(p, u.dir) {
+			return u
+		}
+	}
+	return unionDir{dir: c.rootDir, real: c.realRoot}
+}
+
+// dirLayers returns the directories listed for the share path display, of
+// which p is the first: those of all layers holding it as a directory.
+func (c *controller) dirLayers(display, p string) []string {
+	dirs := []string{p}
+	for _, l := range c.layers() {
+		d := filepath.Join(l.dir, filepath.FromSlash(display))
+		if d == p {
+			continue
+		}
+		if info, err := os.Stat(d); err == nil && info.IsDir() && c.allowed(d) {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// urlBuilder makes the absolute URLs of links which leave the browser, e.g.
+// share links, QR codes and playlists. They point to the external URL if
+// there is one, e.g. of a reverse proxy serving gosfs below a base path,
+// and otherwise to the address the client used.
+type urlBuilder struct {
+	external *url.URL // nil without -external-url
+}
+
+func newURLBuilder(external string) (*urlBuilder, error) {
+	if external == "" {
+		return &urlBuilder{}, nil
+	}
+	u, err := url.Parse(external)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid external url %q", external)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return &urlBuilder{external: u}, nil
+}
+
+// base returns the URL which paths are relative to for the client of r.
+func (b *urlBuilder) base(r *http.Request) *url.URL {
+	if b.external != nil {
+		u := *b.external
+		return &u
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// r.Host keeps the brackets of IPv6 literals.
+	return &url.URL{Scheme: scheme, Host: r.Host}
+}
+
+// url turns the path p into an absolute URL for the client of r.
+func (b *urlBuilder) url(r *http.Request, p string) string {
+	u := b.base(r)
+	u.Path += p
+	return u.String()
+}
+
+// link turns a link of a page, an escaped path with an optional query, into
+// an absolute URL for the client of r.
+func (b *urlBuilder) link(r *http.Request, ref string) string {
+	rel, err := url.Parse(ref)
+	if err != nil {
+		return b.url(r, ref)
+	}
+	u := b.base(r)
+	u.Path += rel.Path
+	u.RawQuery = rel.RawQuery
+	return u.String()
+}
+
+// ours reports whether u is a URL of this server for the client of r.
+func (b *urlBuilder) ours(r *http.Request, u *url.URL) bool {
+	if u.Host == r.Host {
+		return true
+	}
+	return b.external != nil && u.Host == b.external.Host &&
+		strings.HasPrefix(u.Path, b.external.Path+"/")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHLSJobs   = 2
+	hlsPlaylist      = "index.m3u8"
+	hlsCompleted     = "complete"
+	hlsStartupWait   = 15 * time.Second
+	hlsSegmentLength = "6"
+)
+
+//go:embed player.html
+var playerContent string
+
+var playerTemplate = template.Must(template.New("player").Parse(playerContent))
+
+var videoExts = words(".mp4 .m4v .webm .mkv .mov .avi .ogv")
+
+func isVideo(name string) bool {
+	return videoExts[strings.ToLower(path.Ext(name))]
+}
+
+type Player struct {
+	Kind     string
+	Name     string
+	Link     string
+	Parent   string
+	HLS      string
+	Playlist string
+	Tracks   []Track
+}
+
+// transcoder turns videos into HLS streams with an external ffmpeg binary.
+// Segments are cached under dir, keyed by source path and modification
+// time, and at most jobs transcodes run at the same time.
+type transcoder struct {
+	ffmpeg string
+	dir    string
+	slots  chan struct{}
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newTranscoder(ffmpeg, dir string, jobs int) *transcoder {
+	return &transcoder{
+		ffmpeg:  ffmpeg,
+		dir:     dir,
+		slots:   make(chan struct{}, jobs),
+		running: map[string]bool{},
+	}
+}
+
+func (t *transcoder) key(src string, info fs.FileInfo) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d", src, info.Size(), info.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:])
+}
+
+// start makes sure the stream for src is available or being produced and
+// returns its output directory.
+func (t *transcoder) start(ctx context.Context, src string, info fs.FileInfo) (string, error) {
+	out := filepath.Join(t.dir, t.key(src, info))
+	if _, err := os.Stat(filepath.Join(out, hlsCompleted)); err == nil {
+		return out, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running[out] {
+		return out, nil
+	}
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		return "", errTranscoderBusy
+	}
+	// Leftovers of an interrupted run can't be resumed.
+	os.RemoveAll(out)
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		<-t.slots
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, t.ffmpeg, "-nostdin", "-loglevel", "error",
+		"-i", src,
+		"-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac",
+		"-f", "hls", "-hls_time", hlsSegmentLength, "-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(out, "seg%05d.ts"),
+		filepath.Join(out, hlsPlaylist))
+	if err := cmd.Start(); err != nil {
+		<-t.slots
+		return "", err
+	}
+	t.running[out] = true
+	go func() {
+		err := cmd.Wait()
+		if err == nil {
+			err = os.WriteFile(filepath.Join(out, hlsCompleted), nil, 0o644)
+		}
+		t.mu.Lock()
+		delete(t.running, out)
+		t.mu.Unlock()
+		<-t.slots
+		if err != nil {
+			os.RemoveAll(out)
+		}
+	}()
+	return out, nil
+}
+
+var errTranscoderBusy = fmt.Errorf("too many concurrent transcodes")
+
+// player renders a page embedding the video, offering the HLS stream first
+// when transcoding is enabled.
+func (c *controller) player(w http.ResponseWriter, r *http.Request, info fs.FileInfo) {
+	p := Player{
+		Kind:   "video",
+		Name:   info.Name(),
+		Link:   (&url.URL{Path: r.URL.Path}).String(),
+		Parent: (&url.URL{Path: path.Dir(r.URL.Path)}).String(),
+	}
+	if p.Parent != "/" {
+		p.Parent += "/"
+	}
+	if c.transcoder != nil {
+		p.HLS = (&url.URL{Path: "/hls" + r.URL.Path + "/" + hlsPlaylist}).String()
+	}
+	if err := playerTemplate.Execute(w, p); err != nil {
+		c.internalError(w, r, "Error rendering player page:", err)
+	}
+}
+
+// hls serves /hls/<video path>/index.m3u8 and its segments.
+func (c *controller) hls(w http.ResponseWriter, r *http.Request) {
+	if c.transcoder == nil || !c.readable(r) {
+		http.NotFound(w, r)
+		return
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/hls"))
+	video, name := path.Split(rel)
+	video = strings.TrimSuffix(video, "/")
+	if name != hlsPlaylist && !(strings.HasPrefix(name, "seg") && strings.HasSuffix(name, ".ts")) {
+		http.NotFound(w, r)
+		return
+	}
+	src := c.fsPath(video)
+	info, err := os.Stat(src)
+	if err != nil || !info.Mode().IsRegular() || !isVideo(src) ||
+		c.isHidden(video, false) || !c.allowed(src) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if name != hlsPlaylist {
+		out := filepath.Join(c.transcoder.dir, c.transcoder.key(src, info))
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(w, r, filepath.Join(out, name))
+		return
+	}
+	// The transcode outlives the request which started it.
+	out, err := c.transcoder.start(context.Background(), src, info)
+	if err == errTranscoderBusy {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		c.log(r).Println("Error starting transcode:", err)
+		http.Error(w, "unable to transcode video", http.StatusInternalServerError)
+		return
+	}
+	// Give ffmpeg a moment to produce the playlist of a fresh transcode.
+	playlist := filepath.Join(out, hlsPlaylist)
+	deadline := time.Now().Add(hlsStartupWait)
+	for {
+		if _, err = os.Stat(playlist); err == nil || time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		http.Error(w, "transcode is not ready yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, playlist)
+}
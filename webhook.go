@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Webhook event types.
+const (
+	EventUpload = "upload"
+	EventDelete = "delete"
+	EventMove   = "move"
+	EventShare  = "share"
+	// EventShareExpired is sent once a share expired, after its contents
+	// were archived or deleted if the share asked for it.
+	EventShareExpired = "share_expired"
+	// EventCorrupt is sent for files a scrub found corrupt or unreadable.
+	EventCorrupt = "corrupt"
+)
+
+const (
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+	webhookTimeout  = 10 * time.Second
+)
+
+var webhookEvents = words("upload delete move share share_expired corrupt")
+
+// WebhookEvent is the JSON payload posted to webhooks.
+type WebhookEvent struct {
+	Event      string    `json:"event"`
+	Path       string    `json:"path"`
+	To         string    `json:"to,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Token      string    `json:"token,omitempty"`  // of the share
+	Action     string    `json:"action,omitempty"` // on expiry of the share, or of the corrupt file
+	Error      string    `json:"error,omitempty"`  // what is wrong with the corrupt file
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Time       time.Time `json:"time"`
+
+	// trace is the trace context of the request causing the event.
+	trace traceContext
+	// link is the absolute URL of an uploaded file, for chat messages.
+	link string
+}
+
+// webhook posts the events it subscribed to to url. Payloads are signed
+// with HMAC-SHA256 of the secret, if any, in the X-Gosfs-Signature header.
+type webhook struct {
+	url    string
+	secret string
+	events map[string]bool // nil for all events
+}
+
+// webhooks is a repeatable flag of "url [secret=...] [events=a,b]" hooks.
+type webhooks []webhook
+
+func (hooks *webhooks) String() string {
+	var s []string
+	for _, h := range *hooks {
+		s = append(s, h.url)
+	}
+	return strings.Join(s, "; ")
+}
+
+func (hooks *webhooks) Set(v string) error {
+	fields := strings.Fields(v)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty webhook")
+	}
+	u, err := url.Parse(fields[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q", fields[0])
+	}
+	h := webhook{url: fields[0]}
+	for _, opt := range fields[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid webhook option %q", opt)
+		}
+		switch kv[0] {
+		case "secret":
+			h.secret = kv[1]
+		case "events":
+			h.events = map[string]bool{}
+			for _, ev := range strings.Split(kv[1], ",") {
+				if !webhookEvents[ev] {
+					return fmt.Errorf("unknown webhook event %q", ev)
+				}
+				h.events[ev] = true
+			}
+		default:
+			return fmt.Errorf("unknown webhook option %q", kv[0])
+		}
+	}
+	*hooks = append(*hooks, h)
+	return nil
+}
+
+// notify delivers ev, caused by r, to the interested webhooks and, for
+// uploads, chats in the background. The deliveries continue the trace of r.
+func (c *controller) notify(r *http.Request, ev WebhookEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.RemoteAddr = r.RemoteAddr
+	ev.RequestID = requestID(r)
+	ev.User = c.user(r)
+	ev.trace = trace(r)
+	if ev.Event == EventUpload && len(c.chats) > 0 {
+		ev.link = c.chatLink(r, ev.Path)
+	}
+	c.emit(ev)
+}
+
+// emit delivers ev to the interested webhooks and chats in the background.
+func (c *controller) emit(ev WebhookEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, h := range c.webhooks {
+		if h.events == nil || h.events[ev.Event] {
+			go c.deliver(h, ev)
+		}
+	}
+	if ev.Event != EventUpload || ev.link == "" {
+		return
+	}
+	for _, n := range c.chats {
+		if n.watches(ev.Path) {
+			go c.postChat(n, ev)
+		}
+	}
+}
+
+// deliver posts ev to h, retrying failed attempts with exponential backoff.
+func (c *controller) deliver(h webhook, ev WebhookEvent) {
+	logger := requestLogger{Logger: c.logger, id: ev.RequestID}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logger.Println("Error encoding webhook event:", err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(client, h, ev, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			logger.Printf("Error delivering %s event to webhook %s, giving up: %v\n", ev.Event, h.url, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(client *http.Client, h webhook, ev WebhookEvent, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gosfs-Event", ev.Event)
+	if ev.trace.traceID != "" {
+		req.Header.Set("Traceparent", ev.trace.child().traceparent())
+	}
+	if h.secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write(body)
+		req.Header.Set("X-Gosfs-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsMaxFrame bounds the frames of clients, which only send control
+	// frames to the server's streams.
+	wsMaxFrame     = 4096
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+)
+
+// WebSocket opcodes and close codes used by the server.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+
+	wsGoingAway = 1001
+)
+
+var errWebSocketFrame = errors.New("invalid websocket frame")
+
+// wsConn is the server side of a WebSocket connection (RFC 6455) for
+// streaming messages to the client. Messages of the client are read and
+// dropped, answering pings and closes.
+type wsConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	mu     sync.Mutex // serializes writes
+	once   sync.Once
+	closed chan struct{}
+}
+
+// upgradeWebSocket takes over the connection of r for a WebSocket,
+// responding with an error if the request isn't a valid handshake.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, bool) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "websocket handshake expected", http.StatusUpgradeRequired)
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, false
+	}
+	// Browsers open WebSockets to any site with the user's credentials.
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "cross-origin websocket refused", http.StatusForbidden)
+			return nil, false
+		}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets need HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return nil, false
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "websocket upgrade failed", http.StatusInternalServerError)
+		return nil, false
+	}
+	// The connection outlives the server's timeouts for requests.
+	conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	ws := &wsConn{conn: conn, br: brw.Reader, closed: make(chan struct{})}
+	go ws.readLoop()
+	return ws, true
+}
+
+// headerContains reports whether the comma separated header has token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ws *wsConn) readLoop() {
+	defer ws.close()
+	for {
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch op {
+		case wsPing:
+			if ws.write(wsPong, payload) != nil {
+				return
+			}
+		case wsClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.write(wsClose, payload)
+			return
+		}
+	}
+}
+
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(ws.br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	op := h[0] & 0x0f
+	if h[1]&0x80 == 0 {
+		// Frames of clients must be masked.
+		return 0, nil, errWebSocketFrame
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(ws.br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(ws.br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > wsMaxFrame {
+		return 0, nil, errWebSocketFrame
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// write sends an unfragmented frame.
+func (ws *wsConn) write(op byte, payload []byte) error {
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		frame = append(append(frame, 127), b[:]...)
+	}
+	frame = append(frame, payload...)
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// closeWith sends a close frame with code before closing the connection.
+func (ws *wsConn) closeWith(code uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], code)
+	ws.write(wsClose, b[:])
+	ws.close()
+}
+
+func (ws *wsConn) close() {
+	ws.once.Do(func() {
+		close(ws.closed)
+		ws.conn.Close()
+	})
+}
+
+// webSockets are the open WebSocket connections, which the server doesn't
+// track after handing them over, so that they can be closed on shutdown.
+type webSockets struct {
+	mu       sync.Mutex
+	conns    map[*wsConn]struct{}
+	shutdown bool
+}
+
+func newWebSockets() *webSockets {
+	return &webSockets{conns: map[*wsConn]struct{}{}}
+}
+
+// add registers ws, or closes it if the server is shutting down.
+func (s *webSockets) add(ws *wsConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		ws.closeWith(wsGoingAway)
+		return false
+	}
+	s.conns[ws] = struct{}{}
+	return true
+}
+
+func (s *webSockets) remove(ws *wsConn) {
+	s.mu.Lock()
+	delete(s.conns, ws)
+	s.mu.Unlock()
+	ws.close()
+}
+
+// closeAll tells the clients that the server is going away.
+func (s *webSockets) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown = true
+	for ws := range s.conns {
+		ws.closeWith(wsGoingAway)
+	}
+}
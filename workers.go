@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+const (
+	// jobHistory is the number of finished jobs kept for the admin API.
+	jobHistory = 100
+	// jobsShutdownTimeout bounds the wait for running jobs on shutdown.
+	jobsShutdownTimeout = 10 * time.Second
+)
+
+// defaultWorkers leaves room for thumbnails while long jobs such as
+// index scans run on small machines.
+func defaultWorkers() int {
+	if n := runtime.NumCPU(); n > 4 {
+		return n
+	}
+	return 4
+}
+
+// Job is a unit of background work.
+type Job struct {
+	ID       uint64     `json:"id"`
+	Kind     string     `json:"kind"`
+	Target   string     `json:"target,omitempty"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// workerPool runs the background work of all subsystems with a bounded
+// number of workers. Jobs get the pool's context, which is canceled on
+// shutdown, and the shutdown waits for them to wind down.
+type workerPool struct {
+	ctx   context.Context
+	stop  context.CancelFunc
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	nextID  uint64
+	active  map[uint64]*Job
+	history []Job
+	totals  map[[2]string]int64 // finished jobs by kind and state
+}
+
+func newWorkerPool(workers int) *workerPool {
+	ctx, stop := context.WithCancel(context.Background())
+	return &workerPool{
+		ctx:    ctx,
+		stop:   stop,
+		slots:  make(chan struct{}, workers),
+		active: map[uint64]*Job{},
+		totals: map[[2]string]int64{},
+	}
+}
+
+// run executes fn as a job once a worker is free and returns its error.
+// Jobs still queued when ctx or the pool is done are canceled.
+func (p *workerPool) run(ctx context.Context, kind, target string, fn func(ctx context.Context) error) error {
+	p.mu.Lock()
+	if err := p.ctx.Err(); err != nil {
+		// Shutting down, nothing is started anymore.
+		p.mu.Unlock()
+		return err
+	}
+	p.nextID++
+	job := &Job{ID: p.nextID, Kind: kind, Target: target, State: JobQueued, Queued: time.Now().UTC()}
+	p.active[job.ID] = job
+	p.wg.Add(1)
+	p.mu.Unlock()
+	defer p.wg.Done()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		p.finish(job, ctx.Err())
+		return ctx.Err()
+	case <-p.ctx.Done():
+		p.finish(job, p.ctx.Err())
+		return p.ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	now := time.Now().UTC()
+	job.State, job.Started = JobRunning, &now
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	err := fn(ctx)
+	p.finish(job, err)
+	return err
+}
+
+func (p *workerPool) finish(job *Job, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now().UTC()
+	job.Finished = &now
+	switch {
+	case err == nil:
+		job.State = JobDone
+	case err == context.Canceled || err == context.DeadlineExceeded:
+		job.State = JobCanceled
+	default:
+		job.State, job.Error = JobFailed, err.Error()
+	}
+	delete(p.active, job.ID)
+	p.totals[[2]string{job.Kind, job.State}]++
+	p.history = append(p.history, *job)
+	if len(p.history) > jobHistory {
+		p.history = p.history[len(p.history)-jobHistory:]
+	}
+}
+
+// shutdown cancels the jobs and waits for them to finish, reporting
+// whether they did within timeout.
+func (p *workerPool) shutdown(timeout time.Duration) bool {
+	p.mu.Lock()
+	p.stop()
+	p.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// jobs returns the queued and running jobs, oldest first, and the most
+// recently finished ones, newest first.
+func (p *workerPool) jobs() (active, finished []Job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active = make([]Job, 0, len(p.active))
+	for _, job := range p.active {
+		active = append(active, *job)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].ID < active[j].ID })
+	finished = make([]Job, 0, len(p.history))
+	for i := len(p.history) - 1; i >= 0; i-- {
+		finished = append(finished, p.history[i])
+	}
+	return active, finished
+}
+
+// totalSamples returns the numbers of finished jobs as metric samples,
+// ordered by kind and state.
+func (p *workerPool) totalSamples() []sample {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	samples := make([]sample, 0, len(p.totals))
+	for k, n := range p.totals {
+		samples = append(samples, sample{labels: []string{k[0], k[1]}, value: n})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].labels, samples[j].labels
+		return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+	})
+	return samples
+}
+
+// adminJobs lists the background jobs.
+func (c *controller) adminJobs(w http.ResponseWriter, r *http.Request) {
+	active, finished := c.workers.jobs()
+	w.Header().Set("Cache-Control", "no-store")
+	c.writeJSON(w, r, struct {
+		Workers  int   `json:"workers"`
+		Active   []Job `json:"active"`
+		Finished []Job `json:"finished"`
+	}{cap(c.workers.slots), active, finished})
+}